@@ -195,6 +195,10 @@ func (s *verboseService) formatEvent(ev events.Event) string {
 			success = "failed"
 		}
 		return fmt.Sprintf("Login %s for username %s.", success, username)
+
+	case events.LocalItemRenamed:
+		data := ev.Data.(map[string]string)
+		return fmt.Sprintf("Renamed %q to %q in folder %q", data["from"], data["to"], data["folder"])
 	}
 
 	return fmt.Sprintf("%s %#v", ev.Type, ev)
@@ -45,6 +45,7 @@ const (
 	FolderResumed
 	ListenAddressesChanged
 	LoginAttempt
+	LocalItemRenamed
 
 	AllEvents = (1 << iota) - 1
 )
@@ -109,6 +110,8 @@ func (t EventType) String() string {
 		return "ListenAddressesChanged"
 	case LoginAttempt:
 		return "LoginAttempt"
+	case LocalItemRenamed:
+		return "LocalItemRenamed"
 	default:
 		return "Unknown"
 	}
@@ -174,6 +177,8 @@ func UnmarshalEventType(s string) EventType {
 		return ListenAddressesChanged
 	case "LoginAttempt":
 		return LoginAttempt
+	case "LocalItemRenamed":
+		return LocalItemRenamed
 	default:
 		return 0
 	}
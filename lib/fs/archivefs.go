@@ -0,0 +1,441 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errArchiveReadOnly    = errors.New("archive is read only")
+	errArchiveSeekBack    = errors.New("cannot seek backwards in compressed archive member")
+	errArchiveUnsupported = errors.New("unsupported archive format")
+)
+
+// The ArchiveFilesystem presents the members of a zip or tar archive as a
+// read only directory tree, without extracting it. Names are interpreted
+// relative to the root of the archive, so "", "." and "/" all refer to the
+// root directory. Directories that are implied by member names but not
+// present in the archive itself are synthesized.
+type ArchiveFilesystem struct {
+	fd       *os.File
+	entries  map[string]*archiveEntry
+	children map[string][]string
+}
+
+// An archiveEntry is a single member of the archive.
+type archiveEntry struct {
+	name    string
+	mode    os.FileMode
+	size    int64
+	modTime time.Time
+	target  string
+	// Exactly one of section or open is set for regular files. The
+	// section is used for members stored uncompressed, allowing random
+	// access.
+	section *io.SectionReader
+	open    func() (io.ReadCloser, error)
+}
+
+// NewArchiveFilesystem opens the given zip or tar archive, choosing the
+// format based on the file extension. Compressed tar archives are not
+// supported as they don't allow access to individual members.
+func NewArchiveFilesystem(name string) (*ArchiveFilesystem, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	f := &ArchiveFilesystem{
+		fd:       fd,
+		entries:  make(map[string]*archiveEntry),
+		children: make(map[string][]string),
+	}
+	f.entries["."] = &archiveEntry{
+		name:    ".",
+		mode:    os.ModeDir | 0755,
+		modTime: info.ModTime(),
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".zip":
+		err = f.loadZip(info.Size())
+	case ".tar":
+		err = f.loadTar()
+	default:
+		err = errArchiveUnsupported
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	for _, names := range f.children {
+		sort.Strings(names)
+	}
+
+	return f, nil
+}
+
+// Close releases the underlying archive file.
+func (f *ArchiveFilesystem) Close() error {
+	return f.fd.Close()
+}
+
+func (f *ArchiveFilesystem) loadZip(size int64) error {
+	zr, err := zip.NewReader(f.fd, size)
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range zr.File {
+		e := &archiveEntry{
+			mode:    zf.Mode(),
+			size:    int64(zf.UncompressedSize64),
+			modTime: zf.ModTime(),
+			open:    zf.Open,
+		}
+		if zf.Method == zip.Store {
+			if offset, err := zf.DataOffset(); err == nil {
+				e.section = io.NewSectionReader(f.fd, offset, int64(zf.CompressedSize64))
+				e.open = nil
+			}
+		}
+		if e.mode&os.ModeSymlink != 0 {
+			// The link target is stored as the member contents.
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			bs, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			e.target = string(bs)
+			e.size = 0
+		}
+		f.add(zf.Name, e)
+	}
+	return nil
+}
+
+func (f *ArchiveFilesystem) loadTar() error {
+	cr := &countingReadSeeker{ReadSeeker: f.fd}
+	tr := tar.NewReader(cr)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		e := &archiveEntry{
+			mode:    hdr.FileInfo().Mode(),
+			modTime: hdr.ModTime,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+		case tar.TypeSymlink:
+			e.target = hdr.Linkname
+		case tar.TypeReg, tar.TypeRegA:
+			// The reader is positioned at the start of the member data,
+			// which is stored as is in an uncompressed tar.
+			e.size = hdr.Size
+			e.section = io.NewSectionReader(f.fd, cr.pos, hdr.Size)
+		default:
+			// Hard links, devices, sparse files and so on are not
+			// represented.
+			continue
+		}
+		f.add(hdr.Name, e)
+	}
+}
+
+// add inserts the entry under the given archive member name, synthesizing
+// any missing parent directories.
+func (f *ArchiveFilesystem) add(name string, e *archiveEntry) {
+	key := archiveKey(name)
+	if key == "." {
+		return
+	}
+	e.name = path.Base(key)
+	if _, ok := f.entries[key]; !ok {
+		parent := path.Dir(key)
+		f.addDir(parent, e.modTime)
+		f.children[parent] = append(f.children[parent], e.name)
+	}
+	f.entries[key] = e
+}
+
+func (f *ArchiveFilesystem) addDir(key string, modTime time.Time) {
+	if _, ok := f.entries[key]; ok {
+		return
+	}
+	parent := path.Dir(key)
+	f.addDir(parent, modTime)
+	f.children[parent] = append(f.children[parent], path.Base(key))
+	f.entries[key] = &archiveEntry{
+		name:    path.Base(key),
+		mode:    os.ModeDir | 0755,
+		modTime: modTime,
+	}
+}
+
+// archiveKey returns the canonical form of the given name, as used as the
+// key for the entries map.
+func archiveKey(name string) string {
+	key := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if key == "" {
+		return "."
+	}
+	return key
+}
+
+func (f *ArchiveFilesystem) entry(name string) (*archiveEntry, error) {
+	e, ok := f.entries[archiveKey(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (f *ArchiveFilesystem) Lstat(name string) (FileInfo, error) {
+	e, err := f.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	return archiveFileInfo{e}, nil
+}
+
+func (f *ArchiveFilesystem) Stat(name string) (FileInfo, error) {
+	// Symlinks are only followed within the archive.
+	for i := 0; i < 255; i++ {
+		e, err := f.entry(name)
+		if err != nil {
+			return nil, err
+		}
+		if e.mode&os.ModeSymlink == 0 {
+			return archiveFileInfo{e}, nil
+		}
+		if path.IsAbs(e.target) {
+			name = e.target
+		} else {
+			name = path.Join(path.Dir(archiveKey(name)), e.target)
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: errors.New("too many levels of symbolic links")}
+}
+
+func (f *ArchiveFilesystem) DirNames(name string) ([]string, error) {
+	e, err := f.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: errors.New("not a directory")}
+	}
+	return append([]string(nil), f.children[archiveKey(name)]...), nil
+}
+
+func (f *ArchiveFilesystem) Open(name string) (File, error) {
+	e, err := f.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.mode.IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("not a regular file")}
+	}
+	if e.section != nil {
+		return &archiveFile{entry: e, ReadSeeker: io.NewSectionReader(e.section, 0, e.size)}, nil
+	}
+	rc, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{entry: e, ReadSeeker: &forwardSeeker{Reader: rc}, closer: rc}, nil
+}
+
+func (f *ArchiveFilesystem) ReadSymlink(name string) (string, error) {
+	e, err := f.entry(name)
+	if err != nil {
+		return "", err
+	}
+	if e.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: errors.New("not a symlink")}
+	}
+	return e.target, nil
+}
+
+// AllocatedSize returns zero, as archive members don't have an allocated
+// size of their own.
+func (f *ArchiveFilesystem) AllocatedSize(name string) (int64, error) {
+	if _, err := f.entry(name); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// DeviceID returns the same ID for all members, as the archive is a
+// single filesystem.
+func (f *ArchiveFilesystem) DeviceID(name string) (uint64, error) {
+	if _, err := f.entry(name); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// Streams returns nothing, as archive members have no streams other than
+// their contents.
+func (f *ArchiveFilesystem) Streams(name string) ([]Stream, error) {
+	if _, err := f.entry(name); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (f *ArchiveFilesystem) SymlinksSupported() bool {
+	return true
+}
+
+func (f *ArchiveFilesystem) Walk(root string, walkFn WalkFunc) error {
+	return walkRoot(f, root, walkFn)
+}
+
+func (f *ArchiveFilesystem) Chmod(name string, mode FileMode) error {
+	return errArchiveReadOnly
+}
+
+func (f *ArchiveFilesystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return errArchiveReadOnly
+}
+
+func (f *ArchiveFilesystem) Create(name string) (File, error) {
+	return nil, errArchiveReadOnly
+}
+
+func (f *ArchiveFilesystem) CreateSymlink(name, target string) error {
+	return errArchiveReadOnly
+}
+
+func (f *ArchiveFilesystem) Mkdir(name string, perm FileMode) error {
+	return errArchiveReadOnly
+}
+
+func (f *ArchiveFilesystem) Remove(name string) error {
+	return errArchiveReadOnly
+}
+
+func (f *ArchiveFilesystem) Rename(oldname, newname string) error {
+	return errArchiveReadOnly
+}
+
+// archiveFile implements the fs.File interface for reading an archive member.
+type archiveFile struct {
+	io.ReadSeeker
+	entry  *archiveEntry
+	closer io.Closer
+}
+
+func (f *archiveFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errArchiveReadOnly
+}
+
+func (f *archiveFile) Truncate(size int64) error {
+	return errArchiveReadOnly
+}
+
+func (f *archiveFile) Stat() (FileInfo, error) {
+	return archiveFileInfo{f.entry}, nil
+}
+
+func (f *archiveFile) Close() error {
+	if f.closer != nil {
+		return f.closer.Close()
+	}
+	return nil
+}
+
+// archiveFileInfo implements the fs.FileInfo interface for an archive member.
+type archiveFileInfo struct {
+	e *archiveEntry
+}
+
+func (i archiveFileInfo) Name() string       { return i.e.name }
+func (i archiveFileInfo) Mode() FileMode     { return FileMode(i.e.mode) }
+func (i archiveFileInfo) Size() int64        { return i.e.size }
+func (i archiveFileInfo) ModTime() time.Time { return i.e.modTime }
+func (i archiveFileInfo) IsDir() bool        { return i.e.mode.IsDir() }
+func (i archiveFileInfo) IsRegular() bool    { return i.e.mode.IsRegular() }
+func (i archiveFileInfo) IsSymlink() bool    { return i.e.mode&os.ModeSymlink != 0 }
+
+// A forwardSeeker makes a plain reader seekable, as long as the seeks only
+// move forwards. This is sufficient for hashing compressed members.
+type forwardSeeker struct {
+	io.Reader
+	pos int64
+}
+
+func (s *forwardSeeker) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *forwardSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		offset -= s.pos
+	case io.SeekCurrent:
+	default:
+		return s.pos, errArchiveSeekBack
+	}
+	if offset < 0 {
+		return s.pos, errArchiveSeekBack
+	}
+	_, err := io.CopyN(ioutil.Discard, s, offset)
+	return s.pos, err
+}
+
+// A countingReadSeeker keeps track of the current position in the
+// underlying stream.
+type countingReadSeeker struct {
+	io.ReadSeeker
+	pos int64
+}
+
+func (c *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.ReadSeeker.Read(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *countingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := c.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		c.pos = pos
+	}
+	return pos, err
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestArchiveFilesystemZip(t *testing.T) {
+	os.RemoveAll("_archive")
+	defer os.RemoveAll("_archive")
+	os.Mkdir("_archive", 0755)
+
+	fd, err := os.Create("_archive/test.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(fd)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "dir/deflated", Method: zip.Deflate})
+	w.Write([]byte("deflated contents"))
+	w, _ = zw.CreateHeader(&zip.FileHeader{Name: "stored", Method: zip.Store})
+	w.Write([]byte("stored contents"))
+	hdr := &zip.FileHeader{Name: "link"}
+	hdr.SetMode(os.ModeSymlink | 0777)
+	w, _ = zw.CreateHeader(hdr)
+	w.Write([]byte("dir/deflated"))
+	zw.Close()
+	fd.Close()
+
+	testArchiveFilesystem(t, "_archive/test.zip", map[string]string{
+		"dir":          "",
+		"dir/deflated": "deflated contents",
+		"stored":       "stored contents",
+		"link":         "-> dir/deflated",
+	})
+}
+
+func TestArchiveFilesystemTar(t *testing.T) {
+	os.RemoveAll("_archive")
+	defer os.RemoveAll("_archive")
+	os.Mkdir("_archive", 0755)
+
+	fd, err := os.Create("_archive/test.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(fd)
+	for _, m := range []struct{ name, data string }{
+		{"a/b/file", "tar contents"},
+		{"other", "more tar contents"},
+	} {
+		tw.WriteHeader(&tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.data)), Typeflag: tar.TypeReg, ModTime: time.Now()})
+		tw.Write([]byte(m.data))
+	}
+	tw.WriteHeader(&tar.Header{Name: "link", Linkname: "other", Typeflag: tar.TypeSymlink, ModTime: time.Now()})
+	tw.Close()
+	fd.Close()
+
+	testArchiveFilesystem(t, "_archive/test.tar", map[string]string{
+		"a":        "",
+		"a/b":      "",
+		"a/b/file": "tar contents",
+		"other":    "more tar contents",
+		"link":     "-> other",
+	})
+}
+
+func testArchiveFilesystem(t *testing.T, archive string, expected map[string]string) {
+	afs, err := NewArchiveFilesystem(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer afs.Close()
+
+	var seen []string
+	err = afs.Walk("/", func(path string, info FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.ToSlash(path[1:])
+		if name == "" {
+			if !info.IsDir() {
+				t.Error("root is not a directory")
+			}
+			return nil
+		}
+		seen = append(seen, name)
+
+		exp, ok := expected[name]
+		switch {
+		case !ok:
+			t.Errorf("unexpected entry %q", name)
+		case info.IsSymlink():
+			target, err := afs.ReadSymlink(path)
+			if err != nil {
+				t.Error(err)
+			} else if "-> "+target != exp {
+				t.Errorf("%s: incorrect target %q", name, target)
+			}
+		case info.IsDir():
+			if exp != "" {
+				t.Errorf("%s: unexpected directory", name)
+			}
+		case info.IsRegular():
+			if info.Size() != int64(len(exp)) {
+				t.Errorf("%s: incorrect size %d", name, info.Size())
+			}
+			fd, err := afs.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Skip a couple of bytes to exercise seeking
+			if _, err := fd.Seek(2, io.SeekStart); err != nil {
+				t.Error(err)
+			}
+			bs, err := ioutil.ReadAll(fd)
+			fd.Close()
+			if err != nil {
+				t.Error(err)
+			} else if string(bs) != exp[2:] {
+				t.Errorf("%s: incorrect contents %q", name, bs)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != len(expected) {
+		sort.Strings(seen)
+		t.Errorf("incorrect entries %v", seen)
+	}
+
+	if err := afs.Remove("other"); err == nil {
+		t.Error("unexpected successful remove")
+	}
+}
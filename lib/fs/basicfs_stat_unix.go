@@ -0,0 +1,43 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package fs
+
+import (
+	"errors"
+	"syscall"
+)
+
+// DeviceID returns the ID of the device holding the file.
+func (f *BasicFilesystem) DeviceID(name string) (uint64, error) {
+	fi, err := underlyingLstat(name)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errors.New("device ID not available")
+	}
+	return uint64(st.Dev), nil
+}
+
+// AllocatedSize returns the amount of disk space allocated to the file,
+// which is less than its size for sparse files.
+func (f *BasicFilesystem) AllocatedSize(name string) (int64, error) {
+	fi, err := underlyingLstat(name)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, nil
+	}
+	// The block count is in units of 512 bytes, regardless of the block
+	// size of the filesystem.
+	return int64(st.Blocks) * 512, nil
+}
@@ -0,0 +1,18 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package fs
+
+// Streams returns nothing, as files have no streams other than their
+// contents on this platform.
+func (f *BasicFilesystem) Streams(name string) ([]Stream, error) {
+	if _, err := underlyingLstat(name); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
@@ -0,0 +1,78 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package fs
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32          = syscall.NewLazyDLL("kernel32.dll")
+	procFindFirstStreamW = modkernel32.NewProc("FindFirstStreamW")
+	procFindNextStreamW  = modkernel32.NewProc("FindNextStreamW")
+)
+
+const (
+	findStreamInfoStandard = 0
+	errorHandleEOF         = syscall.Errno(38)
+)
+
+// win32FindStreamData is WIN32_FIND_STREAM_DATA.
+type win32FindStreamData struct {
+	StreamSize int64
+	StreamName [syscall.MAX_PATH + 36]uint16
+}
+
+// Streams returns the alternate data streams of the file. The unnamed
+// stream, which is the contents of the file, is not included.
+func (f *BasicFilesystem) Streams(name string) ([]Stream, error) {
+	pathp, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var data win32FindStreamData
+	h, _, e := procFindFirstStreamW.Call(uintptr(unsafe.Pointer(pathp)), findStreamInfoStandard, uintptr(unsafe.Pointer(&data)), 0)
+	if syscall.Handle(h) == syscall.InvalidHandle {
+		if e == errorHandleEOF {
+			// No streams at all, as for some directories.
+			return nil, nil
+		}
+		return nil, &os.PathError{Op: "FindFirstStream", Path: name, Err: e}
+	}
+	defer syscall.FindClose(syscall.Handle(h))
+
+	var streams []Stream
+	for {
+		if sname, ok := parseStreamName(syscall.UTF16ToString(data.StreamName[:])); ok {
+			streams = append(streams, Stream{Name: sname, Size: data.StreamSize})
+		}
+		if r, _, e := procFindNextStreamW.Call(h, uintptr(unsafe.Pointer(&data))); r == 0 {
+			if e == errorHandleEOF {
+				return streams, nil
+			}
+			return nil, &os.PathError{Op: "FindNextStream", Path: name, Err: e}
+		}
+	}
+}
+
+// parseStreamName returns the name of a named data stream, given as
+// ":name:$DATA". The unnamed stream "::$DATA" and streams of other types
+// are not.
+func parseStreamName(s string) (string, bool) {
+	s = strings.TrimPrefix(s, ":")
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || s[i+1:] != "$DATA" {
+		return "", false
+	}
+	return s[:i], true
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseStreamName(t *testing.T) {
+	cases := []struct {
+		in   string
+		name string
+		ok   bool
+	}{
+		{"::$DATA", "", false},
+		{":Zone.Identifier:$DATA", "Zone.Identifier", true},
+		{":a:b:$DATA", "a:b", true},
+		{":other:$OTHER", "", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		if name, ok := parseStreamName(c.in); name != c.name || ok != c.ok {
+			t.Errorf("parseStreamName(%q) = %q, %v; expected %q, %v", c.in, name, ok, c.name, c.ok)
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name+":extra", []byte("ads"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	streams, err := NewBasicFilesystem().Streams(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || streams[0] != (Stream{Name: "extra", Size: 3}) {
+		t.Errorf("unexpected streams %v", streams)
+	}
+}
@@ -3,14 +3,17 @@
 // license that can be found in the LICENSE file.
 
 // This part copied directly from golang.org/src/path/filepath/path.go (Go
-// 1.6) and lightly modified to be methods on BasicFilesystem.
+// 1.6) and lightly modified to work on any Filesystem.
 
 // In our Walk() all paths given to a WalkFunc() are relative to the
 // filesystem root.
 
 package fs
 
-import "path/filepath"
+import (
+	"path/filepath"
+	"sort"
+)
 
 // WalkFunc is the type of the function called for each file or directory
 // visited by Walk. The path argument contains the argument to Walk as a
@@ -29,7 +32,7 @@ import "path/filepath"
 type WalkFunc func(path string, info FileInfo, err error) error
 
 // walk recursively descends path, calling walkFn.
-func (f *BasicFilesystem) walk(path string, info FileInfo, walkFn WalkFunc) error {
+func walk(f Filesystem, path string, info FileInfo, walkFn WalkFunc) error {
 	err := walkFn(path, info, nil)
 	if err != nil {
 		if info.IsDir() && err == SkipDir {
@@ -46,6 +49,7 @@ func (f *BasicFilesystem) walk(path string, info FileInfo, walkFn WalkFunc) erro
 	if err != nil {
 		return walkFn(path, info, err)
 	}
+	sort.Strings(names)
 
 	for _, name := range names {
 		filename := filepath.Join(path, name)
@@ -55,7 +59,7 @@ func (f *BasicFilesystem) walk(path string, info FileInfo, walkFn WalkFunc) erro
 				return err
 			}
 		} else {
-			err = f.walk(filename, fileInfo, walkFn)
+			err = walk(f, filename, fileInfo, walkFn)
 			if err != nil {
 				if !fileInfo.IsDir() || err != SkipDir {
 					return err
@@ -73,9 +77,15 @@ func (f *BasicFilesystem) walk(path string, info FileInfo, walkFn WalkFunc) erro
 // large directories Walk can be inefficient.
 // Walk does not follow symbolic links.
 func (f *BasicFilesystem) Walk(root string, walkFn WalkFunc) error {
+	return walkRoot(f, root, walkFn)
+}
+
+// walkRoot implements Walk for any Filesystem in terms of its Lstat and
+// DirNames methods.
+func walkRoot(f Filesystem, root string, walkFn WalkFunc) error {
 	info, err := f.Lstat(root)
 	if err != nil {
 		return walkFn(root, nil, err)
 	}
-	return f.walk(root, info, walkFn)
+	return walk(f, root, info, walkFn)
 }
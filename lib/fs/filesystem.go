@@ -15,10 +15,12 @@ import (
 
 // The Filesystem interface abstracts access to the file system.
 type Filesystem interface {
+	AllocatedSize(name string) (int64, error)
 	Chmod(name string, mode FileMode) error
 	Chtimes(name string, atime time.Time, mtime time.Time) error
 	Create(name string) (File, error)
 	CreateSymlink(name, target string) error
+	DeviceID(name string) (uint64, error)
 	DirNames(name string) ([]string, error)
 	Lstat(name string) (FileInfo, error)
 	Mkdir(name string, perm FileMode) error
@@ -27,6 +29,7 @@ type Filesystem interface {
 	Remove(name string) error
 	Rename(oldname, newname string) error
 	Stat(name string) (FileInfo, error)
+	Streams(name string) ([]Stream, error)
 	SymlinksSupported() bool
 	Walk(root string, walkFn WalkFunc) error
 }
@@ -35,6 +38,7 @@ type Filesystem interface {
 // smaller interface than os.File
 type File interface {
 	io.Reader
+	io.Seeker
 	io.WriterAt
 	io.Closer
 	Truncate(size int64) error
@@ -56,6 +60,13 @@ type FileInfo interface {
 	IsSymlink() bool
 }
 
+// A Stream is a named data stream of a file, in addition to its contents,
+// such as an alternate data stream on NTFS.
+type Stream struct {
+	Name string
+	Size int64
+}
+
 // FileMode is similar to os.FileMode
 type FileMode uint32
 
@@ -0,0 +1,249 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errObjectReadOnly   = errors.New("object store is read only")
+	errObjectBadSeek    = errors.New("invalid seek in object")
+	errObjectNotRegular = errors.New("not a regular file")
+)
+
+// An ObjectStore is a flat store of objects addressed by key, such as an S3
+// or GCS bucket. Keys use forward slashes as separators.
+type ObjectStore interface {
+	// List returns all objects whose keys start with the prefix.
+	List(prefix string) ([]ObjectInfo, error)
+	// ReadRange returns the given number of bytes of the object, starting
+	// at offset, such as with an HTTP range request.
+	ReadRange(key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// ObjectInfo describes an object in an ObjectStore. Keys ending in a slash
+// are taken to be directories, as some tools create them.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// The ObjectFilesystem presents the objects of an ObjectStore under a key
+// prefix as a read only directory tree. Directories are synthesized from
+// the keys, and the contents are read with range requests, so that files
+// can be hashed without fetching more of them than needed. The objects
+// are listed once, when the filesystem is created; create a new one to
+// see later changes.
+type ObjectFilesystem struct {
+	store  ObjectStore
+	prefix string
+	// tree holds the objects as archive entries, which they resemble.
+	tree *ArchiveFilesystem
+}
+
+// NewObjectFilesystem lists the objects of the store under the prefix,
+// which should end in a slash unless empty.
+func NewObjectFilesystem(store ObjectStore, prefix string) (*ObjectFilesystem, error) {
+	objects, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &ArchiveFilesystem{
+		entries:  make(map[string]*archiveEntry),
+		children: make(map[string][]string),
+	}
+	tree.entries["."] = &archiveEntry{
+		name: ".",
+		mode: os.ModeDir | 0755,
+	}
+	for _, o := range objects {
+		name := strings.TrimPrefix(o.Key, prefix)
+		if strings.HasSuffix(name, "/") {
+			tree.addDir(archiveKey(name), o.ModTime)
+			continue
+		}
+		tree.add(name, &archiveEntry{
+			mode:    0644,
+			size:    o.Size,
+			modTime: o.ModTime,
+		})
+	}
+	for _, names := range tree.children {
+		sort.Strings(names)
+	}
+
+	return &ObjectFilesystem{
+		store:  store,
+		prefix: prefix,
+		tree:   tree,
+	}, nil
+}
+
+func (f *ObjectFilesystem) Lstat(name string) (FileInfo, error) {
+	return f.tree.Lstat(name)
+}
+
+func (f *ObjectFilesystem) Stat(name string) (FileInfo, error) {
+	return f.tree.Lstat(name)
+}
+
+func (f *ObjectFilesystem) DirNames(name string) ([]string, error) {
+	return f.tree.DirNames(name)
+}
+
+func (f *ObjectFilesystem) Open(name string) (File, error) {
+	e, err := f.tree.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.mode.IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errObjectNotRegular}
+	}
+	return &objectFile{
+		store: f.store,
+		key:   f.prefix + archiveKey(name),
+		entry: e,
+	}, nil
+}
+
+// ReadSymlink always fails, as object stores have no symlinks.
+func (f *ObjectFilesystem) ReadSymlink(name string) (string, error) {
+	return f.tree.ReadSymlink(name)
+}
+
+// AllocatedSize returns zero, as there is no telling how objects are
+// stored.
+func (f *ObjectFilesystem) AllocatedSize(name string) (int64, error) {
+	return f.tree.AllocatedSize(name)
+}
+
+// DeviceID returns the same ID for all objects, as the store is a single
+// filesystem.
+func (f *ObjectFilesystem) DeviceID(name string) (uint64, error) {
+	return f.tree.DeviceID(name)
+}
+
+// Streams returns nothing, as objects have no streams other than their
+// contents.
+func (f *ObjectFilesystem) Streams(name string) ([]Stream, error) {
+	return f.tree.Streams(name)
+}
+
+func (f *ObjectFilesystem) SymlinksSupported() bool {
+	return false
+}
+
+func (f *ObjectFilesystem) Walk(root string, walkFn WalkFunc) error {
+	return walkRoot(f, root, walkFn)
+}
+
+func (f *ObjectFilesystem) Chmod(name string, mode FileMode) error {
+	return errObjectReadOnly
+}
+
+func (f *ObjectFilesystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return errObjectReadOnly
+}
+
+func (f *ObjectFilesystem) Create(name string) (File, error) {
+	return nil, errObjectReadOnly
+}
+
+func (f *ObjectFilesystem) CreateSymlink(name, target string) error {
+	return errObjectReadOnly
+}
+
+func (f *ObjectFilesystem) Mkdir(name string, perm FileMode) error {
+	return errObjectReadOnly
+}
+
+func (f *ObjectFilesystem) Remove(name string) error {
+	return errObjectReadOnly
+}
+
+func (f *ObjectFilesystem) Rename(oldname, newname string) error {
+	return errObjectReadOnly
+}
+
+// objectFile implements the fs.File interface for reading an object. It
+// reads from the current position to the end of the object with a single
+// range request, and makes a new one after seeking elsewhere.
+type objectFile struct {
+	store ObjectStore
+	key   string
+	entry *archiveEntry
+	pos   int64
+	body  io.ReadCloser
+}
+
+func (f *objectFile) Read(p []byte) (int, error) {
+	if f.pos >= f.entry.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.store.ReadRange(f.key, f.pos, f.entry.size-f.pos)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.pos += int64(n)
+	if err == io.EOF && f.pos < f.entry.size {
+		// The object is shorter than it was when listed.
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.entry.size
+	default:
+		return f.pos, errObjectBadSeek
+	}
+	if offset < 0 {
+		return f.pos, errObjectBadSeek
+	}
+	if offset != f.pos && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+func (f *objectFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errObjectReadOnly
+}
+
+func (f *objectFile) Truncate(size int64) error {
+	return errObjectReadOnly
+}
+
+func (f *objectFile) Stat() (FileInfo, error) {
+	return archiveFileInfo{f.entry}, nil
+}
+
+func (f *objectFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeObjectStore keeps objects in memory, and records the ranges read.
+type fakeObjectStore struct {
+	objects map[string]string
+	ranges  []string
+}
+
+func (s *fakeObjectStore) List(prefix string) ([]ObjectInfo, error) {
+	var infos []ObjectInfo
+	for key, data := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, ObjectInfo{Key: key, Size: int64(len(data)), ModTime: time.Unix(1234567890, 0)})
+		}
+	}
+	return infos, nil
+}
+
+func (s *fakeObjectStore) ReadRange(key string, offset, length int64) (io.ReadCloser, error) {
+	s.ranges = append(s.ranges, fmt.Sprintf("%s:%d+%d", key, offset, length))
+	data := s.objects[key]
+	return ioutil.NopCloser(strings.NewReader(data[offset : offset+length])), nil
+}
+
+func TestObjectFilesystem(t *testing.T) {
+	store := &fakeObjectStore{
+		objects: map[string]string{
+			"folder/a/b/file": "object contents",
+			"folder/empty/":   "",
+			"folder/other":    "more object contents",
+			"elsewhere":       "not in the folder",
+		},
+	}
+	ofs, err := NewObjectFilesystem(store, "folder/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	err = ofs.Walk(".", func(path string, info FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != "." {
+			seen = append(seen, filepath.ToSlash(path))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(seen)
+	if expected := []string{"a", "a/b", "a/b/file", "empty", "other"}; !reflect.DeepEqual(seen, expected) {
+		t.Errorf("walked %v, expected %v", seen, expected)
+	}
+
+	if info, err := ofs.Lstat("empty"); err != nil || !info.IsDir() {
+		t.Errorf("empty is not a directory: %v, %v", info, err)
+	}
+	info, err := ofs.Lstat("a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsRegular() || info.Size() != 15 || !info.ModTime().Equal(time.Unix(1234567890, 0)) {
+		t.Errorf("unexpected file info %v", info)
+	}
+
+	fd, err := ofs.Open("a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(fd, buf); err != nil || string(buf) != "object" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	if _, err := fd.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(fd)
+	if err != nil || !bytes.Equal(rest, []byte("tents")) {
+		t.Errorf("read %q, %v", rest, err)
+	}
+
+	// Only what's read is requested.
+	if expected := []string{"folder/a/b/file:0+15", "folder/a/b/file:10+5"}; !reflect.DeepEqual(store.ranges, expected) {
+		t.Errorf("read ranges %v, expected %v", store.ranges, expected)
+	}
+
+	if _, err := ofs.Create("new"); err != errObjectReadOnly {
+		t.Errorf("unexpected error %v creating a file", err)
+	}
+}
@@ -34,6 +34,17 @@ type Pattern struct {
 	pattern string
 	match   glob.Glob
 	result  Result
+	source  PatternSource
+}
+
+// A PatternSource is the line of an ignore file that a pattern came from.
+type PatternSource struct {
+	// File is the ignore file, which may be one that was included.
+	File string
+	// Line is the line number in File, starting at one.
+	Line int
+	// Text is the line as written.
+	Text string
 }
 
 func (p Pattern) String() string {
@@ -128,7 +139,11 @@ func (m *Matcher) parseLocked(r io.Reader, file string) error {
 
 	newHash := hashPatterns(patterns)
 	if newHash == m.curHash {
-		// We've already loaded exactly these patterns.
+		// We've already loaded exactly these patterns, and the cached
+		// results remain valid. They may have moved around in the
+		// file though.
+		m.lines = lines
+		m.patterns = patterns
 		return err
 	}
 
@@ -187,7 +202,33 @@ func (m *Matcher) Match(file string) (result Result) {
 		}()
 	}
 
-	// Check all the patterns for a match.
+	if pattern, ok := m.matchLocked(file); ok {
+		return pattern.result
+	}
+
+	// Default to not matching.
+	return resultNotMatched
+}
+
+// MatchSource is like Match, but also returns where the pattern that
+// matched came from. It does not use the cache, as it's meant for
+// explaining a result rather than for every file.
+func (m *Matcher) MatchSource(file string) (Result, PatternSource) {
+	if m == nil {
+		return resultNotMatched, PatternSource{}
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if pattern, ok := m.matchLocked(file); ok {
+		return pattern.result, pattern.source
+	}
+	return resultNotMatched, PatternSource{}
+}
+
+// matchLocked returns the first pattern matching the file, if any.
+func (m *Matcher) matchLocked(file string) (Pattern, bool) {
 	file = filepath.ToSlash(file)
 	var lowercaseFile string
 	for _, pattern := range m.patterns {
@@ -196,17 +237,15 @@ func (m *Matcher) Match(file string) (result Result) {
 				lowercaseFile = strings.ToLower(file)
 			}
 			if pattern.match.Match(lowercaseFile) {
-				return pattern.result
+				return pattern, true
 			}
 		} else {
 			if pattern.match.Match(file) {
-				return pattern.result
+				return pattern, true
 			}
 		}
 	}
-
-	// Default to not matching.
-	return resultNotMatched
+	return Pattern{}, false
 }
 
 // Lines return a list of the unprocessed lines in .stignore at last load
@@ -313,9 +352,11 @@ func parseIgnoreFile(fd io.Reader, currentFile string, modtimes map[string]time.
 		defaultResult |= resultFoldCase
 	}
 
+	var source PatternSource
 	addPattern := func(line string) error {
 		pattern := Pattern{
 			result: defaultResult,
+			source: source,
 		}
 
 		// Allow prefixes to be specified in any order, but only once.
@@ -399,9 +440,12 @@ func parseIgnoreFile(fd io.Reader, currentFile string, modtimes map[string]time.
 
 	scanner := bufio.NewScanner(fd)
 	var err error
+	lineNo := 0
 	for scanner.Scan() {
+		lineNo++
 		line := strings.TrimSpace(scanner.Text())
 		lines = append(lines, line)
+		source = PatternSource{File: currentFile, Line: lineNo, Text: line}
 		switch {
 		case line == "":
 			continue
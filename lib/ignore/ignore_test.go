@@ -843,3 +843,39 @@ func TestIsInternal(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchSource(t *testing.T) {
+	stignore := `// comment
+
+foo
+!bar
+(?i)baz/
+`
+	pats := New(true)
+	err := pats.Parse(bytes.NewBufferString(stignore), "testdata/.stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		f       string
+		ignored bool
+		source  PatternSource
+	}{
+		{"foo", true, PatternSource{"testdata/.stignore", 3, "foo"}},
+		{"dir/foo/x", true, PatternSource{"testdata/.stignore", 3, "foo"}},
+		{"bar", false, PatternSource{"testdata/.stignore", 4, "!bar"}},
+		{"BAZ/x", true, PatternSource{"testdata/.stignore", 5, "(?i)baz/"}},
+		{"other", false, PatternSource{}},
+	}
+
+	for _, tc := range tests {
+		res, source := pats.MatchSource(filepath.FromSlash(tc.f))
+		if res.IsIgnored() != tc.ignored {
+			t.Errorf("Incorrect result for %q: %v", tc.f, res)
+		}
+		if source != tc.source {
+			t.Errorf("Incorrect source for %q: %+v != %+v", tc.f, source, tc.source)
+		}
+	}
+}
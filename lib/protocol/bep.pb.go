@@ -309,6 +309,7 @@ type FileInfo struct {
 	Sequence      int64        `protobuf:"varint,10,opt,name=sequence,proto3" json:"sequence,omitempty"`
 	Blocks        []BlockInfo  `protobuf:"bytes,16,rep,name=Blocks" json:"Blocks"`
 	SymlinkTarget string       `protobuf:"bytes,17,opt,name=symlink_target,json=symlinkTarget,proto3" json:"symlink_target,omitempty"`
+	Decompressed  bool         `protobuf:"varint,18,opt,name=decompressed,proto3" json:"decompressed,omitempty"`
 }
 
 func (m *FileInfo) Reset()                    { *m = FileInfo{} }
@@ -899,6 +900,18 @@ func (m *FileInfo) MarshalTo(dAtA []byte) (int, error) {
 		i = encodeVarintBep(dAtA, i, uint64(len(m.SymlinkTarget)))
 		i += copy(dAtA[i:], m.SymlinkTarget)
 	}
+	if m.Decompressed {
+		dAtA[i] = 0x90
+		i++
+		dAtA[i] = 0x1
+		i++
+		if m.Decompressed {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
 	return i, nil
 }
 
@@ -1438,6 +1451,9 @@ func (m *FileInfo) ProtoSize() (n int) {
 	if l > 0 {
 		n += 2 + l + sovBep(uint64(l))
 	}
+	if m.Decompressed {
+		n += 3
+	}
 	return n
 }
 
@@ -2965,6 +2981,26 @@ func (m *FileInfo) Unmarshal(dAtA []byte) error {
 			}
 			m.SymlinkTarget = string(dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 18:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Decompressed", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowBep
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Decompressed = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipBep(dAtA[iNdEx:])
@@ -4165,114 +4201,114 @@ var (
 func init() { proto.RegisterFile("bep.proto", fileDescriptorBep) }
 
 var fileDescriptorBep = []byte{
-	// 1729 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0x4f, 0x8f, 0xdb, 0xc6,
-	0x15, 0x17, 0x25, 0xea, 0xdf, 0x93, 0x76, 0xc3, 0x1d, 0xdb, 0x5b, 0x96, 0xd9, 0x68, 0x69, 0xc5,
-	0x8e, 0x37, 0x8b, 0x64, 0xe3, 0x26, 0x69, 0x8b, 0x16, 0x6d, 0x01, 0xfd, 0xe1, 0xae, 0x85, 0xca,
-	0x94, 0x3a, 0xd2, 0x3a, 0x75, 0x0e, 0x25, 0x28, 0x71, 0xa4, 0x25, 0x4c, 0x71, 0x54, 0x92, 0x5a,
-	0x5b, 0xfd, 0x08, 0xfa, 0x04, 0xbd, 0x08, 0x08, 0xd0, 0x53, 0xef, 0xfd, 0x10, 0x3e, 0x06, 0x3d,
-	0xf4, 0xd0, 0x83, 0xd1, 0x6c, 0x2f, 0x3d, 0xf6, 0x5e, 0xa0, 0x28, 0x38, 0x43, 0x52, 0xd4, 0xae,
-	0x37, 0xf0, 0xa1, 0x27, 0xce, 0xbc, 0xf7, 0x9b, 0x3f, 0xef, 0xf7, 0xde, 0xef, 0x0d, 0xa1, 0x3c,
-	0x22, 0xf3, 0x93, 0xb9, 0x47, 0x03, 0x8a, 0x4a, 0xec, 0x33, 0xa6, 0x8e, 0xf2, 0xe9, 0xd4, 0x0e,
-	0x2e, 0x16, 0xa3, 0x93, 0x31, 0x9d, 0x7d, 0x36, 0xa5, 0x53, 0xfa, 0x19, 0xf3, 0x8c, 0x16, 0x13,
-	0x36, 0x63, 0x13, 0x36, 0xe2, 0x0b, 0xeb, 0x73, 0xc8, 0x3f, 0x21, 0x8e, 0x43, 0xd1, 0x21, 0x54,
-	0x2c, 0x72, 0x69, 0x8f, 0x89, 0xe1, 0x9a, 0x33, 0x22, 0x0b, 0xaa, 0x70, 0x54, 0xc6, 0xc0, 0x4d,
-	0xba, 0x39, 0x23, 0x21, 0x60, 0xec, 0xd8, 0xc4, 0x0d, 0x38, 0x20, 0xcb, 0x01, 0xdc, 0xc4, 0x00,
-	0x0f, 0x61, 0x37, 0x02, 0x5c, 0x12, 0xcf, 0xb7, 0xa9, 0x2b, 0xe7, 0x18, 0x66, 0x87, 0x5b, 0x9f,
-	0x71, 0x63, 0xdd, 0x87, 0xc2, 0x13, 0x62, 0x5a, 0xc4, 0x43, 0x1f, 0x83, 0x18, 0x2c, 0xe7, 0xfc,
-	0xac, 0xdd, 0xcf, 0xef, 0x9d, 0xc4, 0x31, 0x9c, 0x3c, 0x25, 0xbe, 0x6f, 0x4e, 0xc9, 0x70, 0x39,
-	0x27, 0x98, 0x41, 0xd0, 0xaf, 0xa0, 0x32, 0xa6, 0xb3, 0xb9, 0x47, 0x7c, 0xb6, 0x71, 0x96, 0xad,
-	0x38, 0xb8, 0xb1, 0xa2, 0xb5, 0xc1, 0xe0, 0xf4, 0x82, 0x7a, 0x03, 0x76, 0x5a, 0xce, 0xc2, 0x0f,
-	0x88, 0xd7, 0xa2, 0xee, 0xc4, 0x9e, 0xa2, 0xc7, 0x50, 0x9c, 0x50, 0xc7, 0x22, 0x9e, 0x2f, 0x0b,
-	0x6a, 0xee, 0xa8, 0xf2, 0xb9, 0xb4, 0xd9, 0xec, 0x94, 0x39, 0x9a, 0xe2, 0xeb, 0x37, 0x87, 0x19,
-	0x1c, 0xc3, 0xea, 0x7f, 0xca, 0x42, 0x81, 0x7b, 0xd0, 0x3e, 0x64, 0x6d, 0x8b, 0x53, 0xd4, 0x2c,
-	0x5c, 0xbd, 0x39, 0xcc, 0x76, 0xda, 0x38, 0x6b, 0x5b, 0xe8, 0x2e, 0xe4, 0x1d, 0x73, 0x44, 0x9c,
-	0x88, 0x1c, 0x3e, 0x41, 0xef, 0x43, 0xd9, 0x23, 0xa6, 0x65, 0x50, 0xd7, 0x59, 0x32, 0x4a, 0x4a,
-	0xb8, 0x14, 0x1a, 0x7a, 0xae, 0xb3, 0x44, 0x9f, 0x02, 0xb2, 0xa7, 0x2e, 0xf5, 0x88, 0x31, 0x27,
-	0xde, 0xcc, 0x66, 0xb7, 0xf5, 0x65, 0x91, 0xa1, 0xf6, 0xb8, 0xa7, 0xbf, 0x71, 0xa0, 0x0f, 0x61,
-	0x27, 0x82, 0x5b, 0xc4, 0x21, 0x01, 0x91, 0xf3, 0x0c, 0x59, 0xe5, 0xc6, 0x36, 0xb3, 0xa1, 0xc7,
-	0x70, 0xd7, 0xb2, 0x7d, 0x73, 0xe4, 0x10, 0x23, 0x20, 0xb3, 0xb9, 0x61, 0xbb, 0x16, 0x79, 0x45,
-	0x7c, 0xb9, 0xc0, 0xb0, 0x28, 0xf2, 0x0d, 0xc9, 0x6c, 0xde, 0xe1, 0x1e, 0xb4, 0x0f, 0x85, 0xb9,
-	0xb9, 0xf0, 0x89, 0x25, 0x17, 0x19, 0x26, 0x9a, 0x85, 0x2c, 0xf1, 0x0a, 0xf0, 0x65, 0xe9, 0x3a,
-	0x4b, 0x6d, 0xe6, 0x88, 0x59, 0x8a, 0x60, 0xf5, 0x7f, 0x67, 0xa1, 0xc0, 0x3d, 0xe8, 0xa3, 0x84,
-	0xa5, 0x6a, 0x73, 0x3f, 0x44, 0xfd, 0xfd, 0xcd, 0x61, 0x89, 0xfb, 0x3a, 0xed, 0x14, 0x6b, 0x08,
-	0xc4, 0x54, 0x45, 0xb1, 0x31, 0x3a, 0x80, 0xb2, 0x69, 0x59, 0x61, 0xf6, 0x88, 0x2f, 0xe7, 0xd4,
-	0xdc, 0x51, 0x19, 0x6f, 0x0c, 0xe8, 0xa7, 0xdb, 0xd5, 0x20, 0x5e, 0xaf, 0x9f, 0xdb, 0xca, 0x20,
-	0x4c, 0xc5, 0x98, 0x78, 0x51, 0x05, 0xe7, 0xd9, 0x79, 0xa5, 0xd0, 0xc0, 0xea, 0xf7, 0x3e, 0x54,
-	0x67, 0xe6, 0x2b, 0xc3, 0x27, 0xbf, 0x5f, 0x10, 0x77, 0x4c, 0x18, 0x5d, 0x39, 0x5c, 0x99, 0x99,
-	0xaf, 0x06, 0x91, 0x09, 0xd5, 0x00, 0x6c, 0x37, 0xf0, 0xa8, 0xb5, 0x18, 0x13, 0x2f, 0xe2, 0x2a,
-	0x65, 0x41, 0x3f, 0x86, 0x12, 0x23, 0xdb, 0xb0, 0x2d, 0xb9, 0xa4, 0x0a, 0x47, 0x62, 0x53, 0x89,
-	0x02, 0x2f, 0x32, 0xaa, 0x59, 0xdc, 0xf1, 0x10, 0x17, 0x19, 0xb6, 0x63, 0xa1, 0x5f, 0x80, 0xe2,
-	0xbf, 0xb0, 0xc3, 0x44, 0xf1, 0x9d, 0x02, 0x9b, 0xba, 0x86, 0x47, 0x66, 0xf4, 0xd2, 0x74, 0x7c,
-	0xb9, 0xcc, 0x8e, 0x91, 0x43, 0x44, 0x27, 0x05, 0xc0, 0x91, 0xbf, 0xde, 0x83, 0x3c, 0xdb, 0x31,
-	0xcc, 0x22, 0x2f, 0xd6, 0x48, 0xbd, 0xd1, 0x0c, 0x9d, 0x40, 0x7e, 0x62, 0x3b, 0xc4, 0x97, 0xb3,
-	0x2c, 0x87, 0x28, 0x55, 0xe9, 0xb6, 0x43, 0x3a, 0xee, 0x84, 0x46, 0x59, 0xe4, 0xb0, 0xfa, 0x39,
-	0x54, 0xd8, 0x86, 0xe7, 0x73, 0xcb, 0x0c, 0xc8, 0xff, 0x6d, 0xdb, 0xff, 0xe4, 0xa0, 0x14, 0x7b,
-	0x92, 0xa4, 0x0b, 0xa9, 0xa4, 0x1f, 0x47, 0xfd, 0x80, 0xab, 0x7b, 0xff, 0xe6, 0x7e, 0xa9, 0x86,
-	0x80, 0x40, 0xf4, 0xed, 0x3f, 0x10, 0xa6, 0xa7, 0x1c, 0x66, 0x63, 0xa4, 0x42, 0xe5, 0xba, 0x88,
-	0x76, 0x70, 0xda, 0x84, 0x3e, 0x00, 0x98, 0x51, 0xcb, 0x9e, 0xd8, 0xc4, 0x32, 0x7c, 0x56, 0x00,
-	0x39, 0x5c, 0x8e, 0x2d, 0x03, 0x24, 0x87, 0xe5, 0x1e, 0x4a, 0xc8, 0x8a, 0xb4, 0x12, 0x4f, 0x43,
-	0x8f, 0xed, 0x5e, 0x9a, 0x8e, 0x1d, 0x2b, 0x24, 0x9e, 0x86, 0x5d, 0xcf, 0xa5, 0x5b, 0xe2, 0x2d,
-	0x31, 0xc0, 0x8e, 0x4b, 0xd3, 0xc2, 0x7d, 0x0c, 0xc5, 0xb8, 0x2b, 0x86, 0xf9, 0xdc, 0x52, 0xd2,
-	0x33, 0x32, 0x0e, 0x68, 0xd2, 0x6f, 0x22, 0x18, 0x52, 0xa0, 0x94, 0x94, 0x22, 0xb0, 0x9b, 0x26,
-	0xf3, 0xb0, 0x17, 0x27, 0x71, 0xb8, 0xbe, 0x5c, 0x51, 0x85, 0xa3, 0x3c, 0x4e, 0x42, 0xd3, 0xc3,
-	0xe3, 0x36, 0x80, 0xd1, 0x52, 0xae, 0xb2, 0x5a, 0x7c, 0x2f, 0xae, 0xc5, 0xc1, 0x05, 0xf5, 0x82,
-	0x4e, 0x7b, 0xb3, 0xa2, 0xb9, 0x44, 0x3f, 0x82, 0x42, 0xd3, 0xa1, 0xe3, 0x17, 0xb1, 0xd2, 0xef,
-	0x6c, 0xee, 0xc7, 0xec, 0xa9, 0x7c, 0x46, 0xc0, 0x30, 0x74, 0x7f, 0x39, 0x73, 0x6c, 0xf7, 0x85,
-	0x11, 0x98, 0xde, 0x94, 0x04, 0xf2, 0x1e, 0x6f, 0xf8, 0x91, 0x75, 0xc8, 0x8c, 0x3f, 0x17, 0xff,
-	0xf8, 0xcd, 0x61, 0xa6, 0xee, 0x42, 0x39, 0xd9, 0x27, 0x2c, 0x29, 0x3a, 0x99, 0xf8, 0x24, 0x60,
-	0xf9, 0xcf, 0xe1, 0x68, 0x96, 0x64, 0x35, 0xcb, 0x02, 0xe2, 0x59, 0x45, 0x20, 0x5e, 0x98, 0xfe,
-	0x05, 0xcb, 0x74, 0x15, 0xb3, 0x71, 0xa8, 0xe3, 0x97, 0xc4, 0x7c, 0x61, 0x30, 0x07, 0xcf, 0x73,
-	0x29, 0x34, 0x3c, 0x31, 0xfd, 0x8b, 0xe8, 0xbc, 0x5f, 0x42, 0x81, 0xf3, 0x8a, 0xbe, 0x80, 0xd2,
-	0x98, 0x2e, 0xdc, 0x60, 0xd3, 0xeb, 0xf7, 0xd2, 0xad, 0x82, 0x79, 0xa2, 0xc8, 0x12, 0x60, 0xfd,
-	0x14, 0x8a, 0x91, 0x0b, 0x3d, 0x4c, 0xfa, 0x98, 0xd8, 0xbc, 0x77, 0x8d, 0xc2, 0xed, 0xe6, 0x7f,
-	0x69, 0x3a, 0x0b, 0x7e, 0x79, 0x11, 0xf3, 0x49, 0xfd, 0x2f, 0x02, 0x14, 0x71, 0x98, 0x36, 0x3f,
-	0x48, 0x3d, 0x1b, 0xf9, 0xad, 0x67, 0x63, 0x23, 0xb0, 0xec, 0x96, 0xc0, 0x62, 0x8d, 0xe4, 0x52,
-	0x1a, 0xd9, 0x30, 0x27, 0xbe, 0x95, 0xb9, 0xfc, 0x5b, 0x98, 0x2b, 0xa4, 0x98, 0x7b, 0x08, 0xbb,
-	0x13, 0x8f, 0xce, 0xd8, 0xc3, 0x40, 0x3d, 0xd3, 0x5b, 0x46, 0xf5, 0xbc, 0x13, 0x5a, 0x87, 0xb1,
-	0xb1, 0x6e, 0x40, 0x09, 0x13, 0x7f, 0x4e, 0x5d, 0x9f, 0xdc, 0x7a, 0x6d, 0x04, 0xa2, 0x65, 0x06,
-	0x26, 0xbb, 0x74, 0x15, 0xb3, 0x31, 0x7a, 0x04, 0xe2, 0x98, 0x5a, 0xfc, 0xca, 0xbb, 0xe9, 0x1a,
-	0xd2, 0x3c, 0x8f, 0x7a, 0x2d, 0x6a, 0x11, 0xcc, 0x00, 0xf5, 0x39, 0x48, 0x6d, 0xfa, 0xd2, 0x75,
-	0xa8, 0x69, 0xf5, 0x3d, 0x3a, 0x0d, 0x1b, 0xf4, 0xad, 0x8d, 0xa6, 0x0d, 0xc5, 0x05, 0x6b, 0x45,
-	0x71, 0xab, 0x79, 0xb0, 0xdd, 0x1a, 0xae, 0x6f, 0xc4, 0xfb, 0x56, 0xac, 0xa7, 0x68, 0x69, 0xfd,
-	0x6f, 0x02, 0x28, 0xb7, 0xa3, 0x51, 0x07, 0x2a, 0x1c, 0x69, 0xa4, 0xfe, 0x49, 0x8e, 0xde, 0xe5,
-	0x20, 0xd6, 0x95, 0x60, 0x91, 0x8c, 0xdf, 0xfa, 0xa0, 0xa5, 0xf4, 0x9f, 0x7b, 0x37, 0xfd, 0x3f,
-	0x82, 0x9d, 0x51, 0x28, 0x98, 0xe4, 0xf9, 0x16, 0xd5, 0xdc, 0x51, 0xbe, 0x99, 0x95, 0x32, 0xb8,
-	0x3a, 0xe2, 0x4a, 0x62, 0xf6, 0x7a, 0x01, 0xc4, 0xbe, 0xed, 0x4e, 0xeb, 0x87, 0x90, 0x6f, 0x39,
-	0x94, 0x25, 0xac, 0xe0, 0x11, 0xd3, 0xa7, 0x6e, 0xcc, 0x23, 0x9f, 0x1d, 0xff, 0x35, 0x0b, 0x95,
-	0xd4, 0xaf, 0x15, 0x7a, 0x0c, 0xbb, 0xad, 0xee, 0xf9, 0x60, 0xa8, 0x61, 0xa3, 0xd5, 0xd3, 0x4f,
-	0x3b, 0x67, 0x52, 0x46, 0x39, 0x58, 0xad, 0x55, 0x79, 0xb6, 0x01, 0x6d, 0xff, 0x35, 0x1d, 0x42,
-	0xbe, 0xa3, 0xb7, 0xb5, 0xdf, 0x4a, 0x82, 0x72, 0x77, 0xb5, 0x56, 0xa5, 0x14, 0x90, 0x3f, 0x41,
-	0x9f, 0x40, 0x95, 0x01, 0x8c, 0xf3, 0x7e, 0xbb, 0x31, 0xd4, 0xa4, 0xac, 0xa2, 0xac, 0xd6, 0xea,
-	0xfe, 0x75, 0x5c, 0xc4, 0xf9, 0x87, 0x50, 0xc4, 0xda, 0x6f, 0xce, 0xb5, 0xc1, 0x50, 0xca, 0x29,
-	0xfb, 0xab, 0xb5, 0x8a, 0x52, 0xc0, 0x58, 0x35, 0x0f, 0xa1, 0x84, 0xb5, 0x41, 0xbf, 0xa7, 0x0f,
-	0x34, 0x49, 0x54, 0x7e, 0xb0, 0x5a, 0xab, 0x77, 0xb6, 0x50, 0x51, 0x95, 0xfe, 0x04, 0xf6, 0xda,
-	0xbd, 0xaf, 0xf4, 0x6e, 0xaf, 0xd1, 0x36, 0xfa, 0xb8, 0x77, 0x86, 0xb5, 0xc1, 0x40, 0xca, 0x2b,
-	0x87, 0xab, 0xb5, 0xfa, 0x7e, 0x0a, 0x7f, 0xa3, 0xe8, 0x3e, 0x00, 0xb1, 0xdf, 0xd1, 0xcf, 0xa4,
-	0x82, 0x72, 0x67, 0xb5, 0x56, 0xdf, 0x4b, 0x41, 0x43, 0x52, 0xc3, 0x88, 0x5b, 0xdd, 0xde, 0x40,
-	0x93, 0x8a, 0x37, 0x22, 0x66, 0x64, 0x1f, 0xff, 0x0e, 0xd0, 0xcd, 0x9f, 0x4f, 0xf4, 0x00, 0x44,
-	0xbd, 0xa7, 0x6b, 0x52, 0x86, 0xc7, 0x7f, 0x13, 0xa1, 0x53, 0x97, 0xa0, 0x3a, 0xe4, 0xba, 0x5f,
-	0x7f, 0x29, 0x09, 0xca, 0x0f, 0x57, 0x6b, 0xf5, 0xde, 0x4d, 0x50, 0xf7, 0xeb, 0x2f, 0x8f, 0x29,
-	0x54, 0xd2, 0x1b, 0xd7, 0xa1, 0xf4, 0x54, 0x1b, 0x36, 0xda, 0x8d, 0x61, 0x43, 0xca, 0xf0, 0x2b,
-	0xc5, 0xee, 0xa7, 0x24, 0x30, 0x99, 0x08, 0x0f, 0x20, 0xaf, 0x6b, 0xcf, 0x34, 0x2c, 0x09, 0xca,
-	0xde, 0x6a, 0xad, 0xee, 0xc4, 0x00, 0x9d, 0x5c, 0x12, 0x0f, 0xd5, 0xa0, 0xd0, 0xe8, 0x7e, 0xd5,
-	0x78, 0x3e, 0x90, 0xb2, 0x0a, 0x5a, 0xad, 0xd5, 0xdd, 0xd8, 0xdd, 0x70, 0x5e, 0x9a, 0x4b, 0xff,
-	0xf8, 0xbf, 0x02, 0x54, 0xd3, 0x0f, 0x2e, 0xaa, 0x81, 0x78, 0xda, 0xe9, 0x6a, 0xf1, 0x71, 0x69,
-	0x5f, 0x38, 0x46, 0x47, 0x50, 0x6e, 0x77, 0xb0, 0xd6, 0x1a, 0xf6, 0xf0, 0xf3, 0x38, 0x96, 0x34,
-	0xa8, 0x6d, 0x7b, 0xac, 0xc0, 0x97, 0xe8, 0x67, 0x50, 0x1d, 0x3c, 0x7f, 0xda, 0xed, 0xe8, 0xbf,
-	0x36, 0xd8, 0x8e, 0x59, 0xe5, 0xd1, 0x6a, 0xad, 0xde, 0xdf, 0x02, 0x93, 0xb9, 0x47, 0xc6, 0x66,
-	0x40, 0xac, 0x01, 0x7f, 0x44, 0x42, 0x67, 0x49, 0x40, 0x2d, 0xd8, 0x8b, 0x97, 0x6e, 0x0e, 0xcb,
-	0x29, 0x9f, 0xac, 0xd6, 0xea, 0x47, 0xdf, 0xbb, 0x3e, 0x39, 0xbd, 0x24, 0xa0, 0x07, 0x50, 0x8c,
-	0x36, 0x89, 0x2b, 0x29, 0xbd, 0x34, 0x5a, 0x70, 0xfc, 0x67, 0x01, 0xca, 0x49, 0xbb, 0x0a, 0x09,
-	0xd7, 0x7b, 0x86, 0x86, 0x71, 0x0f, 0xc7, 0x0c, 0x24, 0x4e, 0x9d, 0xb2, 0x21, 0xba, 0x0f, 0xc5,
-	0x33, 0x4d, 0xd7, 0x70, 0xa7, 0x15, 0x0b, 0x23, 0x81, 0x9c, 0x11, 0x97, 0x78, 0xf6, 0x18, 0x7d,
-	0x0c, 0x55, 0xbd, 0x67, 0x0c, 0xce, 0x5b, 0x4f, 0xe2, 0xd0, 0xd9, 0xf9, 0xa9, 0xad, 0x06, 0x8b,
-	0xf1, 0x05, 0xe3, 0xf3, 0x38, 0xd4, 0xd0, 0xb3, 0x46, 0xb7, 0xd3, 0xe6, 0xd0, 0x9c, 0x22, 0xaf,
-	0xd6, 0xea, 0xdd, 0x04, 0xda, 0xe1, 0x7f, 0x1e, 0x21, 0xf6, 0xd8, 0x82, 0xda, 0xf7, 0x37, 0x26,
-	0xa4, 0x42, 0xa1, 0xd1, 0xef, 0x6b, 0x7a, 0x3b, 0xbe, 0xfd, 0xc6, 0xd7, 0x98, 0xcf, 0x89, 0x6b,
-	0x85, 0x88, 0xd3, 0x1e, 0x3e, 0xd3, 0x86, 0xf1, 0xe5, 0x37, 0x88, 0x53, 0x1a, 0xbe, 0xe0, 0xcd,
-	0x83, 0xd7, 0xdf, 0xd5, 0x32, 0xdf, 0x7e, 0x57, 0xcb, 0xbc, 0xbe, 0xaa, 0x09, 0xdf, 0x5e, 0xd5,
-	0x84, 0x7f, 0x5c, 0xd5, 0x32, 0xff, 0xba, 0xaa, 0x09, 0xdf, 0xfc, 0xb3, 0x26, 0x8c, 0x0a, 0xac,
-	0x91, 0x7d, 0xf1, 0xbf, 0x00, 0x00, 0x00, 0xff, 0xff, 0xad, 0x8a, 0xef, 0x7f, 0x8f, 0x0e, 0x00,
-	0x00,
+	// 1737 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0x4f, 0x73, 0xdb, 0xc6,
+	0x15, 0x17, 0x48, 0xf0, 0xdf, 0x23, 0xa5, 0x40, 0x1b, 0x5b, 0x45, 0x11, 0x85, 0x82, 0x11, 0x3b,
+	0x56, 0x34, 0x89, 0xe2, 0x26, 0x69, 0x3b, 0xed, 0xb4, 0x9d, 0xe1, 0x1f, 0x48, 0xe6, 0x94, 0x06,
+	0xd9, 0x25, 0xe5, 0xd4, 0x39, 0x14, 0x03, 0x12, 0x4b, 0x0a, 0x63, 0x10, 0xcb, 0x02, 0xa0, 0x6c,
+	0xf6, 0x23, 0xf0, 0x13, 0xf4, 0xc2, 0x69, 0x66, 0x7a, 0xea, 0xbd, 0x1f, 0xc2, 0xc7, 0x4c, 0x0f,
+	0x3d, 0xf4, 0xe0, 0x69, 0xd4, 0x4b, 0x8f, 0xfd, 0x04, 0x9d, 0x0e, 0x76, 0x01, 0x10, 0x94, 0xec,
+	0x4c, 0x0e, 0x3d, 0x61, 0xf7, 0xbd, 0xdf, 0xfe, 0x79, 0xbf, 0xf7, 0x7b, 0x6f, 0x01, 0x95, 0x11,
+	0x99, 0x9f, 0xce, 0x7d, 0x1a, 0x52, 0x54, 0x66, 0x9f, 0x31, 0x75, 0x95, 0x4f, 0xa6, 0x4e, 0x78,
+	0xb9, 0x18, 0x9d, 0x8e, 0xe9, 0xec, 0xd3, 0x29, 0x9d, 0xd2, 0x4f, 0x99, 0x67, 0xb4, 0x98, 0xb0,
+	0x19, 0x9b, 0xb0, 0x11, 0x5f, 0xa8, 0xcd, 0xa1, 0xf0, 0x98, 0xb8, 0x2e, 0x45, 0x47, 0x50, 0xb5,
+	0xc9, 0x95, 0x33, 0x26, 0xa6, 0x67, 0xcd, 0x88, 0x2c, 0xa8, 0xc2, 0x71, 0x05, 0x03, 0x37, 0x19,
+	0xd6, 0x8c, 0x44, 0x80, 0xb1, 0xeb, 0x10, 0x2f, 0xe4, 0x80, 0x1c, 0x07, 0x70, 0x13, 0x03, 0x3c,
+	0x80, 0xbd, 0x18, 0x70, 0x45, 0xfc, 0xc0, 0xa1, 0x9e, 0x9c, 0x67, 0x98, 0x5d, 0x6e, 0x7d, 0xca,
+	0x8d, 0x5a, 0x00, 0xc5, 0xc7, 0xc4, 0xb2, 0x89, 0x8f, 0x3e, 0x02, 0x31, 0x5c, 0xce, 0xf9, 0x59,
+	0x7b, 0x9f, 0xdd, 0x3d, 0x4d, 0x62, 0x38, 0x7d, 0x42, 0x82, 0xc0, 0x9a, 0x92, 0xe1, 0x72, 0x4e,
+	0x30, 0x83, 0xa0, 0x5f, 0x41, 0x75, 0x4c, 0x67, 0x73, 0x9f, 0x04, 0x6c, 0xe3, 0x1c, 0x5b, 0x71,
+	0x78, 0x6b, 0x45, 0x6b, 0x83, 0xc1, 0xd9, 0x05, 0x5a, 0x03, 0x76, 0x5b, 0xee, 0x22, 0x08, 0x89,
+	0xdf, 0xa2, 0xde, 0xc4, 0x99, 0xa2, 0x47, 0x50, 0x9a, 0x50, 0xd7, 0x26, 0x7e, 0x20, 0x0b, 0x6a,
+	0xfe, 0xb8, 0xfa, 0x99, 0xb4, 0xd9, 0xec, 0x8c, 0x39, 0x9a, 0xe2, 0xab, 0xd7, 0x47, 0x3b, 0x38,
+	0x81, 0x69, 0x7f, 0xce, 0x41, 0x91, 0x7b, 0xd0, 0x01, 0xe4, 0x1c, 0x9b, 0x53, 0xd4, 0x2c, 0x5e,
+	0xbf, 0x3e, 0xca, 0x75, 0xda, 0x38, 0xe7, 0xd8, 0xe8, 0x0e, 0x14, 0x5c, 0x6b, 0x44, 0xdc, 0x98,
+	0x1c, 0x3e, 0x41, 0xef, 0x41, 0xc5, 0x27, 0x96, 0x6d, 0x52, 0xcf, 0x5d, 0x32, 0x4a, 0xca, 0xb8,
+	0x1c, 0x19, 0x7a, 0x9e, 0xbb, 0x44, 0x9f, 0x00, 0x72, 0xa6, 0x1e, 0xf5, 0x89, 0x39, 0x27, 0xfe,
+	0xcc, 0x61, 0xb7, 0x0d, 0x64, 0x91, 0xa1, 0xf6, 0xb9, 0xa7, 0xbf, 0x71, 0xa0, 0x0f, 0x60, 0x37,
+	0x86, 0xdb, 0xc4, 0x25, 0x21, 0x91, 0x0b, 0x0c, 0x59, 0xe3, 0xc6, 0x36, 0xb3, 0xa1, 0x47, 0x70,
+	0xc7, 0x76, 0x02, 0x6b, 0xe4, 0x12, 0x33, 0x24, 0xb3, 0xb9, 0xe9, 0x78, 0x36, 0x79, 0x49, 0x02,
+	0xb9, 0xc8, 0xb0, 0x28, 0xf6, 0x0d, 0xc9, 0x6c, 0xde, 0xe1, 0x1e, 0x74, 0x00, 0xc5, 0xb9, 0xb5,
+	0x08, 0x88, 0x2d, 0x97, 0x18, 0x26, 0x9e, 0x45, 0x2c, 0x71, 0x05, 0x04, 0xb2, 0x74, 0x93, 0xa5,
+	0x36, 0x73, 0x24, 0x2c, 0xc5, 0x30, 0xed, 0x3f, 0x39, 0x28, 0x72, 0x0f, 0xfa, 0x30, 0x65, 0xa9,
+	0xd6, 0x3c, 0x88, 0x50, 0xff, 0x78, 0x7d, 0x54, 0xe6, 0xbe, 0x4e, 0x3b, 0xc3, 0x1a, 0x02, 0x31,
+	0xa3, 0x28, 0x36, 0x46, 0x87, 0x50, 0xb1, 0x6c, 0x3b, 0xca, 0x1e, 0x09, 0xe4, 0xbc, 0x9a, 0x3f,
+	0xae, 0xe0, 0x8d, 0x01, 0xfd, 0x74, 0x5b, 0x0d, 0xe2, 0x4d, 0xfd, 0xbc, 0x4d, 0x06, 0x51, 0x2a,
+	0xc6, 0xc4, 0x8f, 0x15, 0x5c, 0x60, 0xe7, 0x95, 0x23, 0x03, 0xd3, 0xef, 0x3d, 0xa8, 0xcd, 0xac,
+	0x97, 0x66, 0x40, 0x7e, 0xbf, 0x20, 0xde, 0x98, 0x30, 0xba, 0xf2, 0xb8, 0x3a, 0xb3, 0x5e, 0x0e,
+	0x62, 0x13, 0xaa, 0x03, 0x38, 0x5e, 0xe8, 0x53, 0x7b, 0x31, 0x26, 0x7e, 0xcc, 0x55, 0xc6, 0x82,
+	0x7e, 0x0c, 0x65, 0x46, 0xb6, 0xe9, 0xd8, 0x72, 0x59, 0x15, 0x8e, 0xc5, 0xa6, 0x12, 0x07, 0x5e,
+	0x62, 0x54, 0xb3, 0xb8, 0x93, 0x21, 0x2e, 0x31, 0x6c, 0xc7, 0x46, 0xbf, 0x00, 0x25, 0x78, 0xee,
+	0xcc, 0xcd, 0x64, 0xa7, 0xd0, 0xa1, 0x9e, 0xe9, 0x93, 0x19, 0xbd, 0xb2, 0xdc, 0x40, 0xae, 0xb0,
+	0x63, 0xe4, 0x08, 0xd1, 0xc9, 0x00, 0x70, 0xec, 0xd7, 0x7a, 0x50, 0x60, 0x3b, 0x46, 0x59, 0xe4,
+	0x62, 0x8d, 0xab, 0x37, 0x9e, 0xa1, 0x53, 0x28, 0x4c, 0x1c, 0x97, 0x04, 0x72, 0x8e, 0xe5, 0x10,
+	0x65, 0x94, 0xee, 0xb8, 0xa4, 0xe3, 0x4d, 0x68, 0x9c, 0x45, 0x0e, 0xd3, 0x2e, 0xa0, 0xca, 0x36,
+	0xbc, 0x98, 0xdb, 0x56, 0x48, 0xfe, 0x6f, 0xdb, 0xfe, 0x49, 0x84, 0x72, 0xe2, 0x49, 0x93, 0x2e,
+	0x64, 0x92, 0x7e, 0x12, 0xf7, 0x03, 0x5e, 0xdd, 0x07, 0xb7, 0xf7, 0xcb, 0x34, 0x04, 0x04, 0x62,
+	0xe0, 0xfc, 0x81, 0xb0, 0x7a, 0xca, 0x63, 0x36, 0x46, 0x2a, 0x54, 0x6f, 0x16, 0xd1, 0x2e, 0xce,
+	0x9a, 0xd0, 0xfb, 0x00, 0x33, 0x6a, 0x3b, 0x13, 0x87, 0xd8, 0x66, 0xc0, 0x04, 0x90, 0xc7, 0x95,
+	0xc4, 0x32, 0x40, 0x72, 0x24, 0xf7, 0xa8, 0x84, 0xec, 0xb8, 0x56, 0x92, 0x69, 0xe4, 0x71, 0xbc,
+	0x2b, 0xcb, 0x75, 0x92, 0x0a, 0x49, 0xa6, 0x51, 0xd7, 0xf3, 0xe8, 0x56, 0xf1, 0x96, 0x19, 0x60,
+	0xd7, 0xa3, 0xd9, 0xc2, 0x7d, 0x04, 0xa5, 0xa4, 0x2b, 0x46, 0xf9, 0xdc, 0xaa, 0xa4, 0xa7, 0x64,
+	0x1c, 0xd2, 0xb4, 0xdf, 0xc4, 0x30, 0xa4, 0x40, 0x39, 0x95, 0x22, 0xb0, 0x9b, 0xa6, 0xf3, 0xa8,
+	0x17, 0xa7, 0x71, 0x78, 0x81, 0x5c, 0x55, 0x85, 0xe3, 0x02, 0x4e, 0x43, 0x33, 0xa2, 0xe3, 0x36,
+	0x80, 0xd1, 0x52, 0xae, 0x31, 0x2d, 0xbe, 0x93, 0x68, 0x71, 0x70, 0x49, 0xfd, 0xb0, 0xd3, 0xde,
+	0xac, 0x68, 0x2e, 0xd1, 0x8f, 0xa0, 0xd8, 0x74, 0xe9, 0xf8, 0x79, 0x52, 0xe9, 0xef, 0x6e, 0xee,
+	0xc7, 0xec, 0x99, 0x7c, 0xc6, 0xc0, 0x28, 0xf4, 0x60, 0x39, 0x73, 0x1d, 0xef, 0xb9, 0x19, 0x5a,
+	0xfe, 0x94, 0x84, 0xf2, 0x3e, 0x6f, 0xf8, 0xb1, 0x75, 0xc8, 0x8c, 0x48, 0x83, 0x9a, 0x4d, 0x92,
+	0x2a, 0x24, 0xb6, 0x8c, 0x78, 0xcb, 0xca, 0xda, 0x7e, 0x2e, 0xfe, 0xf1, 0xeb, 0xa3, 0x1d, 0xcd,
+	0x83, 0x4a, 0x7a, 0x56, 0x24, 0x3b, 0x3a, 0x99, 0x04, 0x24, 0x64, 0x1a, 0xc9, 0xe3, 0x78, 0x96,
+	0x66, 0x3e, 0xc7, 0x82, 0x66, 0xe3, 0xc8, 0x76, 0x69, 0x05, 0x97, 0x4c, 0x0d, 0x35, 0xcc, 0xc6,
+	0x51, 0xad, 0xbf, 0x20, 0xd6, 0x73, 0x93, 0x39, 0xb8, 0x16, 0xca, 0x91, 0xe1, 0xb1, 0x15, 0x5c,
+	0xc6, 0xe7, 0xfd, 0x12, 0x8a, 0x9c, 0x7b, 0xf4, 0x39, 0x94, 0xc7, 0x74, 0xe1, 0x85, 0x9b, 0xf7,
+	0x60, 0x3f, 0xdb, 0x4e, 0x98, 0x27, 0x8e, 0x3e, 0x05, 0x6a, 0x67, 0x50, 0x8a, 0x5d, 0xe8, 0x41,
+	0xda, 0xeb, 0xc4, 0xe6, 0xdd, 0x1b, 0x34, 0x6f, 0x3f, 0x10, 0x57, 0x96, 0xbb, 0xe0, 0x97, 0x17,
+	0x31, 0x9f, 0x68, 0x7f, 0x15, 0xa0, 0x84, 0xa3, 0xd4, 0x06, 0x61, 0xe6, 0x69, 0x29, 0x6c, 0x3d,
+	0x2d, 0x9b, 0x22, 0xcc, 0x6d, 0x15, 0x61, 0x52, 0x47, 0xf9, 0x4c, 0x1d, 0x6d, 0x98, 0x13, 0xdf,
+	0xc8, 0x5c, 0xe1, 0x0d, 0xcc, 0x15, 0x33, 0xcc, 0x3d, 0x80, 0xbd, 0x89, 0x4f, 0x67, 0xec, 0xf1,
+	0xa0, 0xbe, 0xe5, 0x2f, 0x63, 0xcd, 0xef, 0x46, 0xd6, 0x61, 0x62, 0xd4, 0x4c, 0x28, 0x63, 0x12,
+	0xcc, 0xa9, 0x17, 0x90, 0xb7, 0x5e, 0x1b, 0x81, 0x68, 0x5b, 0xa1, 0xc5, 0x2e, 0x5d, 0xc3, 0x6c,
+	0x8c, 0x1e, 0x82, 0x38, 0xa6, 0x36, 0xbf, 0xf2, 0x5e, 0x56, 0x67, 0xba, 0xef, 0x53, 0xbf, 0x45,
+	0x6d, 0x82, 0x19, 0x40, 0x9b, 0x83, 0xd4, 0xa6, 0x2f, 0x3c, 0x97, 0x5a, 0x76, 0xdf, 0xa7, 0xd3,
+	0x48, 0x2a, 0x6f, 0x6d, 0x46, 0x6d, 0x28, 0x2d, 0x58, 0xbb, 0x4a, 0xda, 0xd1, 0xfd, 0xed, 0xf6,
+	0x71, 0x73, 0x23, 0xde, 0xdb, 0x92, 0x9a, 0x8b, 0x97, 0x6a, 0x7f, 0x17, 0x40, 0x79, 0x3b, 0x1a,
+	0x75, 0xa0, 0xca, 0x91, 0x66, 0xe6, 0xbf, 0xe5, 0xf8, 0xfb, 0x1c, 0xc4, 0x3a, 0x17, 0x2c, 0xd2,
+	0xf1, 0x1b, 0x1f, 0xbd, 0x4c, 0x8f, 0xc8, 0x7f, 0xbf, 0x1e, 0xf1, 0x10, 0x76, 0x47, 0x51, 0xc1,
+	0xa4, 0x4f, 0xbc, 0xa8, 0xe6, 0x8f, 0x0b, 0xcd, 0x9c, 0xb4, 0x83, 0x6b, 0x23, 0x5e, 0x49, 0xcc,
+	0xae, 0x15, 0x41, 0xec, 0x3b, 0xde, 0x54, 0x3b, 0x82, 0x42, 0xcb, 0xa5, 0x2c, 0x61, 0x45, 0x9f,
+	0x58, 0x01, 0xf5, 0x12, 0x1e, 0xf9, 0xec, 0xe4, 0x6f, 0x39, 0xa8, 0x66, 0x7e, 0xbf, 0xd0, 0x23,
+	0xd8, 0x6b, 0x75, 0x2f, 0x06, 0x43, 0x1d, 0x9b, 0xad, 0x9e, 0x71, 0xd6, 0x39, 0x97, 0x76, 0x94,
+	0xc3, 0xd5, 0x5a, 0x95, 0x67, 0x1b, 0xd0, 0xf6, 0x9f, 0xd5, 0x11, 0x14, 0x3a, 0x46, 0x5b, 0xff,
+	0xad, 0x24, 0x28, 0x77, 0x56, 0x6b, 0x55, 0xca, 0x00, 0xf9, 0x33, 0xf5, 0x31, 0xd4, 0x18, 0xc0,
+	0xbc, 0xe8, 0xb7, 0x1b, 0x43, 0x5d, 0xca, 0x29, 0xca, 0x6a, 0xad, 0x1e, 0xdc, 0xc4, 0xc5, 0x9c,
+	0x7f, 0x00, 0x25, 0xac, 0xff, 0xe6, 0x42, 0x1f, 0x0c, 0xa5, 0xbc, 0x72, 0xb0, 0x5a, 0xab, 0x28,
+	0x03, 0x4c, 0xaa, 0xe6, 0x01, 0x94, 0xb1, 0x3e, 0xe8, 0xf7, 0x8c, 0x81, 0x2e, 0x89, 0xca, 0x0f,
+	0x56, 0x6b, 0xf5, 0xdd, 0x2d, 0x54, 0xac, 0xd2, 0x9f, 0xc0, 0x7e, 0xbb, 0xf7, 0xa5, 0xd1, 0xed,
+	0x35, 0xda, 0x66, 0x1f, 0xf7, 0xce, 0xb1, 0x3e, 0x18, 0x48, 0x05, 0xe5, 0x68, 0xb5, 0x56, 0xdf,
+	0xcb, 0xe0, 0x6f, 0x89, 0xee, 0x7d, 0x10, 0xfb, 0x1d, 0xe3, 0x5c, 0x2a, 0x2a, 0xef, 0xae, 0xd6,
+	0xea, 0x3b, 0x19, 0x68, 0x44, 0x6a, 0x14, 0x71, 0xab, 0xdb, 0x1b, 0xe8, 0x52, 0xe9, 0x56, 0xc4,
+	0x8c, 0xec, 0x93, 0xdf, 0x01, 0xba, 0xfd, 0x83, 0x8a, 0xee, 0x83, 0x68, 0xf4, 0x0c, 0x5d, 0xda,
+	0xe1, 0xf1, 0xdf, 0x46, 0x18, 0xd4, 0x23, 0x48, 0x83, 0x7c, 0xf7, 0xab, 0x2f, 0x24, 0x41, 0xf9,
+	0xe1, 0x6a, 0xad, 0xde, 0xbd, 0x0d, 0xea, 0x7e, 0xf5, 0xc5, 0x09, 0x85, 0x6a, 0x76, 0x63, 0x0d,
+	0xca, 0x4f, 0xf4, 0x61, 0xa3, 0xdd, 0x18, 0x36, 0xa4, 0x1d, 0x7e, 0xa5, 0xc4, 0xfd, 0x84, 0x84,
+	0x16, 0x2b, 0xc2, 0x43, 0x28, 0x18, 0xfa, 0x53, 0x1d, 0x4b, 0x82, 0xb2, 0xbf, 0x5a, 0xab, 0xbb,
+	0x09, 0xc0, 0x20, 0x57, 0xc4, 0x47, 0x75, 0x28, 0x36, 0xba, 0x5f, 0x36, 0x9e, 0x0d, 0xa4, 0x9c,
+	0x82, 0x56, 0x6b, 0x75, 0x2f, 0x71, 0x37, 0xdc, 0x17, 0xd6, 0x32, 0x38, 0xf9, 0xaf, 0x00, 0xb5,
+	0xec, 0xa3, 0x8c, 0xea, 0x20, 0x9e, 0x75, 0xba, 0x7a, 0x72, 0x5c, 0xd6, 0x17, 0x8d, 0xd1, 0x31,
+	0x54, 0xda, 0x1d, 0xac, 0xb7, 0x86, 0x3d, 0xfc, 0x2c, 0x89, 0x25, 0x0b, 0x6a, 0x3b, 0x3e, 0x13,
+	0xf8, 0x12, 0xfd, 0x0c, 0x6a, 0x83, 0x67, 0x4f, 0xba, 0x1d, 0xe3, 0xd7, 0x26, 0xdb, 0x31, 0xa7,
+	0x3c, 0x5c, 0xad, 0xd5, 0x7b, 0x5b, 0x60, 0x32, 0xf7, 0xc9, 0xd8, 0x0a, 0x89, 0x3d, 0xe0, 0x0f,
+	0x4d, 0xe4, 0x2c, 0x0b, 0xa8, 0x05, 0xfb, 0xc9, 0xd2, 0xcd, 0x61, 0x79, 0xe5, 0xe3, 0xd5, 0x5a,
+	0xfd, 0xf0, 0x3b, 0xd7, 0xa7, 0xa7, 0x97, 0x05, 0x74, 0x1f, 0x4a, 0xf1, 0x26, 0x89, 0x92, 0xb2,
+	0x4b, 0xe3, 0x05, 0x27, 0x7f, 0x11, 0xa0, 0x92, 0xb6, 0xab, 0x88, 0x70, 0xa3, 0x67, 0xea, 0x18,
+	0xf7, 0x70, 0xc2, 0x40, 0xea, 0x34, 0x28, 0x1b, 0xa2, 0x7b, 0x50, 0x3a, 0xd7, 0x0d, 0x1d, 0x77,
+	0x5a, 0x49, 0x61, 0xa4, 0x90, 0x73, 0xe2, 0x11, 0xdf, 0x19, 0xa3, 0x8f, 0xa0, 0x66, 0xf4, 0xcc,
+	0xc1, 0x45, 0xeb, 0x71, 0x12, 0x3a, 0x3b, 0x3f, 0xb3, 0xd5, 0x60, 0x31, 0xbe, 0x64, 0x7c, 0x9e,
+	0x44, 0x35, 0xf4, 0xb4, 0xd1, 0xed, 0xb4, 0x39, 0x34, 0xaf, 0xc8, 0xab, 0xb5, 0x7a, 0x27, 0x85,
+	0x76, 0xf8, 0xdf, 0x49, 0x84, 0x3d, 0xb1, 0xa1, 0xfe, 0xdd, 0x8d, 0x09, 0xa9, 0x50, 0x6c, 0xf4,
+	0xfb, 0xba, 0xd1, 0x4e, 0x6e, 0xbf, 0xf1, 0x35, 0xe6, 0x73, 0xe2, 0xd9, 0x11, 0xe2, 0xac, 0x87,
+	0xcf, 0xf5, 0xa1, 0x24, 0xdc, 0x44, 0x9c, 0xd1, 0xe8, 0x95, 0x6f, 0x1e, 0xbe, 0xfa, 0xb6, 0xbe,
+	0xf3, 0xcd, 0xb7, 0xf5, 0x9d, 0x57, 0xd7, 0x75, 0xe1, 0x9b, 0xeb, 0xba, 0xf0, 0xcf, 0xeb, 0xfa,
+	0xce, 0xbf, 0xaf, 0xeb, 0xc2, 0xd7, 0xff, 0xaa, 0x0b, 0xa3, 0x22, 0x6b, 0x64, 0x9f, 0xff, 0x6f,
+	0x00, 0x2f, 0x2d, 0xa5, 0xf8, 0xb3, 0x0e, 0x00, 0x00,
 }
@@ -0,0 +1,39 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// appleMetadataNames are the files and directories macOS creates for its
+// own purposes, in folders and at the root of volumes.
+var appleMetadataNames = map[string]struct{}{
+	".DS_Store":               {},
+	".AppleDouble":            {},
+	".AppleDB":                {},
+	".AppleDesktop":           {},
+	".Spotlight-V100":         {},
+	".Trashes":                {},
+	".fseventsd":              {},
+	".TemporaryItems":         {},
+	".DocumentRevisions-V100": {},
+	".VolumeIcon.icns":        {},
+	"Icon\r":                  {},
+}
+
+// isAppleMetadata returns whether the item is macOS metadata: one of the
+// appleMetadataNames, or an AppleDouble file holding the resource fork and
+// extended attributes of another, named for it with a "._" prefix.
+func isAppleMetadata(relPath string) bool {
+	name := filepath.Base(relPath)
+	if _, ok := appleMetadataNames[name]; ok {
+		return true
+	}
+	return strings.HasPrefix(name, "._")
+}
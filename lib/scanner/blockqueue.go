@@ -7,9 +7,15 @@
 package scanner
 
 import (
-	"errors"
+	"bufio"
+	"io"
+	"os"
 	"path/filepath"
+	stdsync "sync"
+	"syscall"
+	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/syncthing/syncthing/lib/fs"
 	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syncthing/syncthing/lib/sync"
@@ -17,6 +23,17 @@ import (
 
 // HashFile hashes the files and returns a list of blocks representing the file.
 func HashFile(fs fs.Filesystem, path string, blockSize int, counter Counter, useWeakHashes bool) ([]protocol.BlockInfo, error) {
+	return hashFile(fs, path, nil, hashOptions{
+		blockSize:     blockSize,
+		counter:       counter,
+		useWeakHashes: useWeakHashes,
+	})
+}
+
+// hashFile is like HashFile, but takes a list of blocks that are known to
+// be unchanged at the start of the file. Those are reused as is and hashing
+// starts at the first byte after them.
+func hashFile(fs fs.Filesystem, path string, prefix []protocol.BlockInfo, opts hashOptions) ([]protocol.BlockInfo, error) {
 	fd, err := fs.Open(path)
 	if err != nil {
 		l.Debugln("open:", err)
@@ -34,14 +51,82 @@ func HashFile(fs fs.Filesystem, path string, blockSize int, counter Counter, use
 	size := fi.Size()
 	modTime := fi.ModTime()
 
+	// Skip past the part of the file covered by the reused blocks, unless
+	// the file has shrunk so that they can't possibly be valid.
+
+	var offset int64
+	for _, b := range prefix {
+		offset += int64(b.Size)
+	}
+	if offset > size {
+		prefix, offset = nil, 0
+	}
+	if offset > 0 {
+		if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+			l.Debugln("seek:", err)
+			return nil, err
+		}
+		if fn := opts.blockFn; fn != nil {
+			// The hashed blocks follow the reused ones.
+			skipped := len(prefix)
+			opts.blockFn = func(i int, b protocol.BlockInfo) {
+				b.Offset += offset
+				fn(i+skipped, b)
+			}
+		}
+	}
+
 	// Hash the file. This may take a while for large files.
 
-	blocks, err := Blocks(fd, blockSize, size, counter, useWeakHashes)
+	var blocks []protocol.BlockInfo
+	mapped := false
+	if opts.mmap && opts.wrap == nil && size > offset && size-offset >= opts.mmapThreshold {
+		blocks, mapped, err = hashMapped(fd, size, offset, opts)
+	}
+	if !mapped {
+		var r io.Reader = fd
+		if opts.chunkReader != nil {
+			opts.chunkReader.Reset(fd)
+			defer opts.chunkReader.Reset(nil)
+			r = opts.chunkReader
+		}
+		sizehint := size - offset
+		if opts.wrap != nil {
+			// There's no telling how much comes out.
+			wr, err := opts.wrap(r)
+			if err != nil {
+				l.Debugln("wrap:", err)
+				return nil, wrapError{err}
+			}
+			r = wrappedReader{wr}
+			sizehint = -1
+		}
+		blocks, err = hashBlocks(r, sizehint, opts)
+	}
 	if err != nil {
 		l.Debugln("blocks:", err)
 		return nil, err
 	}
 
+	if offset > 0 {
+		if offset == size {
+			// Blocks returns a single empty block for an empty reader,
+			// which is not what we want at the end of a file.
+			blocks = nil
+		}
+		for i := range blocks {
+			blocks[i].Offset += offset
+		}
+		blocks = append(append([]protocol.BlockInfo(nil), prefix...), blocks...)
+	}
+
+	if opts.verify && !opts.streamOnly && opts.wrap == nil {
+		if err := verifyBlocks(blocks, size); err != nil {
+			l.Debugln("verify:", err)
+			return nil, err
+		}
+	}
+
 	// Recheck the size and modtime again. If they differ, the file changed
 	// while we were reading it and our hash results are invalid.
 
@@ -51,7 +136,7 @@ func HashFile(fs fs.Filesystem, path string, blockSize int, counter Counter, use
 		return nil, err
 	}
 	if size != fi.Size() || !modTime.Equal(fi.ModTime()) {
-		return nil, errors.New("file changed during hashing")
+		return nil, errChangedDuringHashing
 	}
 
 	return blocks, nil
@@ -62,89 +147,644 @@ func HashFile(fs fs.Filesystem, path string, blockSize int, counter Counter, use
 // workers are used in parallel. The outbox will become closed when the inbox
 // is closed and all items handled.
 type parallelHasher struct {
-	fs            fs.Filesystem
-	dir           string
-	blockSize     int
-	workers       int
-	outbox        chan<- protocol.FileInfo
-	inbox         <-chan protocol.FileInfo
-	counter       Counter
-	done          chan<- struct{}
-	cancel        <-chan struct{}
-	useWeakHashes bool
-	wg            sync.WaitGroup
-}
-
-func newParallelHasher(fs fs.Filesystem, dir string, blockSize, workers int, outbox chan<- protocol.FileInfo, inbox <-chan protocol.FileInfo, counter Counter, done chan<- struct{}, cancel <-chan struct{}, useWeakHashes bool) {
+	Config
+	outbox  chan<- protocol.FileInfo
+	inbox   <-chan protocol.FileInfo
+	counter Counter
+	done    chan<- struct{}
+	wg      sync.WaitGroup
+	// openFiles has a slot for each file that may be open at once, if
+	// limited.
+	openFiles chan struct{}
+	// chunkReaders holds the *bufio.Readers for ReadChunkSize, if set.
+	chunkReaders *stdsync.Pool
+	metrics      *scanMetrics
+	// inline is set when the walker also hashes small files through
+	// hashOne, which makes it one more hasher.
+	inline bool
+	// inflight counts the files handed out but not yet hashed, when the
+	// hashers are kept to one directory at a time.
+	inflight sync.WaitGroup
+	control  *ScanControl
+	// hashers holds the idle Hashers from Config.HasherFactory.
+	hashers chan Hasher
+}
+
+func newParallelHasher(cfg Config, outbox chan<- protocol.FileInfo, inbox <-chan protocol.FileInfo, counter Counter, done chan<- struct{}, control *ScanControl) *parallelHasher {
+	if cfg.BufferPool == nil {
+		blockSize := cfg.BlockSize
+		cfg.BufferPool = &stdsync.Pool{
+			New: func() interface{} {
+				bs := make([]byte, blockSize)
+				return &bs
+			},
+		}
+	}
+
 	ph := &parallelHasher{
-		fs:            fs,
-		dir:           dir,
-		blockSize:     blockSize,
-		workers:       workers,
-		outbox:        outbox,
-		inbox:         inbox,
-		counter:       counter,
-		done:          done,
-		cancel:        cancel,
-		useWeakHashes: useWeakHashes,
-		wg:            sync.NewWaitGroup(),
+		Config:  cfg,
+		outbox:  outbox,
+		inbox:   inbox,
+		counter: counter,
+		done:    done,
+		wg:      sync.NewWaitGroup(),
+		metrics: newScanMetrics(cfg.MetricsRegistry),
+		control: control,
+	}
+	if cfg.MaxOpenFiles > 0 {
+		ph.openFiles = make(chan struct{}, cfg.MaxOpenFiles)
+	}
+	if cfg.HasherFactory != nil {
+		// At least one, for the walker hashing small files itself.
+		n := ph.Hashers
+		if n < 1 {
+			n = 1
+		}
+		ph.hashers = make(chan Hasher, n)
+		for i := 0; i < n; i++ {
+			ph.hashers <- cfg.HasherFactory()
+		}
+	}
+	if cfg.ReadChunkSize > 0 {
+		chunkSize := cfg.ReadChunkSize
+		ph.chunkReaders = &stdsync.Pool{
+			New: func() interface{} {
+				return bufio.NewReaderSize(nil, chunkSize)
+			},
+		}
+	}
+	if cfg.SequentialPerDir {
+		ph.inflight = sync.NewWaitGroup()
+		ph.inbox = ph.groupByDir(inbox)
 	}
 
-	for i := 0; i < workers; i++ {
+	for i := 0; i < ph.Hashers; i++ {
 		ph.wg.Add(1)
-		go ph.hashFiles()
+		go ph.hashFiles(i)
 	}
 
-	go ph.closeWhenDone()
+	go ph.closeWhenDone(inbox)
+
+	return ph
 }
 
-func (ph *parallelHasher) hashFiles() {
+func (ph *parallelHasher) hashFiles(i int) {
 	defer ph.wg.Done()
 
+	ph.metrics.hasherStarted()
+	defer ph.metrics.hasherStopped()
+
 	for {
+		// Over the memory limit, only the first hasher keeps going.
+		if i > 0 && !ph.control.waitMemory(ph.Cancel) {
+			return
+		}
+
 		select {
 		case f, ok := <-ph.inbox:
 			if !ok {
 				return
 			}
 
-			if f.IsDirectory() || f.IsDeleted() {
-				panic("Bug. Asked to hash a directory or a deleted file.")
+			ok = ph.hashOne(f)
+			if ph.inflight != nil {
+				ph.inflight.Done()
 			}
-
-			blocks, err := HashFile(ph.fs, filepath.Join(ph.dir, f.Name), ph.blockSize, ph.counter, ph.useWeakHashes)
-			if err != nil {
-				l.Debugln("hash error:", f.Name, err)
-				continue
+			if !ok {
+				return
 			}
 
-			f.Blocks = blocks
-
-			// The size we saw when initially deciding to hash the file
-			// might not have been the size it actually had when we hashed
-			// it. Update the size from the block list.
+		case <-ph.Cancel:
+			return
+		}
+	}
+}
 
-			f.Size = 0
-			for _, b := range blocks {
-				f.Size += int64(b.Size)
+// groupByDir passes on the files from in, but only once all files from the
+// previous directory have been hashed.
+func (ph *parallelHasher) groupByDir(in <-chan protocol.FileInfo) <-chan protocol.FileInfo {
+	out := make(chan protocol.FileInfo)
+	go func() {
+		defer close(out)
+		var curDir string
+		first := true
+		for f := range in {
+			dir := filepath.Dir(f.Name)
+			if !first && dir != curDir {
+				ph.inflight.Wait()
 			}
+			first = false
+			curDir = dir
 
+			ph.inflight.Add(1)
 			select {
-			case ph.outbox <- f:
-			case <-ph.cancel:
+			case out <- f:
+			case <-ph.Cancel:
+				ph.inflight.Done()
 				return
 			}
+		}
+	}()
+	return out
+}
 
-		case <-ph.cancel:
-			return
+// hashOne hashes a single file and sends it to the outbox. It returns false
+// if cancelled.
+func (ph *parallelHasher) hashOne(f protocol.FileInfo) bool {
+	if (f.IsDeleted() || f.IsDirectory() || f.IsSymlink()) && !ph.Deterministic {
+		panic("Bug. Asked to hash a directory or a deleted file.")
+	}
+
+	if f.IsDeleted() || f.IsDirectory() || f.IsSymlink() {
+		// Passed through to keep the order, in deterministic mode.
+		select {
+		case ph.outbox <- f:
+		case <-ph.Cancel:
+			return false
+		}
+		return true
+	}
+
+	ph.metrics.fileQueued(-1)
+	// The size on disk, as found by the walker, for the checkpoint.
+	size := f.Size
+
+	if ph.TrustModTime && blocksCover(f.Blocks, f.Size) {
+		// Reused as they were, see walkRegular.
+		select {
+		case ph.outbox <- f:
+		case <-ph.Cancel:
+			return false
+		}
+		return true
+	}
+
+	if ph.pastDeadline() {
+		// Too late to start on this one; it'll be picked up by the next
+		// scan.
+		l.Debugln("deadline passed, dropping", f.Name)
+		ph.control.setTruncated()
+		ph.reportError(f.Name, errDeadline)
+		return true
+	}
+
+	if ph.noHash(f.Name, f.Size) {
+		// Metadata only; the contents are not ours to look at.
+		f.Invalid = true
+		f.Blocks = nil
+		select {
+		case ph.outbox <- f:
+		case <-ph.Cancel:
+			return false
+		}
+		return true
+	}
+
+	opts := hashOptions{
+		blockSize:     ph.BlockSize,
+		counter:       ph.counter,
+		useWeakHashes: ph.useWeakHashes(f.Name, f.Size),
+		noStrong:      ph.SkipStrongHashes,
+		verify:        ph.VerifyEmitted,
+		mmap:          ph.UseMmap,
+		mmapThreshold: ph.MmapThreshold,
+		chunking:      ph.ChunkingMode,
+	}
+	if wc, ok := opts.counter.(workCounter); ok && opts.useWeakHashes {
+		wc.cost = ph.hashCost(true)
+		opts.counter = wc
+	}
+	if ph.BlockFn != nil {
+		name := f.Name
+		opts.blockFn = func(i int, b protocol.BlockInfo) {
+			ph.BlockFn(name, i, b.Hash, b.Offset, int64(b.Size))
+		}
+	}
+
+	// Any blocks already present on the file are a known good
+	// prefix that we don't need to hash again, unless we need to
+	// see the whole file for the digests. Config.reusesBlocks makes
+	// the same choices for the progress totals.
+	prefix := f.Blocks
+	if ph.DigestFn != nil && len(ph.ExtraDigests) > 0 && ph.hashers == nil {
+		opts.digests = newDigests(ph.ExtraDigests)
+		prefix = nil
+	}
+
+	// Large files may have their blocks go only to BlockFn, in which case
+	// all of them must go there.
+	var streamedSize int64
+	if opts.blockFn != nil && ph.StreamBlocksThreshold > 0 && f.Size >= ph.StreamBlocksThreshold {
+		opts.streamOnly = true
+		prefix = nil
+		blockFn := opts.blockFn
+		opts.blockFn = func(i int, b protocol.BlockInfo) {
+			streamedSize += int64(b.Size)
+			blockFn(i, b)
+		}
+	}
+
+	if ph.openFiles != nil {
+		select {
+		case ph.openFiles <- struct{}{}:
+		case <-ph.Cancel:
+			return false
+		}
+	}
+
+	if ph.ContentSniffFilter != nil && ph.sniffFiltered(f.Name) {
+		l.Debugln("filtered by content:", f.Name)
+		if ph.openFiles != nil {
+			<-ph.openFiles
+		}
+		ph.reportError(f.Name, errFilteredByContent)
+		return true
+	}
+
+	if ph.hashers != nil {
+		select {
+		case opts.hasher = <-ph.hashers:
+		case <-ph.Cancel:
+			return false
+		}
+	}
+
+	// The buffer goes back into the pool only once hashing is
+	// complete, as nothing refers to it after that.
+	bufp := ph.BufferPool.Get().(*[]byte)
+	opts.buf = *bufp
+	if ph.chunkReaders != nil {
+		opts.chunkReader = ph.chunkReaders.Get().(*bufio.Reader)
+	}
+
+	var decompressed bool
+	if ph.DecompressFilter != nil {
+		if wrap, ok := ph.DecompressFilter(f.Name); ok {
+			// Nothing of the raw file applies to what comes out.
+			opts.wrap = wrap
+			prefix = nil
+			decompressed = true
 		}
 	}
+
+	var priorBufp *[]byte
+	var priorCloser io.Closer
+	if ph.PriorContentProvider != nil && ph.hashers == nil && !decompressed {
+		if cf, ok := ph.CurrentFiler.CurrentFile(f.Name); ok && !cf.IsDeleted() && !cf.IsInvalid() && len(cf.Blocks) > 0 {
+			if r, err := ph.PriorContentProvider.PriorContent(f.Name); err == nil && r != nil {
+				priorBufp = ph.BufferPool.Get().(*[]byte)
+				opts.prior = newPriorBlocks(r, cf.Blocks, *priorBufp)
+				priorCloser, _ = r.(io.Closer)
+			} else if err != nil {
+				l.Debugln("prior content:", f.Name, err)
+			}
+		}
+	}
+
+	ph.metrics.hashing(true)
+	blocks, cancelled, err := ph.hashRetryLocked(f.Name, prefix, opts)
+	if _, ok := err.(wrapError); ok && !cancelled {
+		// Not what the filter thought it was, so the raw contents it is.
+		l.Debugln("not decompressible, hashing raw:", f.Name, err)
+		opts.wrap = nil
+		decompressed = false
+		blocks, cancelled, err = ph.hashRetryLocked(f.Name, nil, opts)
+	}
+	ph.metrics.hashing(false)
+	ph.BufferPool.Put(bufp)
+	if opts.chunkReader != nil {
+		ph.chunkReaders.Put(opts.chunkReader)
+	}
+	if priorBufp != nil {
+		ph.BufferPool.Put(priorBufp)
+	}
+	if priorCloser != nil {
+		priorCloser.Close()
+	}
+	if ph.openFiles != nil {
+		<-ph.openFiles
+	}
+	if opts.hasher != nil {
+		ph.hashers <- opts.hasher
+	}
+	if cancelled {
+		return false
+	}
+	switch {
+	case err != nil && (ph.EmitPlaceholderOnHashError || ph.RetryLockedFiles > 0 && lockedFile(err)):
+		// The file is there as far as we know, we just can't read
+		// it. Say so, keeping the size and modification time from
+		// when it was found.
+		l.Debugln("hash error, placeholder:", f.Name, err)
+		ph.reportError(f.Name, err)
+		f.Invalid = true
+		f.Blocks = nil
+
+	case err != nil:
+		l.Debugln("hash error:", f.Name, err)
+		if _, ok := err.(blockListError); ok || isTooManyOpenFiles(err) {
+			ph.reportError(f.Name, err)
+		}
+		return true
+
+	default:
+		if opts.digests != nil {
+			ph.DigestFn(f.Name, sumDigests(opts.digests))
+		}
+
+		f.Blocks = blocks
+
+		// The size we saw when initially deciding to hash the file
+		// might not have been the size it actually had when we
+		// hashed it. Update the size from the block list.
+
+		f.Size = 0
+		for _, b := range blocks {
+			f.Size += int64(b.Size)
+		}
+		if opts.streamOnly {
+			f.Size = streamedSize
+		}
+
+		if ph.DetectSparse && ph.AllocationFn != nil {
+			ph.reportAllocation(f)
+		}
+		f.Decompressed = decompressed
+		if decompressed && ph.DecompressedFn != nil {
+			ph.DecompressedFn(f.Name)
+		}
+		if !decompressed && ph.control != nil {
+			if first, ok := ph.control.dedup.duplicate(&f); ok {
+				l.Debugln("duplicate contents:", f.Name, first)
+				if ph.DuplicateFn != nil {
+					ph.DuplicateFn(f.Name, first)
+				}
+			}
+		}
+	}
+
+	if ph.AuditOnly {
+		ph.audit(f)
+		return true
+	}
+
+	// Recorded first, as the file may be stored as soon as it's sent.
+	if !f.Invalid && ph.control != nil {
+		ph.control.checkpoints.done(Checkpoint{
+			Name:    f.Name,
+			Size:    size,
+			ModTime: f.ModTime(),
+		})
+	}
+
+	select {
+	case ph.outbox <- f:
+	case <-ph.Cancel:
+		return false
+	}
+
+	return true
+}
+
+// audit reports the file if its blocks differ from those in the index.
+func (ph *parallelHasher) audit(f protocol.FileInfo) {
+	if f.Invalid {
+		// Couldn't be read, which has been reported already.
+		return
+	}
+	cf, ok := ph.CurrentFiler.CurrentFile(f.Name)
+	if !ok {
+		return
+	}
+	if cf.Size != f.Size || !BlocksEqual(cf.Blocks, f.Blocks) {
+		l.Debugln("audit mismatch:", f.Name)
+		ph.reportError(f.Name, errContentDiffers)
+	}
+}
+
+// A ReaderWrapper returns a reader for the contents read from r, such as
+// those of a compressed file, decompressed.
+type ReaderWrapper func(r io.Reader) (io.Reader, error)
+
+// wrapError is an error from a ReaderWrapper or the reader it returned.
+type wrapError struct {
+	error
+}
+
+// wrappedReader marks the errors from the reader as wrapErrors.
+type wrappedReader struct {
+	r io.Reader
+}
+
+func (r wrappedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = wrapError{err}
+	}
+	return n, err
 }
 
-func (ph *parallelHasher) closeWhenDone() {
+// sniffFiltered returns whether the ContentSniffFilter rejects the file
+// based on its first few bytes. Files that can't be read are not rejected,
+// as hashing them will fail anyway.
+func (ph *parallelHasher) sniffFiltered(name string) bool {
+	fd, err := ph.Filesystem.Open(filepath.Join(ph.Dir, name))
+	if err != nil {
+		l.Debugln("sniff:", name, err)
+		return false
+	}
+	defer fd.Close()
+
+	size := ph.ContentSniffSize
+	if size <= 0 {
+		size = defaultContentSniffSize
+	}
+	header := make([]byte, size)
+	n, err := io.ReadFull(fd, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		l.Debugln("sniff:", name, err)
+		return false
+	}
+	return ph.ContentSniffFilter(header[:n], name)
+}
+
+// blocksCover returns whether the blocks are a complete block list for a
+// file of the given size.
+func blocksCover(blocks []protocol.BlockInfo, size int64) bool {
+	if len(blocks) == 0 {
+		return false
+	}
+	var total int64
+	for _, b := range blocks {
+		total += int64(b.Size)
+	}
+	return total == size
+}
+
+// hashRetryLocked hashes the file, retrying while it is locked as per
+// RetryLockedFiles. cancelled is true if the scan was cancelled while
+// waiting to retry.
+func (ph *parallelHasher) hashRetryLocked(name string, prefix []protocol.BlockInfo, opts hashOptions) (blocks []protocol.BlockInfo, cancelled bool, err error) {
+	path := filepath.Join(ph.Dir, name)
+	counter := opts.counter
+	hash := func() ([]protocol.BlockInfo, error) {
+		opts.counter = ph.timedCounter(counter)
+		return hashFile(ph.Filesystem, path, prefix, opts)
+	}
+	blocks, err = hash()
+
+	delay := ph.RetryLockedDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for attempt := 0; err != nil && attempt < ph.RetryLockedFiles && lockedFile(err); attempt++ {
+		l.Debugf("locked, retrying %s in %v: %v", name, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ph.Cancel:
+			return nil, true, err
+		}
+		delay *= 2
+		blocks, err = hash()
+	}
+	return blocks, false, err
+}
+
+// timedCounter returns the counter with the CPU throttle and HashTimings
+// applied, as configured. Their clocks start at once, so this is called
+// right before hashing, after any waiting for open files or hashers.
+func (ph *parallelHasher) timedCounter(counter Counter) Counter {
+	if ph.MaxHashCPUPercent > 0 {
+		counter = newCPUThrottle(counter, ph.hashCPUShare(ph.hashingRoutines()), ph.Cancel)
+	}
+	if ph.HashTimings != nil {
+		counter = newTimingCounter(counter, ph.HashTimings)
+	}
+	return counter
+}
+
+// reportAllocation passes the allocated size of the file to AllocationFn.
+func (ph *parallelHasher) reportAllocation(f protocol.FileInfo) {
+	allocated, err := ph.Filesystem.AllocatedSize(filepath.Join(ph.Dir, f.Name))
+	if err != nil {
+		l.Debugln("allocated size:", f.Name, err)
+		allocated = 0
+	}
+	ph.AllocationFn(f.Name, allocated > 0 && allocated < f.Size, allocated)
+}
+
+func (ph *parallelHasher) closeWhenDone(inbox <-chan protocol.FileInfo) {
 	ph.wg.Wait()
+	// The hashers stop early when cancelled, but the walker may still be
+	// sending directories to the outbox until it closes the inbox.
+	for range inbox {
+	}
+	if ph.control != nil {
+		ph.control.memory.close()
+		ph.control.checkpoints.flush()
+		ph.control.setPhase(PhaseDone)
+	}
 	if ph.done != nil {
 		close(ph.done)
 	}
 	close(ph.outbox)
 }
+
+// A timingCounter records the time taken between consecutive updates, i.e.
+// the time to read and hash each block, and passes the updates on to the
+// next counter if there is one. Time spent in the next counter, such as a
+// cpuThrottle pause, is not recorded.
+type timingCounter struct {
+	next    Counter
+	timings metrics.Histogram
+	last    time.Time
+}
+
+func newTimingCounter(next Counter, timings metrics.Histogram) *timingCounter {
+	return &timingCounter{
+		next:    next,
+		timings: timings,
+		last:    time.Now(),
+	}
+}
+
+func (c *timingCounter) Update(bytes int64) {
+	now := time.Now()
+	c.timings.Update(int64(now.Sub(c.last)))
+	if c.next != nil {
+		c.next.Update(bytes)
+	}
+	c.last = time.Now()
+}
+
+// hashingRoutines returns how many routines may be hashing at once: the
+// hashers, and the walker if it hashes small files itself.
+func (ph *parallelHasher) hashingRoutines() int {
+	n := ph.Hashers
+	if n < 1 {
+		n = 1
+	}
+	if ph.inline {
+		n++
+	}
+	return n
+}
+
+// hashCPUShare returns the share of the time each of the given number of
+// routines may spend hashing to stay within MaxHashCPUPercent.
+func (cfg *Config) hashCPUShare(routines int) float64 {
+	return float64(cfg.MaxHashCPUPercent) / 100 / float64(routines)
+}
+
+// A cpuThrottle pauses after each block for long enough that the time spent
+// hashing is at most the given share of the total. The pauses end early if
+// cancel is closed.
+type cpuThrottle struct {
+	next   Counter
+	share  float64
+	cancel <-chan struct{}
+	last   time.Time
+}
+
+func newCPUThrottle(next Counter, share float64, cancel <-chan struct{}) *cpuThrottle {
+	return &cpuThrottle{
+		next:   next,
+		share:  share,
+		cancel: cancel,
+		last:   timeNow(),
+	}
+}
+
+func (c *cpuThrottle) Update(bytes int64) {
+	if c.next != nil {
+		c.next.Update(bytes)
+	}
+	if pause := throttlePause(timeNow().Sub(c.last), c.share); pause > 0 {
+		select {
+		case <-time.After(pause):
+		case <-c.cancel:
+		}
+	}
+	c.last = timeNow()
+}
+
+// throttlePause returns how long to pause after being busy for the given
+// time, to be busy only the given share of the time.
+func throttlePause(busy time.Duration, share float64) time.Duration {
+	if share <= 0 || share >= 1 {
+		return 0
+	}
+	return time.Duration(float64(busy) * (1/share - 1))
+}
+
+// lockedFile is isLockedFile, unless replaced in tests.
+var lockedFile = isLockedFile
+
+// isTooManyOpenFiles returns whether the error is due to file descriptor
+// exhaustion, either in the process or system wide.
+func isTooManyOpenFiles(err error) bool {
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
+	return err == syscall.EMFILE || err == syscall.ENFILE
+}
@@ -7,10 +7,12 @@
 package scanner
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
 
 	"github.com/chmduquesne/rollinghash/adler32"
 	"github.com/syncthing/syncthing/lib/protocol"
@@ -23,26 +25,93 @@ type Counter interface {
 	Update(bytes int64)
 }
 
+// A Hasher computes the blocks of a file, in place of the built in hashing,
+// for example using hardware acceleration. Blocks has the semantics of the
+// Blocks function, which is the default. It is called with files that are
+// already open and positioned, and the result is checked against the file
+// as usual.
+type Hasher interface {
+	Blocks(r io.Reader, blocksize int, sizehint int64, counter Counter, useWeakHashes bool) ([]protocol.BlockInfo, error)
+}
+
 // Blocks returns the blockwise hash of the reader.
 func Blocks(r io.Reader, blocksize int, sizehint int64, counter Counter, useWeakHashes bool) ([]protocol.BlockInfo, error) {
-	hf := sha256.New()
-	hashLength := hf.Size()
+	return hashBlocks(r, sizehint, hashOptions{
+		blockSize:     blocksize,
+		counter:       counter,
+		useWeakHashes: useWeakHashes,
+	})
+}
 
-	var mhf io.Writer
-	var whf hash.Hash32
+// hashOptions holds the settings for hashing a single file or reader.
+type hashOptions struct {
+	blockSize     int
+	counter       Counter
+	useWeakHashes bool
+	// noStrong leaves out the SHA-256 hashes.
+	noStrong bool
+	// buf is used for copying into the hash functions. A 32k buffer is
+	// allocated if it is nil.
+	buf []byte
+	// digests are fed the complete contents, in addition to the block
+	// hashes.
+	digests map[DigestType]hash.Hash
+	// prior, if set, is consulted for each block to see if it can be
+	// reused from the previous version of the file.
+	prior *priorBlocks
+	// blockFn, if set, is called with each block as it is done.
+	blockFn func(index int, b protocol.BlockInfo)
+	// verify makes hashFile check the resulting block list against the
+	// size of the file.
+	verify bool
+	// chunkReader, if set, is used by hashFile to read the file in chunks
+	// of its buffer size.
+	chunkReader *bufio.Reader
+	// mmap makes hashFile read files of at least mmapThreshold bytes
+	// through a memory mapping, where possible.
+	mmap          bool
+	mmapThreshold int64
+	// streamOnly passes the blocks only to blockFn, without keeping
+	// them, so that the memory used doesn't grow with the file.
+	streamOnly bool
+	// hasher, if set, does the hashing instead. Only blockFn of the
+	// above is honoured then, in addition to its own arguments.
+	hasher Hasher
+	// wrap, if set, makes hashFile hash what it reads from the file
+	// through the returned reader instead of the file itself.
+	wrap ReaderWrapper
+	// chunking selects how the contents are cut into blocks. Only
+	// ChunkingFixed honours prior.
+	chunking ChunkingMode
+}
 
-	if useWeakHashes {
-		whf = adler32.New()
-		mhf = io.MultiWriter(hf, whf)
-	} else {
-		whf = noopHash{}
-		mhf = hf
+func hashBlocks(r io.Reader, sizehint int64, opts hashOptions) ([]protocol.BlockInfo, error) {
+	if opts.hasher != nil {
+		blocks, err := opts.hasher.Blocks(r, opts.blockSize, sizehint, opts.counter, opts.useWeakHashes)
+		if err == nil && opts.blockFn != nil {
+			for i, b := range blocks {
+				opts.blockFn(i, b)
+			}
+		}
+		if opts.streamOnly {
+			blocks = nil
+		}
+		return blocks, err
 	}
+	if opts.chunking == ChunkingContentDefined {
+		return hashChunks(r, opts)
+	}
+
+	blocksize := opts.blockSize
+	counter := opts.counter
+
+	hf, whf, mhf, dw := newBlockHashers(opts)
+	hashLength := hf.Size()
 
 	var blocks []protocol.BlockInfo
 	var hashes, thisHash []byte
 
-	if sizehint >= 0 {
+	if sizehint >= 0 && !opts.streamOnly {
 		// Allocate contiguous blocks for the BlockInfo structures and their
 		// hashes once and for all, and stick to the specified size.
 		r = io.LimitReader(r, sizehint)
@@ -51,16 +120,46 @@ func Blocks(r io.Reader, blocksize int, sizehint int64, counter Counter, useWeak
 		hashes = make([]byte, 0, hashLength*numBlocks)
 	}
 
-	// A 32k buffer is used for copying into the hash function.
-	buf := make([]byte, 32<<10)
+	buf := opts.buf
+	if len(buf) == 0 {
+		// A 32k buffer is used for copying into the hash function.
+		buf = make([]byte, 32<<10)
+	}
+
+	if opts.prior != nil && len(buf) < blocksize {
+		// Blocks are read whole to compare them with the previous ones.
+		buf = make([]byte, blocksize)
+	}
 
 	var offset int64
+	var index int
 	lr := io.LimitReader(r, int64(blocksize)).(*io.LimitedReader)
 	for {
 		lr.N = int64(blocksize)
-		n, err := io.CopyBuffer(mhf, lr, buf)
-		if err != nil {
-			return nil, err
+
+		var n int64
+		var reused *protocol.BlockInfo
+		if opts.prior != nil {
+			rn, err := io.ReadFull(lr, buf[:blocksize])
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			n = int64(rn)
+			data := buf[:rn]
+			if reused, err = opts.prior.find(data); err != nil {
+				return nil, err
+			}
+			if reused != nil {
+				dw.Write(data)
+			} else {
+				mhf.Write(data)
+			}
+		} else {
+			var err error
+			n, err = io.CopyBuffer(mhf, lr, buf)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		if n == 0 {
@@ -71,37 +170,171 @@ func Blocks(r io.Reader, blocksize int, sizehint int64, counter Counter, useWeak
 			counter.Update(n)
 		}
 
-		// Carve out a hash-sized chunk of "hashes" to store the hash for this
-		// block.
-		hashes = hf.Sum(hashes)
-		thisHash, hashes = hashes[:hashLength], hashes[hashLength:]
+		var weakHash uint32
+		if reused != nil {
+			thisHash = reused.Hash
+			if opts.useWeakHashes {
+				weakHash = reused.WeakHash
+			}
+		} else {
+			// Carve out a hash-sized chunk of "hashes" to store the hash
+			// for this block.
+			hashes = hf.Sum(hashes)
+			thisHash, hashes = hashes[:hashLength], hashes[hashLength:]
+			weakHash = whf.Sum32()
+		}
 
 		b := protocol.BlockInfo{
 			Size:     int32(n),
 			Offset:   offset,
 			Hash:     thisHash,
-			WeakHash: whf.Sum32(),
+			WeakHash: weakHash,
 		}
 
-		blocks = append(blocks, b)
+		if opts.blockFn != nil {
+			opts.blockFn(index, b)
+		}
+		index++
+
+		if !opts.streamOnly {
+			blocks = append(blocks, b)
+		}
 		offset += n
 
 		hf.Reset()
 		whf.Reset()
 	}
 
-	if len(blocks) == 0 {
+	if offset == 0 {
 		// Empty file
-		blocks = append(blocks, protocol.BlockInfo{
+		b := protocol.BlockInfo{
 			Offset: 0,
 			Size:   0,
-			Hash:   SHA256OfNothing,
-		})
+		}
+		if !opts.noStrong {
+			b.Hash = SHA256OfNothing
+		}
+		blocks = append(blocks, b)
 	}
 
 	return blocks, nil
 }
 
+// newBlockHashers returns the hash functions for the blocks as per opts: hf
+// for the strong hash, whf for the weak one, mhf to write the data of a
+// block to for both of them and the digests, and dw to write data to for
+// the digests only.
+func newBlockHashers(opts hashOptions) (hf hash.Hash, whf hash.Hash32, mhf, dw io.Writer) {
+	hf = sha256.New()
+	if opts.noStrong {
+		// Sums to nothing, so the blocks get no hash.
+		hf = noopHash{}
+	}
+
+	if opts.useWeakHashes {
+		whf = adler32.New()
+		mhf = io.MultiWriter(hf, whf)
+	} else {
+		whf = noopHash{}
+		mhf = hf
+	}
+
+	// The digests see all data, including blocks that are reused.
+	dw = ioutil.Discard
+	if len(opts.digests) > 0 {
+		writers := make([]io.Writer, 0, len(opts.digests))
+		for _, d := range opts.digests {
+			writers = append(writers, d)
+		}
+		dw = io.MultiWriter(writers...)
+		mhf = io.MultiWriter(mhf, dw)
+	}
+	return hf, whf, mhf, dw
+}
+
+// priorBlocks finds blocks of the previous version of a file, by content,
+// anywhere in that file.
+type priorBlocks struct {
+	r      io.ReaderAt
+	byWeak map[uint32][]protocol.BlockInfo
+	whf    hash.Hash32
+	buf    []byte
+}
+
+func newPriorBlocks(r io.ReaderAt, blocks []protocol.BlockInfo, buf []byte) *priorBlocks {
+	p := &priorBlocks{
+		r:      r,
+		byWeak: make(map[uint32][]protocol.BlockInfo, len(blocks)),
+		whf:    adler32.New(),
+		buf:    buf,
+	}
+	for _, b := range blocks {
+		if b.WeakHash != 0 {
+			p.byWeak[b.WeakHash] = append(p.byWeak[b.WeakHash], b)
+		}
+	}
+	return p
+}
+
+// find returns the previous block with the same contents as data, or nil
+// if there is none.
+func (p *priorBlocks) find(data []byte) (*protocol.BlockInfo, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	p.whf.Reset()
+	p.whf.Write(data)
+	candidates := p.byWeak[p.whf.Sum32()]
+
+	for i, b := range candidates {
+		if int(b.Size) != len(data) {
+			continue
+		}
+		if len(p.buf) < len(data) {
+			p.buf = make([]byte, len(data))
+		}
+		prev := p.buf[:len(data)]
+		if _, err := p.r.ReadAt(prev, b.Offset); err != nil && err != io.EOF {
+			// The previous contents are gone or changed under us; that
+			// only means we can't reuse anything from them.
+			l.Debugln("reading prior block:", err)
+			continue
+		}
+		if bytes.Equal(prev, data) {
+			return &candidates[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// A blockListError is a problem with a block list that we produced
+// ourselves, i.e. a bug.
+type blockListError string
+
+func (e blockListError) Error() string {
+	return string(e)
+}
+
+// verifyBlocks checks that the blocks are contiguous and cover exactly size
+// bytes.
+func verifyBlocks(blocks []protocol.BlockInfo, size int64) error {
+	var offset int64
+	for i, b := range blocks {
+		if b.Offset != offset {
+			return blockListError(fmt.Sprintf("block %d at offset %d, expected %d", i, b.Offset, offset))
+		}
+		if b.Size < 0 || b.Size == 0 && size != 0 {
+			return blockListError(fmt.Sprintf("block %d has size %d", i, b.Size))
+		}
+		offset += int64(b.Size)
+	}
+	if offset != size {
+		return blockListError(fmt.Sprintf("blocks cover %d bytes, expected %d", offset, size))
+	}
+	return nil
+}
+
 // PopulateOffsets sets the Offset field on each block
 func PopulateOffsets(blocks []protocol.BlockInfo) {
 	var offset int64
@@ -202,9 +435,9 @@ func BlocksEqual(src, tgt []protocol.BlockInfo) bool {
 
 type noopHash struct{}
 
-func (noopHash) Sum32() uint32             { return 0 }
-func (noopHash) BlockSize() int            { return 0 }
-func (noopHash) Size() int                 { return 0 }
-func (noopHash) Reset()                    {}
-func (noopHash) Sum([]byte) []byte         { return nil }
-func (noopHash) Write([]byte) (int, error) { return 0, nil }
+func (noopHash) Sum32() uint32               { return 0 }
+func (noopHash) BlockSize() int              { return 0 }
+func (noopHash) Size() int                   { return 0 }
+func (noopHash) Reset()                      {}
+func (noopHash) Sum(b []byte) []byte         { return b }
+func (noopHash) Write(p []byte) (int, error) { return len(p), nil }
@@ -165,6 +165,63 @@ func TestDiffEmpty(t *testing.T) {
 	}
 }
 
+func TestVerifyBlocks(t *testing.T) {
+	cases := []struct {
+		blocks []protocol.BlockInfo
+		size   int64
+		ok     bool
+	}{
+		{[]protocol.BlockInfo{{Offset: 0, Size: 0}}, 0, true},
+		{[]protocol.BlockInfo{{Offset: 0, Size: 3}, {Offset: 3, Size: 2}}, 5, true},
+		{[]protocol.BlockInfo{{Offset: 0, Size: 3}, {Offset: 3, Size: 2}}, 6, false},
+		{[]protocol.BlockInfo{{Offset: 0, Size: 3}, {Offset: 4, Size: 2}}, 6, false},
+		{[]protocol.BlockInfo{{Offset: 0, Size: 3}, {Offset: 3, Size: 0}}, 3, false},
+		{nil, 3, false},
+	}
+	for i, c := range cases {
+		if err := verifyBlocks(c.blocks, c.size); (err == nil) != c.ok {
+			t.Errorf("case %d: unexpected result %v", i, err)
+		}
+	}
+
+	// Whatever we hash must pass.
+	blocks, err := Blocks(bytes.NewBufferString("contents"), 3, -1, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyBlocks(blocks, 8); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBlocksHashSelection(t *testing.T) {
+	for _, c := range []struct{ weak, strong bool }{
+		{true, true},
+		{true, false},
+		{false, true},
+		{false, false},
+	} {
+		for _, data := range []string{"contents", ""} {
+			blocks, err := hashBlocks(bytes.NewBufferString(data), int64(len(data)), hashOptions{
+				blockSize:     3,
+				useWeakHashes: c.weak,
+				noStrong:      !c.strong,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, b := range blocks {
+				if strong := len(b.Hash) > 0; strong != c.strong {
+					t.Errorf("%+v, %q: block %d has strong hash %v", c, data, i, strong)
+				}
+				if weak := b.WeakHash != 0; data != "" && weak != c.weak {
+					t.Errorf("%+v, %q: block %d has weak hash %v", c, data, i, weak)
+				}
+			}
+		}
+	}
+}
+
 func TestAdler32Variants(t *testing.T) {
 	// Verify that the two adler32 functions give matching results for a few
 	// different blocks of data.
@@ -227,3 +284,56 @@ func TestAdler32Variants(t *testing.T) {
 		hf3.Roll(data[i])
 	}
 }
+
+func TestContentDefinedChunking(t *testing.T) {
+	const blockSize = 4096
+	data := make([]byte, 256<<10)
+	if _, err := rand.Reader.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := func(data []byte) []protocol.BlockInfo {
+		blocks, err := hashBlocks(bytes.NewReader(data), int64(len(data)), hashOptions{
+			blockSize: blockSize,
+			chunking:  ChunkingContentDefined,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyBlocks(blocks, int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		for i, b := range blocks[:len(blocks)-1] {
+			if b.Size < blockSize/4 || b.Size > blockSize {
+				t.Errorf("block %d has size %d", i, b.Size)
+			}
+		}
+		return blocks
+	}
+
+	blocks := chunk(data)
+	if avg := len(data) / len(blocks); avg < blockSize/3 || avg > blockSize*3/4 {
+		t.Errorf("average block size %d, expected around %d", avg, blockSize/2)
+	}
+
+	// Inserting data at the start moves the boundaries along with it,
+	// so only the first few blocks change.
+	inserted := chunk(append([]byte("something new at the start"), data...))
+	hashes := make(map[string]struct{})
+	for _, b := range blocks {
+		hashes[string(b.Hash)] = struct{}{}
+	}
+	changed := 0
+	for _, b := range inserted {
+		if _, ok := hashes[string(b.Hash)]; !ok {
+			changed++
+		}
+	}
+	if changed > len(inserted)/10 {
+		t.Errorf("%d of %d blocks changed by inserting at the start", changed, len(inserted))
+	}
+
+	if blocks := chunk(nil); len(blocks) != 1 || blocks[0].Size != 0 || !bytes.Equal(blocks[0].Hash, SHA256OfNothing) {
+		t.Errorf("unexpected blocks for empty data: %v", blocks)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// defaultCheckpointInterval is the CheckpointInterval if unset.
+const defaultCheckpointInterval = 10 * time.Second
+
+// A Checkpointer records the files a walk has hashed, and whose results
+// the caller has stored, so that the walk can skip them if it's restarted
+// after a crash. The files it returns as completed are skipped if they
+// still have the same size and modification time; it should forget them
+// once the walk is complete.
+type Checkpointer interface {
+	// Save records the file as hashed.
+	Save(cp Checkpoint)
+	// Completed returns the files recorded as hashed.
+	Completed() []Checkpoint
+}
+
+// A Checkpoint is a hashed file, with the size and modification time it
+// had when it was found.
+type Checkpoint struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// A CheckpointFlusher is a Checkpointer that wants to know when a batch of
+// Saves is complete, e.g. to write them out at once.
+type CheckpointFlusher interface {
+	Checkpointer
+	Flush()
+}
+
+// checkpoints passes the hashed files to the Checkpointer in batches, at
+// most once per interval, once the caller has stored them. A nil
+// *checkpoints does nothing.
+type checkpoints struct {
+	cp        Checkpointer
+	interval  time.Duration
+	completed map[string]Checkpoint
+	mut       sync.Mutex
+	// returned holds the files returned, but not yet stored.
+	returned  map[string]Checkpoint
+	pending   []Checkpoint
+	lastFlush time.Time
+	// finished is set once all files are hashed, after which stored files
+	// are passed on at once.
+	finished bool
+}
+
+func newCheckpoints(cp Checkpointer, interval time.Duration) *checkpoints {
+	if interval <= 0 {
+		interval = defaultCheckpointInterval
+	}
+	c := &checkpoints{
+		cp:        cp,
+		interval:  interval,
+		completed: make(map[string]Checkpoint),
+		mut:       sync.NewMutex(),
+		returned:  make(map[string]Checkpoint),
+		lastFlush: timeNow(),
+	}
+	for _, cp := range cp.Completed() {
+		c.completed[cp.Name] = cp
+	}
+	return c
+}
+
+// isCompleted returns whether the file was hashed by an earlier attempt of
+// the walk, and is unchanged since.
+func (c *checkpoints) isCompleted(relPath string, size int64, modTime time.Time) bool {
+	if c == nil {
+		return false
+	}
+	cp, ok := c.completed[relPath]
+	return ok && cp.Size == size && cp.ModTime.Equal(modTime)
+}
+
+// done records the file as hashed and returned, to be saved once it's
+// stored.
+func (c *checkpoints) done(cp Checkpoint) {
+	if c == nil {
+		return
+	}
+	c.mut.Lock()
+	c.returned[cp.Name] = cp
+	c.mut.Unlock()
+}
+
+// stored moves the named files on to be saved, passing on the pending
+// files if the interval has passed or the walk is complete.
+func (c *checkpoints) stored(names []string) {
+	if c == nil {
+		return
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, name := range names {
+		name = filepath.FromSlash(name)
+		if cp, ok := c.returned[name]; ok {
+			delete(c.returned, name)
+			c.pending = append(c.pending, cp)
+		}
+	}
+	if c.finished || timeNow().Sub(c.lastFlush) >= c.interval {
+		c.flushLocked()
+	}
+}
+
+// flush passes on the pending files, once all files are hashed.
+func (c *checkpoints) flush() {
+	if c == nil {
+		return
+	}
+	c.mut.Lock()
+	c.finished = true
+	c.flushLocked()
+	c.mut.Unlock()
+}
+
+func (c *checkpoints) flushLocked() {
+	c.lastFlush = timeNow()
+	if len(c.pending) == 0 {
+		return
+	}
+	for _, cp := range c.pending {
+		c.cp.Save(cp)
+	}
+	c.pending = c.pending[:0]
+	if f, ok := c.cp.(CheckpointFlusher); ok {
+		f.Flush()
+	}
+}
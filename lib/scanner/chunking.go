@@ -0,0 +1,166 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"io"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// ChunkingMode is how files are cut into blocks, as per Config.ChunkingMode.
+type ChunkingMode int
+
+const (
+	// ChunkingFixed cuts files into blocks of BlockSize, the last one
+	// possibly shorter.
+	ChunkingFixed ChunkingMode = iota
+	// ChunkingContentDefined cuts files where a rolling hash of the last
+	// 64 bytes matches, so that the boundaries move along with the data
+	// when something is inserted before them.
+	ChunkingContentDefined
+)
+
+func (m ChunkingMode) String() string {
+	switch m {
+	case ChunkingFixed:
+		return "fixed"
+	case ChunkingContentDefined:
+		return "content-defined"
+	default:
+		return "unknown"
+	}
+}
+
+// gearTable holds a random value for each byte, for the rolling hash of the
+// chunker. It must never change, as that would move all boundaries.
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64, from a fixed seed.
+	x := uint64(0x5363616e43444321)
+	for i := range gearTable {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// A chunker finds the block boundaries of ChunkingContentDefined. Blocks are
+// at least a quarter and at most all of the block size, and half of it on
+// average.
+type chunker struct {
+	minSize int
+	maxSize int
+	shift   uint // a boundary is where the hash has no bits from shift up
+	hash    uint64
+	size    int // of the current block so far
+}
+
+func newChunker(blockSize int) *chunker {
+	c := &chunker{
+		minSize: blockSize / 4,
+		maxSize: blockSize,
+		shift:   64,
+	}
+	// With the top bits of the hash as the condition, a boundary is
+	// found after another minSize bytes on average, past the minimum.
+	for avg := c.minSize; avg > 1; avg >>= 1 {
+		c.shift--
+	}
+	return c
+}
+
+// next returns how many bytes of data belong to the current block, up to
+// and including its end, or -1 if all of them do and the block goes on.
+func (c *chunker) next(data []byte) int {
+	for i, b := range data {
+		c.hash = c.hash<<1 + gearTable[b]
+		c.size++
+		if c.size >= c.maxSize || c.size >= c.minSize && c.hash>>c.shift == 0 {
+			c.hash = 0
+			c.size = 0
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// hashChunks is hashBlocks for ChunkingContentDefined.
+func hashChunks(r io.Reader, opts hashOptions) ([]protocol.BlockInfo, error) {
+	hf, whf, mhf, _ := newBlockHashers(opts)
+	c := newChunker(opts.blockSize)
+
+	buf := opts.buf
+	if len(buf) == 0 {
+		buf = make([]byte, 32<<10)
+	}
+
+	var blocks []protocol.BlockInfo
+	var offset, size int64
+	var index int
+	endBlock := func() {
+		if opts.counter != nil {
+			opts.counter.Update(size)
+		}
+		b := protocol.BlockInfo{
+			Size:     int32(size),
+			Offset:   offset,
+			Hash:     hf.Sum(nil),
+			WeakHash: whf.Sum32(),
+		}
+		if opts.blockFn != nil {
+			opts.blockFn(index, b)
+		}
+		index++
+		if !opts.streamOnly {
+			blocks = append(blocks, b)
+		}
+		offset += size
+		size = 0
+		hf.Reset()
+		whf.Reset()
+	}
+
+	for {
+		n, err := r.Read(buf)
+		data := buf[:n]
+		for len(data) > 0 {
+			end := c.next(data)
+			if end < 0 {
+				mhf.Write(data)
+				size += int64(len(data))
+				break
+			}
+			mhf.Write(data[:end])
+			size += int64(end)
+			endBlock()
+			data = data[end:]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if size > 0 {
+		endBlock()
+	}
+
+	if offset == 0 {
+		// Empty file
+		b := protocol.BlockInfo{}
+		if !opts.noStrong {
+			b.Hash = SHA256OfNothing
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
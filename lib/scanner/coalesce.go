@@ -0,0 +1,190 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// A Coalescer merges walks of parts of the same folder that are requested
+// in quick succession, such as those triggered by a filesystem watcher,
+// into a single walk of all those parts. Walks never overlap: those
+// requested while one is running are merged and wait for it to finish.
+type Coalescer struct {
+	cfg     Config
+	mut     sync.Mutex
+	pending *coalescedWalk
+	running bool
+}
+
+// A coalescedWalk is a walk that requests are still being merged into, or
+// that has been started.
+type coalescedWalk struct {
+	subs    []string
+	all     bool
+	outs    []coalescedOut
+	due     bool          // set once the CoalesceWindow has passed
+	started chan struct{} // closed once the walk is started and err set
+	err     error
+}
+
+type coalescedOut struct {
+	subs  []string
+	fchan chan protocol.FileInfo
+}
+
+// NewCoalescer returns a Coalescer for walks as per cfg, apart from the
+// Subs, which are given for each walk. Walks requested within
+// cfg.CoalesceWindow of the first are merged with it.
+func NewCoalescer(cfg Config) *Coalescer {
+	return &Coalescer{
+		cfg: cfg,
+		mut: sync.NewMutex(),
+	}
+}
+
+// Walk is like the Walk function, walking the given subs of the folder, or
+// all of it if there are none. It waits for the CoalesceWindow to pass,
+// and for any running walk to finish, then walks the subs of all requests
+// made in the meantime at once. The returned channel gets the results that
+// are under the given subs. The results of the merged walk are handed out
+// in turn, so all callers must read their channel until it is closed or
+// the walk is cancelled.
+func (c *Coalescer) Walk(subs []string) (chan protocol.FileInfo, error) {
+	fchan := make(chan protocol.FileInfo)
+
+	c.mut.Lock()
+	p := c.pending
+	if p == nil {
+		p = &coalescedWalk{started: make(chan struct{})}
+		c.pending = p
+		time.AfterFunc(c.cfg.CoalesceWindow, func() {
+			c.mut.Lock()
+			p.due = true
+			c.mut.Unlock()
+			c.start()
+		})
+	}
+	if len(subs) == 0 {
+		p.all = true
+	}
+	p.subs = append(p.subs, subs...)
+	p.outs = append(p.outs, coalescedOut{subs: subs, fchan: fchan})
+	c.mut.Unlock()
+
+	<-p.started
+	if p.err != nil {
+		return nil, p.err
+	}
+	return fchan, nil
+}
+
+// start starts the pending walk and hands out its results, unless it is
+// not yet due or another walk is running, which starts it when done.
+func (c *Coalescer) start() {
+	c.mut.Lock()
+	p := c.pending
+	if p == nil || !p.due || c.running {
+		c.mut.Unlock()
+		return
+	}
+	c.pending = nil
+	c.running = true
+	c.mut.Unlock()
+
+	cfg := c.cfg
+	cfg.Subs = nil
+	if !p.all {
+		cfg.Subs = mergeSubs(p.subs)
+	}
+	l.Debugf("coalesced %d walks of %s into %v", len(p.outs), cfg.Dir, cfg.Subs)
+
+	fchan, err := Walk(cfg)
+	p.err = err
+	close(p.started)
+	if err != nil {
+		c.finished()
+		return
+	}
+
+	go func() {
+		c.distribute(p, fchan, cfg.Cancel)
+		for _, out := range p.outs {
+			close(out.fchan)
+		}
+		c.finished()
+	}()
+}
+
+// distribute hands out the results of the walk to the callers that want
+// them. Once cancelled, the remaining results are discarded.
+func (c *Coalescer) distribute(p *coalescedWalk, fchan chan protocol.FileInfo, cancel <-chan struct{}) {
+	for f := range fchan {
+		name := filepath.FromSlash(f.Name)
+		for _, out := range p.outs {
+			if !wantsItem(out.subs, name) {
+				continue
+			}
+			select {
+			case out.fchan <- f:
+			case <-cancel:
+				for range fchan {
+				}
+				return
+			}
+		}
+	}
+}
+
+// finished starts the pending walk, if any is due, now that the previous
+// one is done.
+func (c *Coalescer) finished() {
+	c.mut.Lock()
+	c.running = false
+	c.mut.Unlock()
+	c.start()
+}
+
+// mergeSubs returns the subs without duplicates and without those that are
+// within another.
+func mergeSubs(subs []string) []string {
+	var merged []string
+	for i, sub := range subs {
+		sub = filepath.Clean(sub)
+		covered := false
+		for j, other := range subs {
+			other = filepath.Clean(other)
+			// Of two identical subs, the first one is kept.
+			if i != j && inPath(sub, other) && (sub != other || j < i) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			merged = append(merged, sub)
+		}
+	}
+	return merged
+}
+
+// wantsItem returns whether an item is within the subs, or if there are
+// none, anywhere.
+func wantsItem(subs []string, relPath string) bool {
+	if len(subs) == 0 {
+		return true
+	}
+	for _, sub := range subs {
+		if inPath(relPath, filepath.Clean(sub)) {
+			return true
+		}
+	}
+	return false
+}
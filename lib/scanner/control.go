@@ -0,0 +1,193 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import "github.com/syncthing/syncthing/lib/sync"
+
+// A ScanControl pauses and resumes a running walk. While paused, no new
+// items are traversed and no new files are handed to the hashers. Files
+// that are already being hashed are completed.
+type ScanControl struct {
+	mut       sync.Mutex
+	resumed   chan struct{} // non-nil while paused, closed on resume
+	truncated bool
+	lastPath  string
+	scanID    string
+	// memory pauses the walk on its own, while over Config.MemoryLimit.
+	memory *memoryGovernor
+	// checkpoints keeps track of the hashed files for Config.Checkpointer.
+	checkpoints *checkpoints
+	// dedup finds the files with the same contents for Config.ContentDedup.
+	dedup   *contentDedup
+	phase   ScanPhase
+	phaseFn func(ScanPhase)
+}
+
+// ScanPhase is the stage a walk is in.
+type ScanPhase int
+
+const (
+	// PhaseStarting is before the walk has started.
+	PhaseStarting ScanPhase = iota
+	// PhaseEnumerating is while the walk looks for changed items. Unless
+	// there are progress events, files are hashed as they are found.
+	PhaseEnumerating
+	// PhaseHashing is once all changed items have been found, while the
+	// remaining files are hashed.
+	PhaseHashing
+	// PhaseDone is once all files have been hashed.
+	PhaseDone
+)
+
+func (p ScanPhase) String() string {
+	switch p {
+	case PhaseStarting:
+		return "starting"
+	case PhaseEnumerating:
+		return "enumerating"
+	case PhaseHashing:
+		return "hashing"
+	case PhaseDone:
+		return "done"
+	default:
+		return "unknown"
+	}
+}
+
+func newScanControl() *ScanControl {
+	return &ScanControl{
+		mut: sync.NewMutex(),
+	}
+}
+
+// Pause pauses the walk. It is a no-op if the walk is already paused.
+func (c *ScanControl) Pause() {
+	c.mut.Lock()
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+	}
+	c.mut.Unlock()
+}
+
+// Resume resumes a paused walk where it left off. It is a no-op if the
+// walk is not paused.
+func (c *ScanControl) Resume() {
+	c.mut.Lock()
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+	}
+	c.mut.Unlock()
+}
+
+// ScanID returns the Config.ScanID of the walk, or the one generated for
+// it.
+func (c *ScanControl) ScanID() string {
+	return c.scanID
+}
+
+// Phase returns the phase the walk is in.
+func (c *ScanControl) Phase() ScanPhase {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.phase
+}
+
+// setPhase moves the walk on to the given phase, calling the Config.PhaseFn
+// if it's a new one.
+func (c *ScanControl) setPhase(phase ScanPhase) {
+	if c == nil {
+		return
+	}
+	c.mut.Lock()
+	changed := c.phase != phase
+	c.phase = phase
+	c.mut.Unlock()
+	if changed && c.phaseFn != nil {
+		c.phaseFn(phase)
+	}
+}
+
+// Stored tells the walk that the named files it returned have been stored
+// for good, so that they're passed on to Config.Checkpointer. Files that
+// aren't reported as stored are hashed again if the walk is restarted.
+func (c *ScanControl) Stored(names ...string) {
+	c.checkpoints.stored(names)
+}
+
+// Paused returns whether the walk is currently paused.
+func (c *ScanControl) Paused() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.resumed != nil
+}
+
+// Truncated returns whether the walk stopped early because Config.Deadline
+// passed or Config.MaxFilesPerScan was reached. It is final once the
+// output channel of the walk is closed.
+func (c *ScanControl) Truncated() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.truncated
+}
+
+// LastPath returns the last file handed to the hashers, so that a walk
+// stopped by Config.MaxFilesPerScan can be continued after it.
+func (c *ScanControl) LastPath() string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.lastPath
+}
+
+func (c *ScanControl) setLastPath(relPath string) {
+	c.mut.Lock()
+	c.lastPath = relPath
+	c.mut.Unlock()
+}
+
+func (c *ScanControl) setTruncated() {
+	if c == nil {
+		return
+	}
+	c.mut.Lock()
+	c.truncated = true
+	c.mut.Unlock()
+}
+
+// wait blocks for as long as the walk is paused, or over the memory limit.
+// It returns false if the cancel channel was closed while waiting.
+func (c *ScanControl) wait(cancel <-chan struct{}) bool {
+	if c == nil {
+		return true
+	}
+	if !c.memory.wait(cancel) {
+		return false
+	}
+
+	c.mut.Lock()
+	resumed := c.resumed
+	c.mut.Unlock()
+	if resumed == nil {
+		return true
+	}
+
+	select {
+	case <-resumed:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// waitMemory blocks for as long as the walk is over the memory limit. It
+// returns false if the cancel channel was closed while waiting.
+func (c *ScanControl) waitMemory(cancel <-chan struct{}) bool {
+	if c == nil {
+		return true
+	}
+	return c.memory.wait(cancel)
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// defaultContentDedupEntries is the ContentDedupMaxEntries if unset.
+const defaultContentDedupEntries = 10000
+
+// contentDedup remembers the first file hashed with any given contents, for
+// files of up to maxSize bytes and at most maxEntries different contents.
+// A nil *contentDedup does nothing.
+type contentDedup struct {
+	maxSize    int64
+	maxEntries int
+	mut        sync.Mutex
+	first      map[string]dedupEntry
+}
+
+type dedupEntry struct {
+	name   string
+	blocks []protocol.BlockInfo
+}
+
+func newContentDedup(maxSize int64, maxEntries int) *contentDedup {
+	if maxEntries <= 0 {
+		maxEntries = defaultContentDedupEntries
+	}
+	return &contentDedup{
+		maxSize:    maxSize,
+		maxEntries: maxEntries,
+		mut:        sync.NewMutex(),
+		first:      make(map[string]dedupEntry),
+	}
+}
+
+// duplicate returns the name of the first file with the same contents as
+// the given, freshly hashed one, and gives it the block list of that file.
+// Otherwise the file is remembered as the first with its contents, while
+// there is room.
+func (d *contentDedup) duplicate(f *protocol.FileInfo) (string, bool) {
+	if d == nil || f.Size > d.maxSize || len(f.Blocks) == 0 {
+		return "", false
+	}
+	key, ok := contentKey(f.Blocks)
+	if !ok {
+		return "", false
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if e, ok := d.first[key]; ok {
+		f.Blocks = e.blocks
+		return e.name, true
+	}
+	if len(d.first) < d.maxEntries {
+		d.first[key] = dedupEntry{f.Name, f.Blocks}
+	}
+	return "", false
+}
+
+// contentKey returns the block hashes and sizes as a string, or false if
+// there are no strong hashes to go by.
+func contentKey(blocks []protocol.BlockInfo) (string, bool) {
+	key := make([]byte, 0, len(blocks)*(4+len(blocks[0].Hash)))
+	for _, b := range blocks {
+		if len(b.Hash) == 0 {
+			return "", false
+		}
+		key = append(key, byte(b.Size>>24), byte(b.Size>>16), byte(b.Size>>8), byte(b.Size))
+		key = append(key, b.Hash...)
+	}
+	return string(key), true
+}
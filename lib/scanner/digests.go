@@ -0,0 +1,67 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"crypto/md5"
+	"hash"
+	"hash/crc32"
+)
+
+// DigestType is a whole file digest that can be computed in addition to the
+// block hashes, for interoperability with other tools.
+type DigestType int
+
+const (
+	DigestMD5    DigestType = iota // as used by rsync and friends
+	DigestCRC32                    // IEEE polynomial
+	DigestCRC32C                   // Castagnoli polynomial, as used by object stores
+)
+
+func (d DigestType) String() string {
+	switch d {
+	case DigestMD5:
+		return "md5"
+	case DigestCRC32:
+		return "crc32"
+	case DigestCRC32C:
+		return "crc32c"
+	default:
+		return "unknown"
+	}
+}
+
+func (d DigestType) newHash() hash.Hash {
+	switch d {
+	case DigestMD5:
+		return md5.New()
+	case DigestCRC32:
+		return crc32.NewIEEE()
+	case DigestCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	default:
+		panic("bug: unknown digest type")
+	}
+}
+
+// newDigests returns a fresh hash for each of the given digest types.
+func newDigests(types []DigestType) map[DigestType]hash.Hash {
+	digests := make(map[DigestType]hash.Hash, len(types))
+	for _, t := range types {
+		digests[t] = t.newHash()
+	}
+	return digests
+}
+
+// sumDigests returns the final value of each of the digests.
+func sumDigests(digests map[DigestType]hash.Hash) map[DigestType][]byte {
+	sums := make(map[DigestType][]byte, len(digests))
+	for t, h := range digests {
+		sums[t] = h.Sum(nil)
+	}
+	return sums
+}
@@ -0,0 +1,216 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"sort"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/sha256"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// A dirTree collects the contents of the walked directories, so that a
+// hash of each directory can be computed from its children once the walk
+// is complete.
+//
+// The hash of a directory is the SHA-256 of its children, sorted by name,
+// each serialized as:
+//
+//	type     (1 byte, the protocol.FileInfoType)
+//	invalid  (1 byte, 1 if the item is flagged invalid, otherwise 0)
+//	name     (4 byte big endian length, followed by the UTF8 name)
+//	hash     (4 byte big endian length, followed by the hash)
+//
+// where the hash is that of the directory for directories, the SHA-256 of
+// the concatenated block hashes for files, the SHA-256 of the target for
+// symlinks and empty for invalid files.
+type dirTree struct {
+	mut  sync.Mutex
+	dirs map[string]*dirNode
+}
+
+type dirNode struct {
+	// walked is set for directories we've seen in full, as opposed to the
+	// parents of Subs.
+	walked   bool
+	children map[string]dirChild
+}
+
+type dirChild struct {
+	typ     protocol.FileInfoType
+	invalid bool
+	hash    []byte
+}
+
+func newDirTree() *dirTree {
+	return &dirTree{
+		mut:  sync.NewMutex(),
+		dirs: make(map[string]*dirNode),
+	}
+}
+
+// node returns the directory with the given name, creating it if needed.
+// Must be called with the mutex held.
+func (t *dirTree) node(name string) *dirNode {
+	d, ok := t.dirs[name]
+	if !ok {
+		d = &dirNode{children: make(map[string]dirChild)}
+		t.dirs[name] = d
+	}
+	return d
+}
+
+// addRoot marks the folder root as walked, i.e. not limited to some Subs.
+func (t *dirTree) addRoot() {
+	if t == nil {
+		return
+	}
+	t.mut.Lock()
+	t.node(".").walked = true
+	t.mut.Unlock()
+}
+
+func (t *dirTree) addDir(relPath string) {
+	t.add(relPath, dirChild{typ: protocol.FileInfoTypeDirectory})
+}
+
+func (t *dirTree) addSymlink(relPath, target string) {
+	h := sha256.Sum256([]byte(target))
+	t.add(relPath, dirChild{typ: protocol.FileInfoTypeSymlink, hash: h[:]})
+}
+
+// addFile records the file, unless it is in some way incomplete.
+func (t *dirTree) addFile(f protocol.FileInfo) {
+	if t == nil || f.IsDeleted() || f.IsDirectory() || f.IsSymlink() {
+		return
+	}
+	if f.IsInvalid() {
+		t.add(f.Name, dirChild{typ: f.Type, invalid: true})
+		return
+	}
+	h := sha256.New()
+	for _, b := range f.Blocks {
+		h.Write(b.Hash)
+	}
+	t.add(f.Name, dirChild{typ: f.Type, hash: h.Sum(nil)})
+}
+
+func (t *dirTree) add(relPath string, c dirChild) {
+	if t == nil {
+		return
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.node(filepath.Dir(relPath)).children[filepath.Base(relPath)] = c
+	if c.typ == protocol.FileInfoTypeDirectory {
+		t.node(relPath).walked = true
+	}
+}
+
+// report calls fn with the hash of each walked directory, children before
+// their parents.
+func (t *dirTree) report(fn func(relPath string, hash []byte)) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	var names []string
+	for name, d := range t.dirs {
+		if d.walked {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(deepestFirst(names))
+
+	hashes := make(map[string][]byte, len(t.dirs))
+	for _, name := range names {
+		fn(name, t.hash(name, hashes))
+	}
+}
+
+// deepestFirst sorts directory names by depth, deepest first, and then by
+// name. Plain reverse lexical order would put "." before names such as
+// "-a", that sort lower.
+type deepestFirst []string
+
+func (l deepestFirst) Len() int      { return len(l) }
+func (l deepestFirst) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l deepestFirst) Less(i, j int) bool {
+	if di, dj := dirDepth(l[i]), dirDepth(l[j]); di != dj {
+		return di > dj
+	}
+	return l[i] < l[j]
+}
+
+// dirDepth returns how many levels below the root the directory is, zero
+// being the root itself.
+func dirDepth(name string) int {
+	if name == "." {
+		return 0
+	}
+	return pathDepth(name)
+}
+
+// hash returns the hash of the named directory. Must be called with the
+// mutex held.
+func (t *dirTree) hash(name string, memo map[string][]byte) []byte {
+	if h, ok := memo[name]; ok {
+		return h
+	}
+
+	var children []string
+	d := t.node(name)
+	for child := range d.children {
+		children = append(children, child)
+	}
+	sort.Strings(children)
+
+	h := sha256.New()
+	var buf [4]byte
+	for _, child := range children {
+		c := d.children[child]
+		if c.typ == protocol.FileInfoTypeDirectory {
+			c.hash = t.hash(filepath.Join(name, child), memo)
+		}
+		var invalid byte
+		if c.invalid {
+			invalid = 1
+		}
+		h.Write([]byte{byte(c.typ), invalid})
+		binary.BigEndian.PutUint32(buf[:], uint32(len(child)))
+		h.Write(buf[:])
+		h.Write([]byte(child))
+		binary.BigEndian.PutUint32(buf[:], uint32(len(c.hash)))
+		h.Write(buf[:])
+		h.Write(c.hash)
+	}
+
+	memo[name] = h.Sum(nil)
+	return memo[name]
+}
+
+// relay passes the items from in to the returned channel, recording the
+// files along the way. Once in is closed, the directory hashes are reported
+// to fn before the returned channel is closed.
+func (t *dirTree) relay(in <-chan protocol.FileInfo, fn func(relPath string, hash []byte), cancel <-chan struct{}) chan protocol.FileInfo {
+	out := make(chan protocol.FileInfo)
+	go func() {
+		defer close(out)
+		for f := range in {
+			t.addFile(f)
+			select {
+			case out <- f:
+			case <-cancel:
+				return
+			}
+		}
+		t.report(fn)
+	}()
+	return out
+}
@@ -0,0 +1,20 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package scanner
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// isHidden returns whether the item is hidden, that is, its name starts
+// with a dot.
+func isHidden(absPath string) bool {
+	return strings.HasPrefix(filepath.Base(absPath), ".")
+}
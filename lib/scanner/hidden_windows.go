@@ -0,0 +1,25 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package scanner
+
+import "syscall"
+
+// isHidden returns whether the item is hidden, that is, has the hidden
+// attribute set.
+func isHidden(absPath string) bool {
+	p, err := syscall.UTF16PtrFromString(absPath)
+	if err != nil {
+		return false
+	}
+	attrs, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return false
+	}
+	return attrs&syscall.FILE_ATTRIBUTE_HIDDEN != 0
+}
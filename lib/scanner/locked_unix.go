@@ -0,0 +1,15 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package scanner
+
+// isLockedFile returns whether the error is due to the file being locked
+// by another process. Files are never locked that way on this platform.
+func isLockedFile(err error) bool {
+	return false
+}
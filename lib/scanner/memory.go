@@ -0,0 +1,136 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"runtime"
+	stdsync "sync"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+var (
+	// memorySampleInterval is how often the memory usage is checked
+	// against Config.MemoryLimit.
+	memorySampleInterval = 500 * time.Millisecond
+	// Once over the limit, the pressure is relieved only when the usage
+	// falls below this fraction of it, so that we don't flap around the
+	// limit.
+	memoryResumeFraction = 0.9
+)
+
+// A memoryGovernor keeps track of whether the memory usage is over the
+// limit. While it is, the walk is paused and all but one hasher wait. A
+// nil *memoryGovernor never is.
+type memoryGovernor struct {
+	limit    int64
+	usage    func() int64
+	mut      sync.Mutex
+	relieved chan struct{} // non-nil while over the limit, closed when relieved
+	stop     chan struct{}
+	stopOnce stdsync.Once
+}
+
+func newMemoryGovernor(limit int64, usage func() int64) *memoryGovernor {
+	if usage == nil {
+		usage = heapInUse
+	}
+	return &memoryGovernor{
+		limit: limit,
+		usage: usage,
+		mut:   sync.NewMutex(),
+		stop:  make(chan struct{}),
+	}
+}
+
+// start samples the usage once and then keeps doing so in the background,
+// until stopped.
+func (g *memoryGovernor) start() {
+	if g == nil {
+		return
+	}
+	g.sample()
+	go func() {
+		ticker := time.NewTicker(memorySampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				g.sample()
+			case <-g.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops sampling and releases anyone waiting.
+func (g *memoryGovernor) close() {
+	if g == nil {
+		return
+	}
+	g.stopOnce.Do(func() { close(g.stop) })
+
+	g.mut.Lock()
+	if g.relieved != nil {
+		close(g.relieved)
+		g.relieved = nil
+	}
+	g.mut.Unlock()
+}
+
+func (g *memoryGovernor) sample() {
+	usage := g.usage()
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	select {
+	case <-g.stop:
+		return
+	default:
+	}
+
+	switch {
+	case g.relieved == nil && usage >= g.limit:
+		l.Debugf("memory usage %d over limit %d, slowing down", usage, g.limit)
+		g.relieved = make(chan struct{})
+	case g.relieved != nil && float64(usage) < float64(g.limit)*memoryResumeFraction:
+		l.Debugf("memory usage %d back under limit %d, resuming", usage, g.limit)
+		close(g.relieved)
+		g.relieved = nil
+	}
+}
+
+// wait blocks for as long as the usage is over the limit. It returns false
+// if the cancel channel was closed while waiting.
+func (g *memoryGovernor) wait(cancel <-chan struct{}) bool {
+	if g == nil {
+		return true
+	}
+
+	g.mut.Lock()
+	relieved := g.relieved
+	g.mut.Unlock()
+	if relieved == nil {
+		return true
+	}
+
+	select {
+	case <-relieved:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+func heapInUse() int64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapInuse)
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"github.com/rcrowley/go-metrics"
+)
+
+// scanMetrics are the live counters of the walker and hashers in
+// Config.MetricsRegistry. The counters are looked up by name, so all walks
+// sharing a registry add up to the same values. A nil *scanMetrics does
+// nothing.
+type scanMetrics struct {
+	// queued is the number of files waiting for a hasher.
+	queued metrics.Counter
+	// active is the number of hashers currently hashing a file, while
+	// idle is the number waiting for one.
+	active metrics.Counter
+	idle   metrics.Counter
+}
+
+func newScanMetrics(r metrics.Registry) *scanMetrics {
+	if r == nil {
+		return nil
+	}
+	return &scanMetrics{
+		queued: metrics.GetOrRegisterCounter("scanner.queued", r),
+		active: metrics.GetOrRegisterCounter("scanner.hashers.active", r),
+		idle:   metrics.GetOrRegisterCounter("scanner.hashers.idle", r),
+	}
+}
+
+func (m *scanMetrics) fileQueued(delta int64) {
+	if m != nil {
+		m.queued.Inc(delta)
+	}
+}
+
+func (m *scanMetrics) hasherStarted() {
+	if m != nil {
+		m.idle.Inc(1)
+	}
+}
+
+func (m *scanMetrics) hasherStopped() {
+	if m != nil {
+		m.idle.Dec(1)
+	}
+}
+
+// hashing marks a hasher as picking up (true) or finishing (false) a file.
+func (m *scanMetrics) hashing(active bool) {
+	if m == nil {
+		return
+	}
+	if active {
+		m.idle.Dec(1)
+		m.active.Inc(1)
+	} else {
+		m.active.Dec(1)
+		m.idle.Inc(1)
+	}
+}
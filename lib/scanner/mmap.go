@@ -0,0 +1,55 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/syncthing/syncthing/lib/fs"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+var errChangedDuringHashing = errors.New("file changed during hashing")
+
+// faultError is what the runtime panics with on a memory fault, when
+// debug.SetPanicOnFault is in effect.
+type faultError interface {
+	runtime.Error
+	Addr() uintptr
+}
+
+// hashMapped hashes the file from offset to size, reading it through a
+// memory mapping. If the file can't be mapped, mapped is false and the
+// caller should read it as usual instead.
+func hashMapped(fd fs.File, size, offset int64, opts hashOptions) (blocks []protocol.BlockInfo, mapped bool, err error) {
+	data, unmap, err := mapFile(fd, size)
+	if err != nil {
+		l.Debugln("mmap:", err)
+		return nil, false, nil
+	}
+	defer unmap()
+
+	// If the file shrinks while we're at it, reading the mapping past the
+	// new end is a fault rather than an EOF. Make it an error instead of
+	// a crash.
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(faultError); !ok {
+				panic(r)
+			}
+			l.Debugln("mmap fault:", r)
+			blocks, err = nil, errChangedDuringHashing
+		}
+	}()
+
+	blocks, err = hashBlocks(bytes.NewReader(data[offset:]), size-offset, opts)
+	return blocks, true, err
+}
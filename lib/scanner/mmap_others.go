@@ -0,0 +1,21 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package scanner
+
+import (
+	"errors"
+
+	"github.com/syncthing/syncthing/lib/fs"
+)
+
+// mapFile always fails, as memory mapping is not supported on this
+// platform.
+func mapFile(fd fs.File, size int64) ([]byte, func(), error) {
+	return nil, nil, errors.New("memory mapping not supported")
+}
@@ -0,0 +1,35 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package scanner
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/syncthing/syncthing/lib/fs"
+)
+
+// mapFile maps the first size bytes of the file into memory, read only.
+// The returned function removes the mapping.
+func mapFile(fd fs.File, size int64) ([]byte, func(), error) {
+	f, ok := fd.(interface {
+		Fd() uintptr
+	})
+	if !ok {
+		return nil, nil, errors.New("not an OS file")
+	}
+	if size <= 0 || int64(int(size)) != size {
+		return nil, nil, errors.New("unmappable size")
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() { syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,68 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"github.com/golang/groupcache/lru"
+	"github.com/syncthing/syncthing/lib/sync"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normCache remembers names that were found to be normalized already, as
+// almost all of them are, across walks as per NormalizationCacheSize.
+// Whether a name is normalized depends only on the name and the form, so
+// entries stay valid whatever happens on disk; renamed names are dropped
+// nonetheless to not keep them around.
+var normCache = &normalizedNames{
+	mut: sync.NewMutex(),
+}
+
+type normalizedNames struct {
+	mut   sync.Mutex
+	names *lru.Cache
+}
+
+type normalizedKey struct {
+	form norm.Form
+	name string
+}
+
+// has returns whether the name is known to be in the form.
+func (c *normalizedNames) has(form norm.Form, name string) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.names == nil {
+		return false
+	}
+	_, ok := c.names.Get(normalizedKey{form, name})
+	return ok
+}
+
+// add records the name as being in the form, keeping at most size names.
+func (c *normalizedNames) add(form norm.Form, name string, size int) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.names == nil {
+		c.names = lru.New(size)
+	}
+	c.names.MaxEntries = size
+	c.names.Add(normalizedKey{form, name}, nil)
+	for c.names.Len() > size {
+		c.names.RemoveOldest()
+	}
+}
+
+// remove forgets the name, in any form.
+func (c *normalizedNames) remove(name string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.names == nil {
+		return
+	}
+	c.names.Remove(normalizedKey{norm.NFC, name})
+	c.names.Remove(normalizedKey{norm.NFD, name})
+}
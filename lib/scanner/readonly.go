@@ -0,0 +1,51 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"errors"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/fs"
+)
+
+var errReadOnly = errors.New("not allowed in read only mode")
+
+// A readOnlyFilesystem refuses all operations that would change the
+// filesystem, as a backstop for Config.ReadOnly. The files it opens are
+// only ever read by the hashers.
+type readOnlyFilesystem struct {
+	fs.Filesystem
+}
+
+func (readOnlyFilesystem) Chmod(name string, mode fs.FileMode) error {
+	return errReadOnly
+}
+
+func (readOnlyFilesystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return errReadOnly
+}
+
+func (readOnlyFilesystem) Create(name string) (fs.File, error) {
+	return nil, errReadOnly
+}
+
+func (readOnlyFilesystem) CreateSymlink(name, target string) error {
+	return errReadOnly
+}
+
+func (readOnlyFilesystem) Mkdir(name string, perm fs.FileMode) error {
+	return errReadOnly
+}
+
+func (readOnlyFilesystem) Remove(name string) error {
+	return errReadOnly
+}
+
+func (readOnlyFilesystem) Rename(oldname, newname string) error {
+	return errReadOnly
+}
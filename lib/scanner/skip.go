@@ -0,0 +1,70 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scanner
+
+// SkipReason is the reason an item was skipped by the walker, as passed to
+// Config.SkipFn.
+type SkipReason int
+
+const (
+	SkipError           SkipReason = iota // couldn't be looked at, see ErrorFn
+	SkipTemporary                         // a Syncthing temporary file
+	SkipInternal                          // see Config.IsInternal
+	SkipIgnored                           // matched by an ignore pattern
+	SkipSize                              // outside the size band, with FileSizeSkip
+	SkipInvalidUTF8                       // name isn't UTF-8, and wasn't repaired
+	SkipFilenameBOM                       // name starts with a BOM, and wasn't stripped
+	SkipUnnormalized                      // name isn't normalized, and wasn't fixed
+	SkipOtherFilesystem                   // a mount point, with SingleFilesystem
+	SkipUnsupportedType                   // not a file, directory or symlink
+	SkipMarkedDir                         // contains one of Config.SkipDirMarkers
+	SkipHidden                            // hidden, with Config.SkipHidden
+	SkipVanished                          // deleted while the walk was at it
+	SkipAppleMetadata                     // macOS metadata, with Config.SkipAppleMetadata
+)
+
+func (r SkipReason) String() string {
+	switch r {
+	case SkipError:
+		return "error"
+	case SkipTemporary:
+		return "temporary"
+	case SkipInternal:
+		return "internal"
+	case SkipIgnored:
+		return "ignored"
+	case SkipSize:
+		return "size"
+	case SkipInvalidUTF8:
+		return "invalid-utf8"
+	case SkipFilenameBOM:
+		return "filename-bom"
+	case SkipUnnormalized:
+		return "unnormalized"
+	case SkipOtherFilesystem:
+		return "other-filesystem"
+	case SkipUnsupportedType:
+		return "unsupported-type"
+	case SkipMarkedDir:
+		return "marked-dir"
+	case SkipHidden:
+		return "hidden"
+	case SkipVanished:
+		return "vanished"
+	case SkipAppleMetadata:
+		return "apple-metadata"
+	default:
+		return "unknown"
+	}
+}
+
+// skipped passes the skipped item to the SkipFn, if set.
+func (w *walker) skipped(relPath string, reason SkipReason) {
+	if w.SkipFn != nil {
+		w.SkipFn(relPath, reason)
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package scanner
+
+import (
+	"os"
+	"syscall"
+)
+
+// isTransientError returns whether the error may go away when retried, as
+// happens on network mounts.
+func isTransientError(err error) bool {
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
+	switch err {
+	case syscall.EINTR, syscall.EAGAIN, syscall.ETIMEDOUT, syscall.EIO, syscall.ESTALE:
+		return true
+	}
+	return false
+}
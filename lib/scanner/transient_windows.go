@@ -0,0 +1,33 @@
+// Copyright (C) 2017 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package scanner
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	errorUnexpNetErr    syscall.Errno = 59
+	errorNetnameDeleted syscall.Errno = 64
+	errorSemTimeout     syscall.Errno = 121
+)
+
+// isTransientError returns whether the error may go away when retried, as
+// happens on network shares.
+func isTransientError(err error) bool {
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
+	switch err {
+	case errorUnexpNetErr, errorNetnameDeleted, errorSemTimeout:
+		return true
+	}
+	return false
+}
@@ -7,9 +7,15 @@
 package scanner
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	stdsync "sync"
 	"sync/atomic"
 	"time"
 	"unicode/utf8"
@@ -20,11 +26,73 @@ import (
 	"github.com/syncthing/syncthing/lib/ignore"
 	"github.com/syncthing/syncthing/lib/osutil"
 	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/rand"
+	"github.com/syncthing/syncthing/lib/sync"
 	"golang.org/x/text/unicode/norm"
 )
 
 var maskModePerm fs.FileMode
 
+// variable so that we can mock it for testing
+var timeNow = time.Now
+
+var (
+	errDeadline      = errors.New("scan deadline passed")
+	errFileLimit     = errors.New("file limit reached")
+	errFutureModTime = errors.New("modification time is in the future")
+	// errFilteredByContent is reported for files rejected by the
+	// ContentSniffFilter.
+	errFilteredByContent = errors.New("skipped by content filter")
+	// errContentDiffers is reported by AuditOnly walks for files whose
+	// blocks don't match the index.
+	errContentDiffers = errors.New("content differs from index")
+	// errLowSpace is reported for the folder when there's less than
+	// MinFreeSpaceBytes free.
+	errLowSpace = errors.New("insufficient free space, only removing temporary files")
+)
+
+// defaultContentSniffSize is the ContentSniffSize if unset, as much as
+// http.DetectContentType looks at.
+const defaultContentSniffSize = 512
+
+// DefaultWeakHashOverhead is the WeakHashOverhead if unset. Weak hashes add
+// about half to the time it takes to hash a file, going by
+// BenchmarkHashFile and BenchmarkHashFileNoWeakHashes.
+const DefaultWeakHashOverhead = 0.5
+
+// diskFreeBytes returns the free space on the filesystem of the path, for
+// MinFreeSpaceBytes.
+var diskFreeBytes = osutil.DiskFreeBytes
+
+// transientError is isTransientError, unless replaced in tests.
+var transientError = isTransientError
+
+// futureModTimeTolerance is how far in the future a modification time may
+// be before it's considered wrong, to allow for some clock skew.
+var futureModTimeTolerance = time.Minute
+
+// maxSymlinkDepth is the number of symlinks followed when resolving a path
+// or a chain of symlinks, unless MaxSymlinkDepth says otherwise, to guard
+// against loops.
+const maxSymlinkDepth = 255
+
+var (
+	errInvalidUTF8           = errors.New("file name is not valid UTF8")
+	errNormalizationConflict = errors.New("normalized name conflicts with another file")
+	errRepairConflict        = errors.New("repaired name conflicts with another file")
+	errNormalizeNotAllowed   = errors.New("file name is not normalized and may not be renamed")
+	errRepairNotAllowed      = errors.New("file name is not valid UTF8 and may not be renamed")
+	errSymlinkEscapes        = errors.New("symlink target is outside the folder")
+	errBrokenSymlink         = errors.New("symlink target does not exist")
+	errSymlinkDepth          = errors.New("too many levels of symlinks")
+	errSymlinkLoop           = errors.New("symlink points to a directory containing it")
+	errSymlinkChainLoop      = errors.New("symlink chain loops back on itself")
+	errVanished              = errors.New("file vanished during scan")
+	errFilenameBOM           = errors.New("file name starts with a byte order mark")
+	errStripBOMConflict      = errors.New("name without byte order mark conflicts with another file")
+	errStripBOMNotAllowed    = errors.New("file name starts with a byte order mark and may not be renamed")
+)
+
 func init() {
 	if runtime.GOOS == "windows" {
 		// There is no user/group/others in Windows' read-only
@@ -73,28 +141,1152 @@ type Config struct {
 	Cancel chan struct{}
 	// Whether or not we should also compute weak hashes
 	UseWeakHashes bool
+	// If WeakHashFn is not nil, it decides per file whether to compute
+	// weak hashes, instead of UseWeakHashes. Weak hashes are only of use
+	// for files that are likely to be changed in place, and skipping them
+	// saves over a third of the hashing time, as measured by
+	// BenchmarkHashFile and BenchmarkHashFileNoWeakHashes.
+	WeakHashFn func(relPath string, size int64) bool
+	// If IncrementalBlocks is true, files that have grown since the last
+	// scan are assumed to have been appended to. The full blocks of the
+	// previous version, as given by the CurrentFiler, are reused and only
+	// the remainder of the file is hashed.
+	IncrementalBlocks bool
+	// If SuppressWarnings is true, problems with individual files are
+	// only logged at debug level instead of as warnings.
+	SuppressWarnings bool
+	// If HashTimings is not nil, the time taken to read and hash each
+	// block is recorded into it, in nanoseconds. The percentiles of the
+	// histogram can be used to tell uniformly slow storage apart from
+	// storage that occasionally stalls.
+	HashTimings metrics.Histogram
+	// NormalizationForm overrides the Unicode normalization form that file
+	// names are expected to be in. The default is NFD on macOS and NFC
+	// everywhere else.
+	NormalizationForm NormalizationForm
+	// PermissionChangeVersioning controls whether a change of permission
+	// bits alone results in a new version of the file or directory.
+	PermissionChangeVersioning PermissionChangeVersioning
+	// If ScanNewerThan is not zero, files and directories with a
+	// modification time, as per ModTimeFn if set, before it are not
+	// considered changed. Directories are still descended into, as their
+	// contents may be newer.
+	ScanNewerThan time.Time
+	// If ErrorFn is not nil, it is called for problems with individual
+	// items that don't stop the walk as a whole. It may be called
+	// concurrently from several routines.
+	ErrorFn func(ScanError)
+	// If RenameFn is not nil, it is called whenever an item has been
+	// renamed on disk, for example to correct its normalization.
+	RenameFn func(from, to string)
+	// If AllowRenameFn is not nil, it is asked before an item is renamed
+	// on disk to correct its normalization or UTF8 encoding. If it
+	// returns false the item is left alone, reported through ErrorFn and
+	// skipped, as if AutoNormalize or RepairInvalidUTF8 were off.
+	AllowRenameFn func(from, to string) bool
+	// BufferPool, if not nil, provides the read buffers for the hashers,
+	// as values of type *[]byte. Buffers are returned to the pool once a
+	// file has been hashed. By default a pool of BlockSize sized buffers
+	// is shared by the hashers of the walk.
+	BufferPool *stdsync.Pool
+	// If RepairInvalidUTF8 is true, items with names that are not valid
+	// UTF8 are renamed on disk with the invalid bytes replaced by U+FFFD,
+	// instead of being skipped.
+	RepairInvalidUTF8 bool
+	// ExtraDigests lists whole file digests to compute in the same pass as
+	// the block hashes. The results are passed to DigestFn, which is
+	// called from the hashers, concurrently, for each hashed file. Blocks
+	// are never reused by IncrementalBlocks when digests are computed.
+	ExtraDigests []DigestType
+	DigestFn     func(relPath string, digests map[DigestType][]byte)
+	// If TempReapedFn is not nil, it is called for each old temporary file
+	// that has been removed. Failures to remove are passed to ErrorFn.
+	TempReapedFn func(relPath string, size int64, modTime time.Time)
+	// If ScanInternal is true, Syncthing's own internal files and
+	// directories (.stfolder, .stignore, .stversions) are scanned like any
+	// other item. This is dangerous when the result is used to sync the
+	// folder and should only be enabled for special purposes such as
+	// backups. Temporary files and ignore patterns are still respected.
+	ScanInternal bool
+	// MaxOpenFiles limits the number of files the hashers have open at
+	// any given time, regardless of the number of hashers. Hashers wait
+	// for a free slot rather than fail. Zero means no limit.
+	MaxOpenFiles int
+	// If TempLifetimeFn is not nil, it is used instead of TempLifetime to
+	// decide how long to keep each temporary file. A zero or negative
+	// lifetime means the file is never removed.
+	TempLifetimeFn func(relPath string) time.Duration
+	// If PriorContentProvider is not nil, it is asked for the previous
+	// contents of changed files. Blocks that are unchanged from the
+	// previous version, as given by the CurrentFiler, are then reused
+	// wherever they occur in the new file rather than hashed again. This
+	// requires weak hashes on the previous blocks.
+	PriorContentProvider PriorContentProvider
+	// If SubDoneFn is not nil, it is called with each of Subs once the walk
+	// of it has completed, before the next one is started. Files found
+	// in it may still be in the process of being hashed at that point.
+	SubDoneFn func(sub string)
+	// If SingleFilesystem is true, directories on another filesystem than
+	// Dir, such as mount points, are skipped along with their contents.
+	// On Windows this means another volume.
+	SingleFilesystem bool
+	// If Deterministic is true, files are hashed one at a time and all
+	// items are returned in the order they were found, making the output
+	// reproducible. This is intended for tests.
+	Deterministic bool
+	// If MetricsRegistry is not nil, the live state of the walk is kept
+	// in counters in it: "scanner.queued" is the number of files waiting
+	// to be hashed, while "scanner.hashers.active" and
+	// "scanner.hashers.idle" are the number of hashers busy hashing and
+	// waiting for files, respectively.
+	MetricsRegistry metrics.Registry
+	// If EmitPlaceholderOnHashError is true, files that can't be hashed,
+	// for example because they can no longer be opened, are returned
+	// flagged as invalid and without blocks, rather than left out, and the
+	// error is passed to ErrorFn. The file is then known to be present
+	// but unreadable, as opposed to gone.
+	EmitPlaceholderOnHashError bool
+	// If MinFileAge is not zero, changed files that were modified more
+	// recently than that are assumed to still be being written to, and
+	// are left for a later scan. DeferredFn, if not nil, is called for
+	// each such file with the time at which it will be old enough.
+	MinFileAge time.Duration
+	DeferredFn func(relPath string, readyAt time.Time)
+	// If DirHashFn is not nil, it is called with a hash of the contents
+	// of each walked directory, including unchanged ones, once the walk
+	// is complete and before the output channel is closed. The hash
+	// covers the names, types and contents of all items in the directory
+	// and, recursively, its subdirectories, so an unchanged hash means an
+	// unchanged subtree. Subdirectories are reported before their parents
+	// and the folder root, if walked in full, is reported last as ".".
+	// NewWalkFunc doesn't report the root.
+	DirHashFn func(relPath string, hash []byte)
+	// If DetectSparse is true, AllocationFn is called from the hashers for
+	// each hashed file with the amount of disk space allocated to it, and
+	// whether that makes it sparse. The allocated size is zero on
+	// platforms where it is not available.
+	DetectSparse bool
+	AllocationFn func(relPath string, sparse bool, allocated int64)
+	// If SkipEmptyDirs is true, directories are only returned once a file
+	// or symlink that is not ignored has been found somewhere below them.
+	// Empty directories, including those containing only ignored items or
+	// other empty directories, are left out. This relies on the tree being
+	// walked depth first.
+	SkipEmptyDirs bool
+	// Changed files with any of the NoHashExtensions, such as "iso", are
+	// not hashed but returned with their size and modification time only,
+	// flagged as invalid and without blocks. The extensions are case
+	// insensitive and may be given with or without the leading dot.
+	NoHashExtensions []string
+	// If SequentialPerDir is true, the hashers finish all files in one
+	// directory before starting on the next, keeping reads local. This
+	// gives better throughput on spinning disks at the cost of some
+	// parallelism.
+	SequentialPerDir bool
+	// If EmitDeletes is true, a delete is returned for each of Subs that
+	// doesn't exist but is known to CurrentFiler. Only the sub itself is
+	// returned, not any items below it. The same goes for items deleted
+	// between the walk finding them and looking at them. Otherwise, missing
+	// Subs and vanished items are reported through ErrorFn.
+	EmitDeletes bool
+	// If VerifyEmitted is true, the block list of each hashed file is
+	// checked to be contiguous and to add up to the size of the file.
+	// Files that fail the check are reported through ErrorFn and handled
+	// like files that could not be hashed.
+	VerifyEmitted bool
+	// If RetryLockedFiles is above zero, files that can't be hashed
+	// because they are locked by another process, as happens on Windows,
+	// are retried up to that many times. The first retry is after
+	// RetryLockedDelay, or a second if unset, doubling for each
+	// following retry. Files that remain locked are returned as
+	// placeholders, as with EmitPlaceholderOnHashError, and reported
+	// through ErrorFn.
+	RetryLockedFiles int
+	RetryLockedDelay time.Duration
+	// If SlashedNames is true, the returned names and symlink targets use
+	// forward slashes as path separators, as in the protocol, instead of
+	// the native ones. Names passed to the callbacks and CurrentFiler
+	// remain native.
+	SlashedNames bool
+	// If Deadline is not zero, no new items are walked and no new files
+	// are hashed once it has passed, while files already being hashed
+	// are completed. Files that were found but not hashed in time are
+	// reported through ErrorFn, so that they can be rescanned later.
+	// Whether this happened is available from ScanControl.Truncated.
+	Deadline time.Time
+	// If BlockFn is not nil, it is called by the hashers for each block of
+	// a file as soon as it has been hashed, before the file is complete.
+	// It is called concurrently from all hashers and must be safe for
+	// that. Blocks may be reported for a file that then fails to hash, or
+	// is found to have changed while hashing, and is not returned. Blocks
+	// known to be unchanged from the current version of the file are not
+	// reported again.
+	BlockFn func(relPath string, blockIndex int, hash []byte, offset, size int64)
+	// Files smaller than MinFileSize or, if it is not zero, larger than
+	// MaxFileSize are handled as per FileSizePolicy.
+	MinFileSize    int64
+	MaxFileSize    int64
+	FileSizePolicy FileSizePolicy
+	// If EnterDirFn is not nil, it is called when the walk descends into
+	// a directory, to show where the scan is at. It is called at most
+	// once per EnterDirInterval, or four times a second if unset, so not
+	// every directory is reported.
+	EnterDirFn       func(relPath string)
+	EnterDirInterval time.Duration
+	// If MemoryLimit is above zero, the memory usage is checked against
+	// it twice a second. While at or over the limit, no new items are
+	// walked and only one hasher keeps going, until the usage falls under
+	// 90% of the limit. The usage is given by MemoryFn or, if that is
+	// nil, the heap in use as per runtime.MemStats.
+	MemoryLimit int64
+	MemoryFn    func() int64
+	// If TypeChangeFn is not nil, it is called for each changed item that
+	// was of another type, file, directory or symlink, as per
+	// CurrentFiler, before it is returned.
+	TypeChangeFn func(relPath string, from, to protocol.FileInfoType)
+	// If ReadChunkSize is above zero, files are read in chunks of that
+	// size, rather than a block at a time, for better throughput on fast
+	// storage. It must be a multiple of BlockSize. The resulting blocks
+	// are the same either way.
+	ReadChunkSize int
+	// If ScanADS is true, StreamsFn is called for each changed file with
+	// its alternate data streams, on platforms that have them, such as
+	// NTFS on Windows. The contents of the file are not included. It is
+	// called with no streams on other platforms.
+	ScanADS   bool
+	StreamsFn func(relPath string, streams []fs.Stream)
+	// If UseMmap is true, files of at least MmapThreshold bytes are
+	// hashed through a memory mapping rather than by reading them, where
+	// the platform and Filesystem support it. Other files, and files
+	// that can't be mapped, are read as usual. The blocks are the same
+	// either way.
+	UseMmap       bool
+	MmapThreshold int64
+	// If RestrictSymlinkTargets is true, symlinks with relative targets
+	// that point outside of Dir are reported through ErrorFn instead of
+	// being returned. Absolute targets are not checked.
+	RestrictSymlinkTargets bool
+	// Symlinks are returned whether or not their target exists, as the
+	// link itself does. If ReportBrokenSymlinks is true, those whose
+	// target doesn't exist are also reported through ErrorFn, as are
+	// those that can't be read at all and are thus skipped.
+	ReportBrokenSymlinks bool
+	// ScanID identifies the scan in the events and ScanErrors it causes,
+	// so that overlapping scans of the same folder can be told apart. A
+	// random one is used if it's empty, available from
+	// ScanControl.ScanID.
+	ScanID string
+	// If TrustModTime is true, a file whose size and modification time
+	// are as last scanned but whose permissions changed is returned with
+	// the blocks it had then, without reading it again.
+	TrustModTime bool
+	// If ReadOnly is true, nothing on disk is changed: expired temporary
+	// files are left alone, and names that would be normalized or
+	// repaired are skipped with a warning instead, as if AutoNormalize,
+	// RepairInvalidUTF8 and StripFilenameBOM were off.
+	ReadOnly bool
+	// If SkipStrongHashes is true, the blocks carry no SHA-256 hash, only
+	// the weak hash if UseWeakHashes is set. This is for tools that only
+	// need rolling checksums; such block lists can't be used to sync.
+	SkipStrongHashes bool
+	// PriorityPaths are files, or directories of files, to hash before
+	// any others that need hashing, for example because the user is
+	// waiting on them. The others follow in the usual order. Paths that
+	// aren't part of the scan are ignored. Files can only be reordered
+	// once the walk is complete, so this has no effect unless
+	// ProgressTickIntervalS is zero or above, nor in Deterministic mode.
+	PriorityPaths []string
+	// File names starting with a UTF8 byte order mark are reported
+	// through ErrorFn, as they are valid but rarely intended. If
+	// StripFilenameBOM is true, they are instead renamed on disk without
+	// it, unless that name is taken.
+	StripFilenameBOM bool
+	// If HasherFactory is not nil, files are hashed by the Hashers it
+	// returns rather than by the built in hashing. One is created for
+	// each of the Hashers and used for one file at a time. ExtraDigests,
+	// PriorContentProvider and SkipStrongHashes are not used then.
+	HasherFactory func() Hasher
+	// CoalesceWindow is how long a Coalescer waits for more walks to be
+	// requested after the first, before walking them all at once.
+	CoalesceWindow time.Duration
+	// If MatchFn is not nil, it is called for each item that is skipped
+	// because of the Matcher, with the line of the ignore file that the
+	// matching pattern came from.
+	MatchFn func(relPath string, source ignore.PatternSource)
+	// If MaxFilesPerScan is above zero, the walk stops once that many
+	// files have been handed to the hashers, which complete them. The
+	// last of them is available from ScanControl.LastPath, and whether
+	// this happened from ScanControl.Truncated.
+	MaxFilesPerScan int
+	// Files with a modification time in the future are reported through
+	// ErrorFn. If ClampFutureMtimes is true, they are also returned with
+	// the current time instead, and on later walks their modification
+	// time is not compared until it has passed, so that they don't keep
+	// appearing changed. Changes that keep the size are noticed only
+	// then.
+	ClampFutureMtimes bool
+	// If StreamBlocksThreshold is above zero and BlockFn is set, the
+	// blocks of files of at least that size are only passed to BlockFn
+	// as they are hashed, rather than also collected, so that hashing
+	// huge files doesn't take memory in proportion to their size. Such
+	// files are returned without blocks, and without reusing any from
+	// IncrementalBlocks; the caller must put the block list together
+	// from BlockFn.
+	StreamBlocksThreshold int64
+	// If ContentSniffFilter is not nil, the hashers pass it the first
+	// ContentSniffSize bytes of each file to hash, 512 if unset, before
+	// hashing it. Files it returns true for are not returned, and are
+	// reported through ErrorFn instead. This means opening and reading
+	// the start of each file an extra time.
+	ContentSniffFilter func(header []byte, relPath string) bool
+	ContentSniffSize   int
+	// If AuditOnly is true, the walk checks the contents of the files
+	// known to the CurrentFiler instead of looking for changes. Each such
+	// file is hashed and its blocks are compared to the ones in the index,
+	// which must have been hashed with the same BlockSize. Differences are
+	// reported through ErrorFn; nothing is returned. AuditOnly implies
+	// ReadOnly.
+	AuditOnly bool
+	// IsInternal decides which items are internal and thus not scanned,
+	// unless ScanInternal is set. It defaults to ignore.IsInternal, which
+	// covers Syncthing's own files; those using the scanner for other
+	// purposes may want their own rule.
+	IsInternal func(relPath string) bool
+	// If MaxSymlinkDepth is greater than zero, the chain of symlinks a
+	// symlink points to is followed, and symlinks with more links than
+	// that in their chain, including loops, are reported through ErrorFn
+	// instead of being returned. With RestrictSymlinkTargets, so are those
+	// where any link of the chain points outside of Dir, absolute or not.
+	MaxSymlinkDepth int
+	// If SkipFn is not nil, it is called for each item that is left out
+	// of the walk, and why. Items below a skipped directory are not
+	// passed.
+	SkipFn func(relPath string, reason SkipReason)
+	// If SymlinkPolicyFn is not nil, it decides for each symlink whether
+	// it is returned as such, or as the directory or file it points to.
+	// Links that point somewhere else than the policy expects, or that
+	// can't be resolved, are returned as symlinks. Directories that
+	// contain the link itself are not followed, and with
+	// RestrictSymlinkTargets neither are targets outside of Dir; both are
+	// reported through ErrorFn instead.
+	SymlinkPolicyFn func(relPath, target string) SymlinkPolicy
+	// If DeleteGracePeriod is set, EmitDeletes only returns a delete for an
+	// item that was first found missing at least that long ago, to not
+	// delete things that are only gone for a moment. The CurrentFiler
+	// must be a MissingCurrentFiler to remember that between scans;
+	// otherwise the deletes are returned right away.
+	DeleteGracePeriod time.Duration
+	// If DisableEvents is true, nothing is logged to events.Default, for
+	// those not using it and to measure the scanner on its own.
+	DisableEvents bool
+	// If NormalizationCacheSize is greater than zero, up to that many
+	// names found to be normalized already are remembered, also for later
+	// walks, and not checked again. The cache is shared by all walks.
+	NormalizationCacheSize int
+	// Directories containing any of the files named in SkipDirMarkers,
+	// such as ".nobackup" or "CACHEDIR.TAG", are skipped with their
+	// contents and passed to SkipFn. If EmitMarkedDirs is true, the
+	// directories themselves are still returned, empty.
+	SkipDirMarkers []string
+	EmitMarkedDirs bool
+	// If ResolveDirSymlink is true, Dir may be a symlink to a directory,
+	// and that directory is walked instead. Otherwise, such a Dir is not
+	// a directory and the walk fails.
+	ResolveDirSymlink bool
+	// If Checkpointer is not nil, the hashed files are passed to it once
+	// reported through ScanControl.Stored, every CheckpointInterval, 10
+	// seconds if unset, and right away once all are hashed. Files it has
+	// as completed from earlier are skipped if they still have the same
+	// size and modification time.
+	Checkpointer       Checkpointer
+	CheckpointInterval time.Duration
+	// If there is less than MinFreeSpaceBytes of free space on the
+	// filesystem of Dir when the walk starts, that's reported through
+	// ErrorFn and the walk only removes expired temporary files, to free
+	// up space, without returning anything.
+	MinFreeSpaceBytes int64
+	// If PermChangeFn is not nil, it is called for each changed file or
+	// directory whose permissions are the only thing that changed, as per
+	// CurrentFiler, before it is returned.
+	PermChangeFn func(relPath string, from, to uint32)
+	// If SkipHidden is true, hidden items are skipped, with their contents
+	// for directories. Those are items whose name starts with a dot, or on
+	// Windows those with the hidden attribute.
+	SkipHidden bool
+	// If DecompressFilter is not nil, it may return a ReaderWrapper for a
+	// file, such as one that decompresses it, and the blocks are then of
+	// what the wrapper returns, with the size of that. Such files are
+	// marked Decompressed, and passed to DecompressedFn if set. Where the
+	// wrapper fails, the file is hashed as is.
+	DecompressFilter func(relPath string) (ReaderWrapper, bool)
+	DecompressedFn   func(relPath string)
+	// If PhaseFn is not nil, it is called whenever the walk moves on to
+	// the next phase. PhaseDone is reported before the output channel is
+	// closed. The current phase is also available from the ScanControl.
+	PhaseFn func(phase ScanPhase)
+	// If ContentDedup is set, files of up to ContentDedupMaxSize bytes
+	// (the block size if unset) that turn out to have the same contents as
+	// one hashed before share its block list, and DuplicateFn, if not nil,
+	// is called with the name of the first. At most ContentDedupMaxEntries
+	// different contents are remembered (10000 if unset).
+	ContentDedup           bool
+	ContentDedupMaxSize    int64
+	ContentDedupMaxEntries int
+	DuplicateFn            func(relPath, firstPath string)
+	// If LstatRetries is above zero, items that can't be looked up due to
+	// what may be a transient error, as happens on network mounts, are
+	// retried up to that many times. The first retry is after
+	// LstatRetryDelay, or 100 ms if unset, doubling for each following
+	// retry. Items that still can't be looked up are reported through
+	// ErrorFn and skipped.
+	LstatRetries    int
+	LstatRetryDelay time.Duration
+	// If DetectSymlinkLoops is true, symlinks whose chain of links runs
+	// into a loop, such as one pointing at itself, are reported through
+	// ErrorFn. They are returned as usual, unless MaxSymlinkDepth
+	// leaves them out, in which case they are still reported as loops.
+	DetectSymlinkLoops bool
+	// If MaxDepth is greater than zero, the walk doesn't descend below
+	// that many levels from Dir: with one, only the items directly in Dir
+	// are returned. Directories at the limit are returned, but not their
+	// contents.
+	MaxDepth int
+	// ChunkingMode selects how files are cut into blocks. With
+	// ChunkingContentDefined, the boundaries follow from the contents, so
+	// that inserting data into a file changes only the blocks around it.
+	// Blocks are then between a quarter of BlockSize and BlockSize, and
+	// half of it on average. Syncthing itself expects all but the last
+	// block of a file to be BlockSize, so such block lists are for use
+	// outside of the protocol, such as deduplication, and must not be
+	// sent to other devices. Files that are unchanged keep the blocks they
+	// have. IncrementalBlocks, PriorContentProvider and HasherFactory are
+	// not used with it.
+	ChunkingMode ChunkingMode
+	// If UnchangedFn is not nil, it decides instead of the built in rules
+	// whether an item known to CurrentFiler is unchanged and can be left
+	// out, given the current file and what's on disk now. It's called for
+	// files, directories and symlinks alike, whatever the type of the
+	// current file.
+	UnchangedFn func(cur protocol.FileInfo, info fs.FileInfo) bool
+	// WeakHashOverhead is how much longer it takes to hash a byte with
+	// weak hashes than without, as a fraction of the latter. It weighs
+	// the bytes of files hashed with weak hashes when estimating the time
+	// left, passed as "eta" in the progress events. It defaults to
+	// DefaultWeakHashOverhead.
+	WeakHashOverhead float64
+	// If MaxHashCPUPercent is above zero, the hashers pause after each
+	// block for long enough to keep the time they spend hashing, taken
+	// together, at about that percentage of a single CPU. It is shared
+	// between the Hashers, so each of them gets its part of the time,
+	// and has no effect once it exceeds 100 times Hashers. This is
+	// approximate: time spent waiting to read counts as hashing, and the
+	// pauses end at once when the walk is cancelled. It's independent of
+	// GOMAXPROCS and doesn't affect the rest of the process.
+	MaxHashCPUPercent int
+	// If SkipAppleMetadata is true, the files and directories macOS keeps
+	// its metadata in are skipped, such as .DS_Store, .Spotlight-V100 and
+	// the "._" AppleDouble files. This applies on all platforms, as they
+	// end up elsewhere through shared drives and archives.
+	SkipAppleMetadata bool
+	// If ModTimeFn is set, it supplies the modification time of files and
+	// directories, in place of the one from the filesystem, such as when
+	// that isn't kept or is known to be wrong. The returned time is
+	// recorded in the emitted FileInfo, compared to that of the current
+	// file and to ScanNewerThan. MinFileAge still goes by the filesystem.
+	ModTimeFn func(relPath string, info fs.FileInfo) time.Time
+}
+
+// A ScanError describes a problem with a single item encountered during the
+// walk.
+type ScanError struct {
+	// Path is the name of the item, relative to Config.Dir.
+	Path string
+	// PhysicalPath is the location of the item with all symlinks resolved,
+	// when that differs from the location under Config.Dir; for example
+	// when one of the parents of Config.Dir is a symlink.
+	PhysicalPath string
+	// ScanID is the Config.ScanID of the scan that found the problem.
+	ScanID string
+	Err    error
+}
+
+func (e ScanError) Error() string {
+	if e.PhysicalPath != "" {
+		return fmt.Sprintf("%s (%s): %v", e.Path, e.PhysicalPath, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
 }
 
+// NormalizationForm is the Unicode normalization form of file names.
+type NormalizationForm int
+
+const (
+	// NormalizationDefault is NFD on macOS and NFC elsewhere.
+	NormalizationDefault NormalizationForm = iota
+	NormalizationNFC
+	NormalizationNFD
+	// NormalizationNone accepts file names in any form, as long as they
+	// are valid UTF-8.
+	NormalizationNone
+)
+
+// PermissionChangeVersioning is the way permission only changes are
+// versioned.
+type PermissionChangeVersioning int
+
+const (
+	// PermissionChangeUpdateVersion bumps the version for permission only
+	// changes, the same as for any other change.
+	PermissionChangeUpdateVersion PermissionChangeVersioning = iota
+	// PermissionChangeKeepVersion records the new permissions but keeps
+	// the previous version, so that the change does not propagate as a
+	// new version of the item.
+	PermissionChangeKeepVersion
+)
+
+// FileSizePolicy is the way files outside the MinFileSize and MaxFileSize
+// band are handled.
+type FileSizePolicy int
+
+const (
+	// FileSizeMetadataOnly returns the files with their size and
+	// modification time only, the same as for NoHashExtensions.
+	FileSizeMetadataOnly FileSizePolicy = iota
+	// FileSizeSkip leaves the files out, as if they were ignored.
+	FileSizeSkip
+)
+
+// SymlinkPolicy is the way a symlink is handled, see
+// Config.SymlinkPolicyFn.
+type SymlinkPolicy int
+
+const (
+	// SymlinkRecord returns the symlink with its target.
+	SymlinkRecord SymlinkPolicy = iota
+	// SymlinkFollowDir returns a directory pointed to by the link as a
+	// directory of that name, and walks its contents.
+	SymlinkFollowDir
+	// SymlinkDereference returns a file pointed to by the link as a file
+	// of that name, with the target's contents.
+	SymlinkDereference
+)
+
 type CurrentFiler interface {
 	// CurrentFile returns the file as seen at last scan.
 	CurrentFile(name string) (protocol.FileInfo, bool)
 }
 
+// A DirCurrentFiler is a CurrentFiler that can also look up all items in
+// a directory at once. If the CurrentFiler is one, the walker uses that
+// instead of looking up each item in turn.
+type DirCurrentFiler interface {
+	CurrentFiler
+	// CurrentFilesInDir returns the items directly in the given
+	// directory, "." being the root, as seen at last scan, keyed by
+	// their full name.
+	CurrentFilesInDir(dir string) map[string]protocol.FileInfo
+}
+
+// A MissingCurrentFiler is a CurrentFiler that also remembers when items
+// were first found missing, for Config.DeleteGracePeriod.
+type MissingCurrentFiler interface {
+	CurrentFiler
+	// MissingSince returns when the item was first found missing,
+	// recording the given time as that if it isn't already.
+	MissingSince(name string, now time.Time) time.Time
+	// Found forgets that the item was missing. It's called for every
+	// known item the walk finds.
+	Found(name string)
+}
+
+// A PriorContentProvider gives access to the contents of the previous
+// version of a file. An error, such as os.ErrNotExist, means the previous
+// contents are not available and the file is hashed in full. If the returned
+// reader is also an io.Closer, it is closed once hashing is complete.
+type PriorContentProvider interface {
+	PriorContent(relPath string) (io.ReaderAt, error)
+}
+
 func Walk(cfg Config) (chan protocol.FileInfo, error) {
-	w := walker{cfg}
+	fchan, _, err := WalkWithControl(cfg)
+	return fchan, err
+}
+
+// WalkWithControl is like Walk, but also returns a ScanControl that can be
+// used to pause and resume the walk.
+func WalkWithControl(cfg Config) (chan protocol.FileInfo, *ScanControl, error) {
+	w := newWalker(cfg)
+	fchan, err := w.results()
+	if err != nil {
+		return nil, nil, err
+	}
+	return fchan, w.control, nil
+}
+
+// results starts the walk and returns the items as Walk does.
+func (w *walker) results() (chan protocol.FileInfo, error) {
+	fchan, err := w.walk()
+	if err != nil {
+		return nil, err
+	}
+	if w.dirTree != nil {
+		if len(w.Subs) == 0 {
+			w.dirTree.addRoot()
+		}
+		fchan = w.dirTree.relay(fchan, w.DirHashFn, w.Cancel)
+	}
+	if w.SlashedNames {
+		fchan = slashNames(fchan, w.Cancel)
+	}
+	return fchan, nil
+}
+
+// NewWalkFunc is like Walk, but leaves enumerating the tree to the caller.
+// The returned walkFn handles a single item the same way Walk does and may
+// be used with filepath.Walk on cfg.Dir, or any other walker that passes
+// paths under cfg.Dir. It may be called concurrently. Once the caller is
+// done walking it must call finish, after which fchan is closed when all
+// files have been hashed. Subs and the progress events are not used. As
+// the walker can't tell whether the caller walks all of cfg.Dir, DirHashFn
+// is not called for the root, unlike with Walk.
+func NewWalkFunc(cfg Config) (walkFn filepath.WalkFunc, fchan chan protocol.FileInfo, finish func(), err error) {
+	w := newWalker(cfg)
+	if err := w.prepare(); err != nil {
+		return nil, nil, nil, err
+	}
+	w.control.memory.start()
+
+	toHashChan := make(chan protocol.FileInfo)
+	finishedChan := make(chan protocol.FileInfo)
+	dirChan := finishedChan
+	if w.Deterministic {
+		dirChan = toHashChan
+	}
+
+	w.setSmallFileHasher(newParallelHasher(w.Config, finishedChan, toHashChan, nil, nil, w.control))
+	w.control.setPhase(PhaseEnumerating)
+
+	hashFiles := w.walkAndHashFiles(toHashChan, dirChan)
+	walkFn = func(path string, info os.FileInfo, err error) error {
+		var fsInfo fs.FileInfo
+		if info != nil {
+			fsInfo = osFileInfo{info}
+		}
+		if w.Dir != cfg.Dir {
+			// The caller walks the symlink Dir, the walker its target.
+			if rel, rerr := filepath.Rel(cfg.Dir, path); rerr == nil {
+				path = filepath.Join(w.Dir, rel)
+			}
+		}
+		return hashFiles(path, fsInfo, err)
+	}
+
+	fchan = finishedChan
+	if w.dirTree != nil {
+		fchan = w.dirTree.relay(finishedChan, w.DirHashFn, w.Cancel)
+	}
+	if w.SlashedNames {
+		fchan = slashNames(fchan, w.Cancel)
+	}
+
+	var once stdsync.Once
+	finish = func() {
+		once.Do(func() {
+			w.control.setPhase(PhaseHashing)
+			close(toHashChan)
+		})
+	}
+
+	return walkFn, fchan, finish, nil
+}
+
+// slashNames passes on the files from in, with forward slashes as path
+// separators in their names and symlink targets.
+func slashNames(in <-chan protocol.FileInfo, cancel <-chan struct{}) chan protocol.FileInfo {
+	out := make(chan protocol.FileInfo)
+	go func() {
+		defer close(out)
+		for f := range in {
+			f.Name = filepath.ToSlash(f.Name)
+			if f.IsSymlink() {
+				f.SymlinkTarget = filepath.ToSlash(f.SymlinkTarget)
+			}
+			select {
+			case out <- f:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// A ScanPlan is the estimated amount of work for a scan.
+type ScanPlan struct {
+	// Files is the number of files that would be hashed.
+	Files int
+	// Bytes is the amount of data that would be read to hash them.
+	Bytes int64
+}
+
+// EstimateScan walks the folder as Walk would, deciding which files have
+// changed, but without hashing anything. Nothing on disk is changed:
+// temporary files are left alone and file names are not normalized or
+// repaired. Only the options that decide what is walked and what has
+// changed are used; none of the callbacks reporting on the walk are
+// called, and the CurrentFiler is only used to look up files.
+func EstimateScan(cfg Config) (ScanPlan, error) {
+	w := newWalker(estimateConfig(cfg))
+	if err := w.prepare(); err != nil {
+		return ScanPlan{}, err
+	}
+
+	// Files and directories alike end up on the same channel, but only
+	// the files are of interest.
+	items := make(chan protocol.FileInfo)
+	go func() {
+		w.walkTree(w.walkAndHashFiles(items, items), items)
+		close(items)
+	}()
+
+	var plan ScanPlan
+	for f := range items {
+		if f.IsDirectory() || f.IsSymlink() || f.IsDeleted() {
+			continue
+		}
+		plan.Files++
+		plan.Bytes += cfg.bytesToHash(f)
+	}
+	return plan, nil
+}
+
+// estimateConfig returns the options of cfg that EstimateScan uses. It's a
+// list of what's kept rather than of what's dropped, so that new options
+// don't have side effects on estimates by default.
+func estimateConfig(cfg Config) Config {
+	est := Config{
+		Folder:                 cfg.Folder,
+		Dir:                    cfg.Dir,
+		Subs:                   cfg.Subs,
+		BlockSize:              cfg.BlockSize,
+		Matcher:                cfg.Matcher,
+		Filesystem:             cfg.Filesystem,
+		IgnorePerms:            cfg.IgnorePerms,
+		Cancel:                 cfg.Cancel,
+		IncrementalBlocks:      cfg.IncrementalBlocks,
+		NormalizationForm:      cfg.NormalizationForm,
+		ScanNewerThan:          cfg.ScanNewerThan,
+		ScanInternal:           cfg.ScanInternal,
+		SingleFilesystem:       cfg.SingleFilesystem,
+		MinFileAge:             cfg.MinFileAge,
+		SkipEmptyDirs:          cfg.SkipEmptyDirs,
+		NoHashExtensions:       cfg.NoHashExtensions,
+		SlashedNames:           cfg.SlashedNames,
+		MinFileSize:            cfg.MinFileSize,
+		MaxFileSize:            cfg.MaxFileSize,
+		FileSizePolicy:         cfg.FileSizePolicy,
+		RestrictSymlinkTargets: cfg.RestrictSymlinkTargets,
+		TrustModTime:           cfg.TrustModTime,
+		ClampFutureMtimes:      cfg.ClampFutureMtimes,
+		ContentSniffFilter:     cfg.ContentSniffFilter,
+		ContentSniffSize:       cfg.ContentSniffSize,
+		IsInternal:             cfg.IsInternal,
+		MaxSymlinkDepth:        cfg.MaxSymlinkDepth,
+		SymlinkPolicyFn:        cfg.SymlinkPolicyFn,
+		NormalizationCacheSize: cfg.NormalizationCacheSize,
+		SkipDirMarkers:         cfg.SkipDirMarkers,
+		EmitMarkedDirs:         cfg.EmitMarkedDirs,
+		ResolveDirSymlink:      cfg.ResolveDirSymlink,
+		SkipHidden:             cfg.SkipHidden,
+		LstatRetries:           cfg.LstatRetries,
+		LstatRetryDelay:        cfg.LstatRetryDelay,
+		MaxDepth:               cfg.MaxDepth,
+		ChunkingMode:           cfg.ChunkingMode,
+		UnchangedFn:            cfg.UnchangedFn,
+		SkipAppleMetadata:      cfg.SkipAppleMetadata,
+		ModTimeFn:              cfg.ModTimeFn,
+
+		ReadOnly:         true,
+		SuppressWarnings: true,
+		DisableEvents:    true,
+	}
+	switch cf := cfg.CurrentFiler.(type) {
+	case nil:
+	case DirCurrentFiler:
+		est.CurrentFiler = lookupDirCurrentFiler{cf}
+	default:
+		est.CurrentFiler = lookupCurrentFiler{cf}
+	}
+	return est
+}
+
+// lookupCurrentFiler and lookupDirCurrentFiler hide any interfaces of a
+// CurrentFiler other than those for looking up files, such as that of a
+// MissingCurrentFiler.
+type lookupCurrentFiler struct {
+	cf CurrentFiler
+}
+
+func (c lookupCurrentFiler) CurrentFile(name string) (protocol.FileInfo, bool) {
+	return c.cf.CurrentFile(name)
+}
+
+type lookupDirCurrentFiler struct {
+	cf DirCurrentFiler
+}
+
+func (c lookupDirCurrentFiler) CurrentFile(name string) (protocol.FileInfo, bool) {
+	return c.cf.CurrentFile(name)
+}
+
+func (c lookupDirCurrentFiler) CurrentFilesInDir(dir string) map[string]protocol.FileInfo {
+	return c.cf.CurrentFilesInDir(dir)
+}
+
+// ScanFile hashes the single file at path, which must be a regular file,
+// and returns its FileInfo. The name of the returned file is the last
+// element of path. Of cfg, Dir, Subs, Matcher and CurrentFiler are not
+// used and the file is always hashed.
+func ScanFile(path string, cfg Config) (protocol.FileInfo, error) {
+	cfg.Dir = filepath.Dir(path)
+	cfg.Subs = nil
+	cfg.Matcher = nil
+	cfg.CurrentFiler = nil
+	cfg.Hashers = 1
+	cfg.MinFileAge = 0
+	cfg.MetricsRegistry = nil
+	cfg.DirHashFn = nil
+	cfg.SkipEmptyDirs = false
+	cfg.SequentialPerDir = false
+
+	// Hash errors are returned, rather than the file being left out.
+	var hashErr error
+	cfg.EmitPlaceholderOnHashError = true
+	cfg.ErrorFn = func(e ScanError) {
+		hashErr = e.Err
+	}
+
+	w := newWalker(cfg)
+	if err := w.checkReadChunkSize(); err != nil {
+		return protocol.FileInfo{}, err
+	}
+	relPath := filepath.Base(path)
+	info, err := w.Filesystem.Lstat(path)
+	if err != nil {
+		return protocol.FileInfo{}, err
+	}
+	if !info.IsRegular() {
+		return protocol.FileInfo{}, errors.New(path + ": not a regular file")
+	}
+
+	toHashChan := make(chan protocol.FileInfo, 1)
+	finishedChan := make(chan protocol.FileInfo, 1)
+	if err := w.walkRegular(relPath, info, toHashChan); err != nil {
+		return protocol.FileInfo{}, err
+	}
+	close(toHashChan)
+	newParallelHasher(w.Config, finishedChan, toHashChan, nil, nil, w.control)
+
+	f, ok := <-finishedChan
+	if hashErr != nil {
+		return protocol.FileInfo{}, hashErr
+	}
+	if !ok {
+		return protocol.FileInfo{}, errors.New("cancelled")
+	}
+	return f, nil
+}
+
+// A BlockRef is a block found by ScanBlockHashes, and where it was first
+// seen.
+type BlockRef struct {
+	Hash   []byte
+	Size   int32
+	Path   string
+	Offset int64
+}
+
+// ScanBlockHashes walks the folder as Walk would, but returns only the
+// blocks of the files, each distinct hash once, rather than the files.
+// All files are hashed whatever the CurrentFiler says, and no block lists
+// are kept. The BlockFn, if set, is still called for every block. The
+// returned channel must be read until it is closed.
+func ScanBlockHashes(cfg Config) (<-chan BlockRef, error) {
+	refs := make(chan BlockRef)
+	seen := make(map[string]struct{})
+	seenMut := sync.NewMutex()
+
+	blockFn := cfg.BlockFn
+	cfg.BlockFn = func(relPath string, blockIndex int, hash []byte, offset, size int64) {
+		if blockFn != nil {
+			blockFn(relPath, blockIndex, hash, offset, size)
+		}
+		seenMut.Lock()
+		_, ok := seen[string(hash)]
+		seen[string(hash)] = struct{}{}
+		seenMut.Unlock()
+		if ok {
+			return
+		}
+		select {
+		case refs <- BlockRef{Hash: hash, Size: int32(size), Path: relPath, Offset: offset}:
+		case <-cfg.Cancel:
+		}
+	}
+	cfg.StreamBlocksThreshold = 1
+	cfg.CurrentFiler = nil
+	cfg.AuditOnly = false
+	cfg.SkipStrongHashes = false
+	cfg.DirHashFn = nil
+
+	fchan, err := Walk(cfg)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for range fchan {
+		}
+		close(refs)
+	}()
+	return refs, nil
+}
+
+// WalkSerialized is like Walk, but returns the files marshalled as they
+// would be on the wire, with slashed names regardless of SlashedNames.
+// Files that fail to marshal are reported through ErrorFn and left out.
+// The returned channel must be read until it is closed.
+func WalkSerialized(cfg Config) (<-chan []byte, error) {
+	cfg.SlashedNames = true
+	w := newWalker(cfg)
+	fchan, err := w.results()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for f := range fchan {
+			bs, err := f.Marshal()
+			if err != nil {
+				l.Debugln("marshal error:", f.Name, err)
+				w.reportError(filepath.FromSlash(f.Name), err)
+				continue
+			}
+			select {
+			case out <- bs:
+			case <-w.Cancel:
+				// Drain, so that the walk can finish.
+				for range fchan {
+				}
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// ChangeKind is how a file changed, as per FileChange.
+type ChangeKind int
+
+const (
+	// ChangeCreated is a file not known before, or known as deleted.
+	ChangeCreated ChangeKind = iota
+	// ChangeModified is a file whose contents, type or modification
+	// time changed.
+	ChangeModified
+	// ChangeDeleted is a file that no longer exists.
+	ChangeDeleted
+	// ChangePermissions is a file of which only the permissions changed.
+	ChangePermissions
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeCreated:
+		return "created"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	case ChangePermissions:
+		return "permissions"
+	default:
+		return "unknown"
+	}
+}
+
+// A FileChange is a file returned by WalkChanges, along with the current
+// file it differs from, if any.
+type FileChange struct {
+	Old  *protocol.FileInfo
+	New  protocol.FileInfo
+	Kind ChangeKind
+}
+
+// WalkChanges is like Walk, but returns each file along with the current
+// file from the CurrentFiler and how it changed. Use EmitDeletes to get
+// the deleted files as well. The returned channel must be read until it is
+// closed.
+func WalkChanges(cfg Config) (<-chan FileChange, error) {
+	fchan, err := Walk(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cf := cfg.CurrentFiler
+	if cf == nil {
+		cf = noCurrentFiler{}
+	}
+
+	changes := make(chan FileChange)
+	go func() {
+		defer close(changes)
+		for f := range fchan {
+			name := f.Name
+			if cfg.SlashedNames {
+				name = filepath.FromSlash(name)
+			}
+			c := FileChange{New: f}
+			if old, ok := cf.CurrentFile(name); ok {
+				c.Old = &old
+			}
+			c.Kind = changeKind(c.Old, f)
+			select {
+			case changes <- c:
+			case <-cfg.Cancel:
+				// Drain, so that the walk can finish.
+				for range fchan {
+				}
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// changeKind returns how the file changed from old, which is nil if it
+// wasn't known.
+func changeKind(old *protocol.FileInfo, f protocol.FileInfo) ChangeKind {
+	switch {
+	case f.IsDeleted():
+		return ChangeDeleted
+	case old == nil || old.IsDeleted():
+		return ChangeCreated
+	}
+	sameContents := old.Type == f.Type && old.Size == f.Size && old.ModTime().Equal(f.ModTime()) &&
+		old.SymlinkTarget == f.SymlinkTarget && old.IsInvalid() == f.IsInvalid() &&
+		(f.IsDirectory() || f.IsSymlink() || BlocksEqual(old.Blocks, f.Blocks))
+	if sameContents && old.Permissions != f.Permissions {
+		return ChangePermissions
+	}
+	return ChangeModified
+}
+
+func newWalker(cfg Config) *walker {
+	w := &walker{
+		Config:  cfg,
+		control: newScanControl(),
+		metrics: newScanMetrics(cfg.MetricsRegistry),
+	}
 
 	if w.CurrentFiler == nil {
 		w.CurrentFiler = noCurrentFiler{}
 	}
+	if w.ScanID == "" {
+		w.ScanID = rand.String(8)
+	}
+	w.control.scanID = w.ScanID
+	w.control.phaseFn = w.PhaseFn
 	if w.Filesystem == nil {
 		w.Filesystem = fs.DefaultFilesystem
 	}
+	if w.IsInternal == nil {
+		w.IsInternal = ignore.IsInternal
+	}
+	if w.AuditOnly {
+		// Every file is read in full and nothing is returned, so none
+		// of the shortcuts apply.
+		w.ReadOnly = true
+		w.TrustModTime = false
+		w.IncrementalBlocks = false
+		w.PriorContentProvider = nil
+		w.StreamBlocksThreshold = 0
+		w.SkipStrongHashes = false
+		w.EmitDeletes = false
+	}
+	if w.ChunkingMode == ChunkingContentDefined {
+		// These all assume blocks at multiples of BlockSize.
+		w.IncrementalBlocks = false
+		w.PriorContentProvider = nil
+		w.HasherFactory = nil
+	}
+	if w.ReadOnly {
+		w.AutoNormalize = false
+		w.RepairInvalidUTF8 = false
+		w.StripFilenameBOM = false
+		w.TempLifetimeFn = func(string) time.Duration { return 0 }
+		w.Filesystem = readOnlyFilesystem{w.Filesystem}
+	}
+	if w.Deterministic {
+		// Everything goes through a single hasher, so that the output
+		// is in the order the items were found.
+		w.Hashers = 1
+	}
+	if w.DirHashFn != nil {
+		w.dirTree = newDirTree()
+	}
+	if w.SkipEmptyDirs {
+		w.pendingDirs = newPendingDirs()
+	}
+	if w.EnterDirFn != nil {
+		w.enterDirLimit = newRateLimit(w.EnterDirInterval)
+	}
+	if w.MemoryLimit > 0 {
+		w.control.memory = newMemoryGovernor(w.MemoryLimit, w.MemoryFn)
+	}
+	if w.Checkpointer != nil {
+		w.control.checkpoints = newCheckpoints(w.Checkpointer, w.CheckpointInterval)
+	}
+	if w.ContentDedup {
+		if w.ContentDedupMaxSize <= 0 {
+			w.ContentDedupMaxSize = int64(w.BlockSize)
+		}
+		w.control.dedup = newContentDedup(w.ContentDedupMaxSize, w.ContentDedupMaxEntries)
+	}
+	if dcf, ok := w.CurrentFiler.(DirCurrentFiler); ok {
+		w.dirFiles = newDirFilesCache(dcf)
+	}
 
-	return w.walk()
+	return w
 }
 
 type walker struct {
+	// dirsScanned is the number of directories walked so far, for the
+	// progress events. Accessed atomically and first in the struct for
+	// alignment.
+	dirsScanned int64
+	// filesQueued is the number of files handed to the hashers, for
+	// MaxFilesPerScan. Accessed atomically.
+	filesQueued int64
 	Config
+	control *ScanControl
+	// rootDevice is the device ID of Dir, used for SingleFilesystem.
+	rootDevice uint64
+	metrics    *scanMetrics
+	// smallFiles, if set, hashes files that fit in a single block inline.
+	smallFiles *parallelHasher
+	// dirTree collects the directory contents for DirHashFn, if set.
+	dirTree *dirTree
+	// pendingDirs holds the directories not yet known to be non empty,
+	// for SkipEmptyDirs.
+	pendingDirs *pendingDirs
+	// enterDirLimit limits the calls to EnterDirFn.
+	enterDirLimit *rateLimit
+	// dirFiles holds the current files of the directories being walked,
+	// if the CurrentFiler is a DirCurrentFiler.
+	dirFiles *dirFilesCache
+	// lowSpace is set if there's less than MinFreeSpaceBytes free.
+	lowSpace bool
 }
 
 // Walk returns the list of files found in the local folder by scanning the
@@ -102,31 +1294,40 @@ type walker struct {
 func (w *walker) walk() (chan protocol.FileInfo, error) {
 	l.Debugln("Walk", w.Dir, w.Subs, w.BlockSize, w.Matcher)
 
-	if err := w.checkDir(); err != nil {
+	if err := w.prepare(); err != nil {
 		return nil, err
 	}
+	w.control.memory.start()
 
 	toHashChan := make(chan protocol.FileInfo)
 	finishedChan := make(chan protocol.FileInfo)
 
+	// In deterministic mode directories and symlinks also pass through
+	// the hasher, to keep the order.
+	dirChan := finishedChan
+	if w.Deterministic {
+		dirChan = toHashChan
+	}
+
+	// We're not required to emit scan progress events, just kick off hashers,
+	// and feed inputs directly from the walker.
+	direct := w.ProgressTickIntervalS < 0
+	if direct {
+		w.setSmallFileHasher(newParallelHasher(w.Config, finishedChan, toHashChan, nil, nil, w.control))
+	}
+
 	// A routine which walks the filesystem tree, and sends files which have
 	// been modified to the counter routine.
+	w.control.setPhase(PhaseEnumerating)
 	go func() {
-		hashFiles := w.walkAndHashFiles(toHashChan, finishedChan)
-		if len(w.Subs) == 0 {
-			w.Filesystem.Walk(w.Dir, hashFiles)
-		} else {
-			for _, sub := range w.Subs {
-				w.Filesystem.Walk(filepath.Join(w.Dir, sub), hashFiles)
-			}
+		w.walkTree(w.walkAndHashFiles(toHashChan, dirChan), dirChan)
+		if direct {
+			w.control.setPhase(PhaseHashing)
 		}
 		close(toHashChan)
 	}()
 
-	// We're not required to emit scan progress events, just kick off hashers,
-	// and feed inputs directly from the walker.
-	if w.ProgressTickIntervalS < 0 {
-		newParallelHasher(w.Filesystem, w.Dir, w.BlockSize, w.Hashers, finishedChan, toHashChan, nil, nil, w.Cancel, w.UseWeakHashes)
+	if direct {
 		return finishedChan, nil
 	}
 
@@ -147,22 +1348,43 @@ func (w *walker) walk() (chan protocol.FileInfo, error) {
 	go func() {
 		var filesToHash []protocol.FileInfo
 		var total int64 = 1
+		var totalWork float64
+
+	collect:
+		for {
+			select {
+			case file, ok := <-toHashChan:
+				if !ok {
+					break collect
+				}
+				filesToHash = append(filesToHash, file)
+				bytes := w.bytesToHash(file)
+				total += bytes
+				totalWork += float64(bytes) * w.hashCost(w.useWeakHashes(file.Name, file.Size))
+			case <-ticker.C:
+				// Nothing is hashed while still walking, but the
+				// directories walked so far are worth a mention.
+				w.progressEvent(0, total, 0, -1)
+			}
+		}
 
-		for file := range toHashChan {
-			filesToHash = append(filesToHash, file)
-			total += file.Size
+		if len(w.PriorityPaths) > 0 && !w.Deterministic {
+			filesToHash = w.prioritize(filesToHash)
 		}
+		w.control.setPhase(PhaseHashing)
 
 		realToHashChan := make(chan protocol.FileInfo)
 		done := make(chan struct{})
 		progress := newByteCounter()
+		work := newByteCounter()
 
-		newParallelHasher(w.Filesystem, w.Dir, w.BlockSize, w.Hashers, finishedChan, realToHashChan, progress, done, w.Cancel, w.UseWeakHashes)
+		newParallelHasher(w.Config, finishedChan, realToHashChan, workCounter{progress, work, 1}, done, w.control)
 
 		// A routine which actually emits the FolderScanProgress events
 		// every w.ProgressTicker ticks, until the hasher routines terminate.
 		go func() {
 			defer progress.Close()
+			defer work.Close()
 
 			for {
 				select {
@@ -173,13 +1395,12 @@ func (w *walker) walk() (chan protocol.FileInfo, error) {
 				case <-ticker.C:
 					current := progress.Total()
 					rate := progress.Rate()
+					eta := -1.0
+					if workRate := work.Rate(); workRate > 0 {
+						eta = (totalWork - float64(work.Total())) / workRate
+					}
 					l.Debugf("Walk %s %s current progress %d/%d at %.01f MiB/s (%d%%)", w.Dir, w.Subs, current, total, rate/1024/1024, current*100/total)
-					events.Default.Log(events.FolderScanProgress, map[string]interface{}{
-						"folder":  w.Folder,
-						"current": current,
-						"total":   total,
-						"rate":    rate, // bytes per second
-					})
+					w.progressEvent(current, total, rate, eta)
 				case <-w.Cancel:
 					ticker.Stop()
 					return
@@ -188,7 +1409,18 @@ func (w *walker) walk() (chan protocol.FileInfo, error) {
 		}()
 
 	loop:
-		for _, file := range filesToHash {
+		for i, file := range filesToHash {
+			if !w.control.wait(w.Cancel) {
+				break loop
+			}
+			if w.pastDeadline() {
+				l.Debugln("deadline passed, dropping", len(filesToHash)-i, "files")
+				w.control.setTruncated()
+				for _, f := range filesToHash[i:] {
+					w.reportError(f.Name, errDeadline)
+				}
+				break loop
+			}
 			l.Debugln("real to hash:", file.Name)
 			select {
 			case realToHashChan <- file:
@@ -202,70 +1434,353 @@ func (w *walker) walk() (chan protocol.FileInfo, error) {
 	return finishedChan, nil
 }
 
-func (w *walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) fs.WalkFunc {
-	now := time.Now()
-	return func(absPath string, info fs.FileInfo, err error) error {
-		// Return value used when we are returning early and don't want to
-		// process the item. For directories, this means do-not-descend.
-		var skip error // nil
-		// info nil when error is not nil
-		if info != nil && info.IsDir() {
-			skip = fs.SkipDir
+// prioritize returns the files with those under the PriorityPaths moved to
+// the front, keeping the order otherwise.
+func (w *walker) prioritize(files []protocol.FileInfo) []protocol.FileInfo {
+	sorted := make([]protocol.FileInfo, 0, len(files))
+	var rest []protocol.FileInfo
+	for _, f := range files {
+		if w.isPriority(f.Name) {
+			sorted = append(sorted, f)
+		} else {
+			rest = append(rest, f)
 		}
+	}
+	l.Debugln("hashing", len(sorted), "priority files first")
+	return append(sorted, rest...)
+}
 
-		if err != nil {
-			l.Debugln("error:", absPath, info, err)
-			return skip
+// isPriority returns whether the item is one of the PriorityPaths, or in
+// one of them.
+func (w *walker) isPriority(relPath string) bool {
+	for _, p := range w.PriorityPaths {
+		if inPath(relPath, filepath.Clean(p)) {
+			return true
 		}
+	}
+	return false
+}
 
-		relPath, err := filepath.Rel(w.Dir, absPath)
-		if err != nil {
-			l.Debugln("rel error:", absPath, err)
-			return skip
-		}
+// inPath returns whether relPath is dir or within it.
+func inPath(relPath, dir string) bool {
+	return relPath == dir || strings.HasPrefix(relPath, dir+string(filepath.Separator))
+}
 
-		if relPath == "." {
-			return nil
-		}
+// progressEvent emits a FolderScanProgress event.
+func (w *walker) progressEvent(current, total int64, rate, eta float64) {
+	if w.DisableEvents {
+		return
+	}
+	data := map[string]interface{}{
+		"folder":      w.Folder,
+		"scanID":      w.ScanID,
+		"current":     current,
+		"total":       total,
+		"rate":        rate, // bytes per second
+		"dirsScanned": atomic.LoadInt64(&w.dirsScanned),
+	}
+	if eta >= 0 {
+		data["eta"] = eta // seconds
+	}
+	events.Default.Log(events.FolderScanProgress, data)
+}
 
-		info, err = w.Filesystem.Lstat(absPath)
-		// An error here would be weird as we've already gotten to this point, but act on it nonetheless
-		if err != nil {
-			return skip
+// walkTree walks Dir, or each of Subs in turn. Subs that don't exist are
+// handled by missingSub, using dchan.
+func (w *walker) walkTree(walkFn fs.WalkFunc, dchan chan protocol.FileInfo) {
+	if len(w.Subs) == 0 {
+		w.Filesystem.Walk(w.Dir, walkFn)
+		return
+	}
+	for _, sub := range w.Subs {
+		if w.pastDeadline() || w.fileLimitReached() {
+			w.control.setTruncated()
+			return
 		}
-
-		if ignore.IsTemporary(relPath) {
-			l.Debugln("temporary:", relPath)
-			if info.IsRegular() && info.ModTime().Add(w.TempLifetime).Before(now) {
-				w.Filesystem.Remove(absPath)
-				l.Debugln("removing temporary:", relPath, info.ModTime())
+		absPath := filepath.Join(w.Dir, sub)
+		if _, err := w.Filesystem.Lstat(absPath); fs.IsNotExist(err) {
+			if err := w.missingSub(filepath.Clean(sub), dchan); err != nil {
+				return
 			}
-			return nil
-		}
-
-		if ignore.IsInternal(relPath) {
-			l.Debugln("ignored (internal):", relPath)
-			return skip
+		} else {
+			w.found(filepath.Clean(sub))
+			w.Filesystem.Walk(absPath, walkFn)
 		}
-
-		if w.Matcher.Match(relPath).IsIgnored() {
-			l.Debugln("ignored (patterns):", relPath)
-			return skip
+		if w.SubDoneFn != nil {
+			w.SubDoneFn(sub)
 		}
+	}
+}
 
-		if !utf8.ValidString(relPath) {
-			l.Warnf("File name %q is not in UTF8 encoding; skipping.", relPath)
-			return skip
-		}
+// missingSub emits a delete for a requested sub that doesn't exist, if
+// EmitDeletes is set and we knew about it, or otherwise reports it.
+func (w *walker) missingSub(relPath string, dchan chan protocol.FileInfo) error {
+	if !w.EmitDeletes {
+		w.reportError(relPath, errors.New("requested sub not found"))
+		return nil
+	}
+	return w.emitDelete(relPath, dchan)
+}
 
-		relPath, shouldSkip := w.normalizePath(absPath, relPath)
+// found tells a MissingCurrentFiler that the item is there, in case it was
+// missing before.
+func (w *walker) found(relPath string) {
+	if !w.EmitDeletes || w.DeleteGracePeriod <= 0 {
+		return
+	}
+	if mcf, ok := w.CurrentFiler.(MissingCurrentFiler); ok {
+		mcf.Found(relPath)
+	}
+}
+
+// emitDelete emits a delete for the item at relPath, which doesn't exist,
+// if we knew about it and it's not within the DeleteGracePeriod.
+func (w *walker) emitDelete(relPath string, dchan chan protocol.FileInfo) error {
+	cf, ok := w.CurrentFiler.CurrentFile(relPath)
+	if !ok || cf.IsDeleted() {
+		return nil
+	}
+
+	if mcf, ok := w.CurrentFiler.(MissingCurrentFiler); ok && w.DeleteGracePeriod > 0 {
+		now := timeNow()
+		if since := mcf.MissingSince(relPath, now); now.Sub(since) < w.DeleteGracePeriod {
+			l.Debugln("missing in grace period:", relPath, since)
+			return nil
+		}
+	}
+
+	l.Debugln("deleted:", relPath)
+
+	f := protocol.FileInfo{
+		Name:       relPath,
+		Type:       cf.Type,
+		ModifiedS:  cf.ModifiedS,
+		ModifiedNs: cf.ModifiedNs,
+		ModifiedBy: w.ShortID,
+		Deleted:    true,
+		Version:    cf.Version.Update(w.ShortID),
+	}
+
+	select {
+	case dchan <- f:
+	case <-w.Cancel:
+		return errors.New("cancelled")
+	}
+	return nil
+}
+
+// prepare checks the folder root and records what we need to know about it
+// before walking.
+func (w *walker) prepare() error {
+	if err := w.checkReadChunkSize(); err != nil {
+		return err
+	}
+	if err := w.checkDir(); err != nil {
+		return err
+	}
+
+	if w.SingleFilesystem {
+		dev, err := w.Filesystem.DeviceID(w.Dir)
+		if err != nil {
+			return err
+		}
+		w.rootDevice = dev
+	}
+
+	if w.MinFreeSpaceBytes > 0 {
+		if free, err := diskFreeBytes(w.Dir); err != nil {
+			l.Debugln("free space:", w.Dir, err)
+		} else if free < w.MinFreeSpaceBytes {
+			l.Debugf("only %d bytes free in %s, need %d", free, w.Dir, w.MinFreeSpaceBytes)
+			w.lowSpace = true
+			w.reportError(".", errLowSpace)
+		}
+	}
+
+	return nil
+}
+
+func (w *walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) fs.WalkFunc {
+	now := timeNow()
+	var walkFn fs.WalkFunc
+	walkFn = func(absPath string, info fs.FileInfo, err error) error {
+		if !w.control.wait(w.Cancel) {
+			return errors.New("cancelled")
+		}
+
+		if w.pastDeadline() {
+			l.Debugln("deadline passed, stopping walk at", absPath)
+			w.control.setTruncated()
+			return errDeadline
+		}
+		if w.fileLimitReached() {
+			l.Debugln("file limit reached, stopping walk at", absPath)
+			w.control.setTruncated()
+			return errFileLimit
+		}
+
+		// Return value used when we are returning early and don't want to
+		// process the item. For directories, this means do-not-descend.
+		var skip error // nil
+		// info nil when error is not nil
+		if info != nil && info.IsDir() {
+			skip = fs.SkipDir
+		}
+
+		if err != nil {
+			// The walk carries on with the siblings of the item, so all
+			// we lose is the item itself or, for a directory that can't
+			// be read, its contents.
+			l.Debugln("error:", absPath, info, err)
+			if relPath, rerr := filepath.Rel(w.Dir, absPath); rerr == nil {
+				w.reportError(relPath, err)
+				w.skipped(relPath, SkipError)
+			}
+			return skip
+		}
+
+		relPath, err := filepath.Rel(w.Dir, absPath)
+		if err != nil {
+			l.Debugln("rel error:", absPath, err)
+			return skip
+		}
+
+		if relPath == "." {
+			return nil
+		}
+
+		info, err = w.lstatRetry(absPath)
+		// An error here would be weird as we've already gotten to this point, but act on it nonetheless
+		if fs.IsNotExist(err) {
+			// Deleted since the walk came across it.
+			l.Debugln("vanished:", relPath)
+			if w.EmitDeletes {
+				if err := w.emitDelete(relPath, dchan); err != nil {
+					return err
+				}
+			} else {
+				w.reportError(relPath, errVanished)
+			}
+			w.skipped(relPath, SkipVanished)
+			return skip
+		}
+		if err != nil {
+			l.Debugln("lstat error:", absPath, err)
+			w.reportError(relPath, err)
+			w.skipped(relPath, SkipError)
+			return skip
+		}
+
+		if ignore.IsTemporary(relPath) {
+			l.Debugln("temporary:", relPath)
+			if info.IsRegular() && w.tempExpired(relPath, info.ModTime(), now) {
+				l.Debugln("removing temporary:", relPath, info.ModTime())
+				if err := w.Filesystem.Remove(absPath); err != nil {
+					w.reportError(relPath, err)
+				} else if w.TempReapedFn != nil {
+					w.TempReapedFn(relPath, info.Size(), info.ModTime())
+				}
+			}
+			w.skipped(relPath, SkipTemporary)
+			return nil
+		}
+
+		if !w.ScanInternal && w.IsInternal(relPath) {
+			l.Debugln("ignored (internal):", relPath)
+			w.skipped(relPath, SkipInternal)
+			return skip
+		}
+
+		if w.SkipHidden && isHidden(absPath) {
+			l.Debugln("hidden:", relPath)
+			w.skipped(relPath, SkipHidden)
+			return skip
+		}
+
+		if w.SkipAppleMetadata && isAppleMetadata(relPath) {
+			l.Debugln("apple metadata:", relPath)
+			w.skipped(relPath, SkipAppleMetadata)
+			return skip
+		}
+
+		if w.Matcher.Match(relPath).IsIgnored() {
+			l.Debugln("ignored (patterns):", relPath)
+			if w.MatchFn != nil {
+				_, source := w.Matcher.MatchSource(relPath)
+				w.MatchFn(relPath, source)
+			}
+			w.skipped(relPath, SkipIgnored)
+			return skip
+		}
+
+		if w.lowSpace {
+			// Only looking for temporary files.
+			return nil
+		}
+
+		if info.IsRegular() && w.FileSizePolicy == FileSizeSkip && w.outsideSizeBand(info.Size()) {
+			l.Debugln("ignored (size):", relPath, info.Size())
+			w.skipped(relPath, SkipSize)
+			return nil
+		}
+
+		if !utf8.ValidString(relPath) {
+			if !w.RepairInvalidUTF8 {
+				w.warnf("File name %q is not in UTF8 encoding; skipping.", relPath)
+				w.reportError(relPath, errInvalidUTF8)
+				w.skipped(relPath, SkipInvalidUTF8)
+				return skip
+			}
+			newAbsPath, newRelPath, shouldSkip := w.repairUTF8(absPath, relPath)
+			if shouldSkip {
+				w.skipped(relPath, SkipInvalidUTF8)
+				return skip
+			}
+			absPath, relPath = newAbsPath, newRelPath
+		}
+
+		if hasBOM(relPath) {
+			newAbsPath, newRelPath, shouldSkip := w.stripBOM(absPath, relPath)
+			if shouldSkip {
+				w.skipped(relPath, SkipFilenameBOM)
+				return skip
+			}
+			absPath, relPath = newAbsPath, newRelPath
+		}
+
+		normPath, shouldSkip := w.normalizePath(absPath, relPath)
 		if shouldSkip {
+			w.skipped(relPath, SkipUnnormalized)
 			return skip
 		}
+		relPath = normPath
+
+		if w.pendingDirs != nil && !info.IsDir() && !info.IsSymlink() {
+			if err := w.emitPendingDirs(relPath, dchan); err != nil {
+				return err
+			}
+		}
 
 		switch {
 		case info.IsSymlink():
-			if err := w.walkSymlink(absPath, relPath, dchan); err != nil {
+			policy, targetInfo, err := w.symlinkPolicy(absPath, relPath)
+			if err != nil {
+				l.Debugln("symlink not followed:", absPath, err)
+				w.reportError(relPath, err)
+				return nil
+			}
+			if policy == SymlinkFollowDir {
+				return w.followSymlinkDir(absPath, relPath, targetInfo, walkFn, dchan)
+			}
+			if w.pendingDirs != nil {
+				if err := w.emitPendingDirs(relPath, dchan); err != nil {
+					return err
+				}
+			}
+			if policy == SymlinkDereference {
+				return w.walkRegular(relPath, targetInfo, fchan)
+			}
+			if err := w.walkSymlink(absPath, relPath, info, dchan); err != nil {
 				return err
 			}
 			if info.IsDir() {
@@ -275,14 +1790,24 @@ func (w *walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) fs.WalkFu
 			return nil
 
 		case info.IsDir():
-			err = w.walkDir(relPath, info, dchan)
+			err = w.enterDir(absPath, relPath, info, dchan)
 
 		case info.IsRegular():
+			if w.modTime(relPath, info).Before(w.ScanNewerThan) {
+				l.Debugln("older than cutoff:", relPath)
+				w.addCurrentFile(relPath)
+				return nil
+			}
 			err = w.walkRegular(relPath, info, fchan)
+
+		default:
+			l.Debugln("unsupported type:", relPath, info.Mode())
+			w.skipped(relPath, SkipUnsupportedType)
 		}
 
 		return err
 	}
+	return walkFn
 }
 
 func (w *walker) walkRegular(relPath string, info fs.FileInfo, fchan chan protocol.FileInfo) error {
@@ -298,35 +1823,118 @@ func (w *walker) walkRegular(relPath string, info fs.FileInfo, fchan chan protoc
 	//  - had the same modification time as it has now
 	//  - was not a directory previously (since it's a file now)
 	//  - was not a symlink (since it's a file now)
-	//  - was not invalid (since it looks valid now)
-	//  - has the same size as previously
-	cf, ok := w.CurrentFiler.CurrentFile(relPath)
+	//  - was not invalid (since it looks valid now), unless it's exempt
+	//    from hashing and thus always invalid
+	//  - has the same size as previously, unless it was decompressed and
+	//    the size is that of the contents
+	cf, ok := w.currentFile(relPath)
+	if ok {
+		w.found(relPath)
+	}
+	if w.AuditOnly {
+		if !ok || cf.IsDeleted() || cf.IsDirectory() || cf.IsSymlink() || cf.IsInvalid() {
+			// Nothing to compare against.
+			return nil
+		}
+		f := protocol.FileInfo{
+			Name: relPath,
+			Type: protocol.FileInfoTypeFile,
+			Size: info.Size(),
+		}
+		l.Debugln("to audit:", relPath)
+		return w.queueFile(f, fchan)
+	}
+	modTime, modTimeUnchanged := w.checkModTime(relPath, w.modTime(relPath, info), cf)
 	permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Permissions, curMode)
-	if ok && permUnchanged && !cf.IsDeleted() && cf.ModTime().Equal(info.ModTime()) && !cf.IsDirectory() &&
-		!cf.IsSymlink() && !cf.IsInvalid() && cf.Size == info.Size() {
+	otherUnchanged := ok && !cf.IsDeleted() && modTimeUnchanged && !cf.IsDirectory() &&
+		!cf.IsSymlink() && (!cf.IsInvalid() || w.noHash(relPath, info.Size())) &&
+		(cf.Size == info.Size() || cf.Decompressed && w.DecompressFilter != nil)
+	if w.unchanged(cf, ok, info, permUnchanged && otherUnchanged) {
+		w.dirTree.addFile(cf)
+		return nil
+	}
+
+	if w.control.checkpoints.isCompleted(relPath, info.Size(), modTime) {
+		l.Debugln("completed before:", relPath)
+		w.addCurrentFile(relPath)
 		return nil
 	}
 
+	if w.MinFileAge > 0 {
+		if readyAt := info.ModTime().Add(w.MinFileAge); timeNow().Before(readyAt) {
+			l.Debugln("too recently modified:", relPath)
+			if ok {
+				w.dirTree.addFile(cf)
+			}
+			if w.DeferredFn != nil {
+				w.DeferredFn(relPath, readyAt)
+			}
+			return nil
+		}
+	}
+
 	if ok {
 		l.Debugln("rescan:", cf, info.ModTime().Unix(), info.Mode()&fs.ModePerm)
 	}
 
+	w.typeChanged(relPath, cf, ok, protocol.FileInfoTypeFile)
+	if otherUnchanged && !permUnchanged && w.PermChangeFn != nil {
+		w.PermChangeFn(relPath, cf.Permissions, curMode&uint32(maskModePerm))
+	}
+
 	f := protocol.FileInfo{
 		Name:          relPath,
 		Type:          protocol.FileInfoTypeFile,
-		Version:       cf.Version.Update(w.ShortID),
+		Version:       w.newVersion(cf, otherUnchanged),
 		Permissions:   curMode & uint32(maskModePerm),
 		NoPermissions: w.IgnorePerms,
-		ModifiedS:     info.ModTime().Unix(),
-		ModifiedNs:    int32(info.ModTime().Nanosecond()),
+		ModifiedS:     modTime.Unix(),
+		ModifiedNs:    int32(modTime.Nanosecond()),
 		ModifiedBy:    w.ShortID,
 		Size:          info.Size(),
 	}
+	if w.TrustModTime && otherUnchanged && len(cf.Blocks) > 0 && !cf.Decompressed {
+		// Only the permissions changed, so the contents haven't as far
+		// as we're concerned. The hasher passes on complete block lists.
+		f.Blocks = cf.Blocks
+		l.Debugln("trusting modtime:", relPath)
+	}
+	if w.IncrementalBlocks && ok && !cf.IsDeleted() && !cf.IsDirectory() && !cf.IsSymlink() && !cf.IsInvalid() && !cf.Decompressed && cf.Size < info.Size() {
+		f.Blocks = reusableBlocks(cf.Blocks, w.BlockSize)
+		l.Debugf("reusing %d blocks for %s", len(f.Blocks), relPath)
+	}
+
+	if w.ScanADS && w.StreamsFn != nil {
+		w.reportStreams(relPath)
+	}
+
 	l.Debugln("to hash:", relPath, f)
 
+	return w.queueFile(f, fchan)
+}
+
+// queueFile hands the file to the hashers.
+func (w *walker) queueFile(f protocol.FileInfo, fchan chan protocol.FileInfo) error {
+	w.metrics.fileQueued(1)
+	if w.MaxFilesPerScan > 0 {
+		atomic.AddInt64(&w.filesQueued, 1)
+		w.control.setLastPath(f.Name)
+	}
+	if w.smallFiles != nil && f.Size <= int64(w.BlockSize) {
+		// A single block isn't worth the trip through the hashers. The
+		// walker is a hasher for the time being.
+		w.smallFiles.metrics.hasherStarted()
+		ok := w.smallFiles.hashOne(f)
+		w.smallFiles.metrics.hasherStopped()
+		if !ok {
+			return errors.New("cancelled")
+		}
+		return nil
+	}
 	select {
 	case fchan <- f:
 	case <-w.Cancel:
+		w.metrics.fileQueued(-1)
 		return errors.New("cancelled")
 	}
 
@@ -341,24 +1949,43 @@ func (w *walker) walkDir(relPath string, info fs.FileInfo, dchan chan protocol.F
 	//  - was a directory previously (not a file or something else)
 	//  - was not a symlink (since it's a directory now)
 	//  - was not invalid (since it looks valid now)
-	cf, ok := w.CurrentFiler.CurrentFile(relPath)
+	atomic.AddInt64(&w.dirsScanned, 1)
+	if w.AuditOnly {
+		return nil
+	}
+	cf, ok := w.currentFile(relPath)
+	if ok {
+		w.found(relPath)
+	}
 	permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Permissions, uint32(info.Mode()))
-	if ok && permUnchanged && !cf.IsDeleted() && cf.IsDirectory() && !cf.IsSymlink() && !cf.IsInvalid() {
+	otherUnchanged := ok && !cf.IsDeleted() && cf.IsDirectory() && !cf.IsSymlink() && !cf.IsInvalid()
+	if w.unchanged(cf, ok, info, permUnchanged && otherUnchanged) {
 		return nil
 	}
 
+	w.typeChanged(relPath, cf, ok, protocol.FileInfoTypeDirectory)
+	if otherUnchanged && !permUnchanged && w.PermChangeFn != nil {
+		w.PermChangeFn(relPath, cf.Permissions, uint32(info.Mode()&maskModePerm))
+	}
+
+	modTime := w.modTime(relPath, info)
 	f := protocol.FileInfo{
 		Name:          relPath,
 		Type:          protocol.FileInfoTypeDirectory,
-		Version:       cf.Version.Update(w.ShortID),
+		Version:       w.newVersion(cf, otherUnchanged),
 		Permissions:   uint32(info.Mode() & maskModePerm),
 		NoPermissions: w.IgnorePerms,
-		ModifiedS:     info.ModTime().Unix(),
-		ModifiedNs:    int32(info.ModTime().Nanosecond()),
+		ModifiedS:     modTime.Unix(),
+		ModifiedNs:    int32(modTime.Nanosecond()),
 		ModifiedBy:    w.ShortID,
 	}
 	l.Debugln("dir:", relPath, f)
 
+	if w.pendingDirs != nil {
+		w.pendingDirs.add(f)
+		return nil
+	}
+
 	select {
 	case dchan <- f:
 	case <-w.Cancel:
@@ -370,10 +1997,10 @@ func (w *walker) walkDir(relPath string, info fs.FileInfo, dchan chan protocol.F
 
 // walkSymlink returns nil or an error, if the error is of the nature that
 // it should stop the entire walk.
-func (w *walker) walkSymlink(absPath, relPath string, dchan chan protocol.FileInfo) error {
+func (w *walker) walkSymlink(absPath, relPath string, info fs.FileInfo, dchan chan protocol.FileInfo) error {
 	// Symlinks are not supported on Windows. We ignore instead of returning
 	// an error.
-	if runtime.GOOS == "windows" {
+	if runtime.GOOS == "windows" || w.AuditOnly {
 		return nil
 	}
 
@@ -385,9 +2012,50 @@ func (w *walker) walkSymlink(absPath, relPath string, dchan chan protocol.FileIn
 	target, err := w.Filesystem.ReadSymlink(absPath)
 	if err != nil {
 		l.Debugln("readlink error:", absPath, err)
+		if w.ReportBrokenSymlinks {
+			w.reportError(relPath, err)
+		}
+		return nil
+	}
+
+	// The names the target refers to are normalized like ours, so the
+	// target should be as well to keep pointing at them elsewhere.
+	if form, ok := w.normalizationForm(); ok {
+		target = form.String(target)
+	}
+
+	if w.RestrictSymlinkTargets && symlinkEscapes(relPath, target) {
+		l.Debugln("symlink escapes:", absPath, target)
+		w.reportError(relPath, errSymlinkEscapes)
 		return nil
 	}
 
+	if w.MaxSymlinkDepth > 0 || w.DetectSymlinkLoops {
+		switch err := w.resolveSymlink(relPath, target); {
+		case err == nil:
+		case w.MaxSymlinkDepth > 0:
+			if err == errSymlinkChainLoop && !w.DetectSymlinkLoops {
+				// Without loop detection, it's just a chain that's too long.
+				err = errSymlinkDepth
+			}
+			l.Debugln("symlink chain:", absPath, err)
+			w.reportError(relPath, err)
+			return nil
+		case err == errSymlinkChainLoop:
+			l.Debugln("symlink loop:", absPath, target)
+			w.reportError(relPath, err)
+		}
+	}
+
+	if w.ReportBrokenSymlinks {
+		if _, err := w.Filesystem.Stat(absPath); fs.IsNotExist(err) {
+			l.Debugln("broken symlink:", absPath, target)
+			w.reportError(relPath, errBrokenSymlink)
+		}
+	}
+
+	w.dirTree.addSymlink(relPath, target)
+
 	// A symlink is "unchanged", if
 	//  - it exists
 	//  - it wasn't deleted (because it isn't now)
@@ -395,11 +2063,16 @@ func (w *walker) walkSymlink(absPath, relPath string, dchan chan protocol.FileIn
 	//  - it wasn't invalid
 	//  - the symlink type (file/dir) was the same
 	//  - the target was the same
-	cf, ok := w.CurrentFiler.CurrentFile(relPath)
-	if ok && !cf.IsDeleted() && cf.IsSymlink() && !cf.IsInvalid() && cf.SymlinkTarget == target {
+	cf, ok := w.currentFile(relPath)
+	if ok {
+		w.found(relPath)
+	}
+	if w.unchanged(cf, ok, info, ok && !cf.IsDeleted() && cf.IsSymlink() && !cf.IsInvalid() && cf.SymlinkTarget == target) {
 		return nil
 	}
 
+	w.typeChanged(relPath, cf, ok, protocol.FileInfoTypeSymlink)
+
 	f := protocol.FileInfo{
 		Name:          relPath,
 		Type:          protocol.FileInfoTypeSymlink,
@@ -419,17 +2092,267 @@ func (w *walker) walkSymlink(absPath, relPath string, dchan chan protocol.FileIn
 	return nil
 }
 
+// unchanged returns whether the item is unchanged from cf, the current file
+// if ok, as per UnchangedFn if set, or builtin otherwise.
+func (w *walker) unchanged(cf protocol.FileInfo, ok bool, info fs.FileInfo, builtin bool) bool {
+	if w.UnchangedFn == nil || !ok {
+		return builtin
+	}
+	return w.UnchangedFn(cf, info)
+}
+
+// hasSkipDirMarker returns whether the directory contains one of the
+// SkipDirMarkers.
+func (w *walker) hasSkipDirMarker(absPath string) bool {
+	for _, marker := range w.SkipDirMarkers {
+		if _, err := w.Filesystem.Lstat(filepath.Join(absPath, marker)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// symlinkPolicy returns how the symlink is to be handled as per the
+// SymlinkPolicyFn and, unless it's SymlinkRecord, what the link points to.
+// An error means the link may not be followed as the policy says.
+func (w *walker) symlinkPolicy(absPath, relPath string) (SymlinkPolicy, fs.FileInfo, error) {
+	if w.SymlinkPolicyFn == nil || runtime.GOOS == "windows" || w.AuditOnly {
+		return SymlinkRecord, nil, nil
+	}
+	target, err := w.Filesystem.ReadSymlink(absPath)
+	if err != nil {
+		// Left for walkSymlink to deal with.
+		return SymlinkRecord, nil, nil
+	}
+	policy := w.SymlinkPolicyFn(relPath, target)
+	if policy == SymlinkRecord {
+		return SymlinkRecord, nil, nil
+	}
+
+	info, err := w.Filesystem.Stat(absPath)
+	if err != nil || policy == SymlinkFollowDir && !info.IsDir() || policy == SymlinkDereference && !info.IsRegular() {
+		l.Debugln("symlink target unsuitable for policy:", absPath, policy, err)
+		return SymlinkRecord, nil, nil
+	}
+
+	physTarget := physicalPath(w.Filesystem, absPath)
+	if w.RestrictSymlinkTargets {
+		if rel, err := filepath.Rel(physicalPath(w.Filesystem, w.Dir), physTarget); err != nil || outsideFolder(rel) {
+			return SymlinkRecord, nil, errSymlinkEscapes
+		}
+	}
+	if policy == SymlinkFollowDir {
+		for dir := filepath.Dir(absPath); ; dir = filepath.Dir(dir) {
+			if physicalPath(w.Filesystem, dir) == physTarget {
+				return SymlinkRecord, nil, errSymlinkLoop
+			}
+			if dir == filepath.Clean(w.Dir) || dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+	return policy, info, nil
+}
+
+// enterDir handles the directory at dirPath, which is relPath in the
+// folder, and returns fs.SkipDir if its contents are not to be walked.
+// Followed symlinks pass their target as dirPath, so that they get the
+// same treatment as a real directory.
+func (w *walker) enterDir(dirPath, relPath string, info fs.FileInfo, dchan chan protocol.FileInfo) error {
+	if w.otherFilesystem(dirPath) {
+		l.Debugln("other filesystem:", relPath)
+		w.skipped(relPath, SkipOtherFilesystem)
+		return fs.SkipDir
+	}
+
+	if w.enterDirLimit != nil && w.enterDirLimit.allow() {
+		w.EnterDirFn(relPath)
+	}
+
+	if w.pendingDirs != nil {
+		w.pendingDirs.enter(relPath)
+	}
+
+	if w.hasSkipDirMarker(dirPath) {
+		l.Debugln("marked to skip:", relPath)
+		w.skipped(relPath, SkipMarkedDir)
+		if w.EmitMarkedDirs {
+			w.dirTree.addDir(relPath)
+			if err := w.walkDir(relPath, info, dchan); err != nil {
+				return err
+			}
+		}
+		return fs.SkipDir
+	}
+
+	w.dirTree.addDir(relPath)
+	if w.modTime(relPath, info).Before(w.ScanNewerThan) {
+		// Not considered changed, but still descended into.
+		l.Debugln("older than cutoff:", relPath)
+		atomic.AddInt64(&w.dirsScanned, 1)
+	} else if err := w.walkDir(relPath, info, dchan); err != nil {
+		return err
+	}
+
+	if w.MaxDepth > 0 && pathDepth(relPath) >= w.MaxDepth {
+		l.Debugln("max depth reached:", relPath)
+		return fs.SkipDir
+	}
+	return nil
+}
+
+// followSymlinkDir returns the directory pointed to by the symlink as a
+// directory at relPath, and walks its contents as if they were there.
+func (w *walker) followSymlinkDir(absPath, relPath string, info fs.FileInfo, walkFn fs.WalkFunc, dchan chan protocol.FileInfo) error {
+	target := physicalPath(w.Filesystem, absPath)
+	if err := w.enterDir(target, relPath, info, dchan); err == fs.SkipDir {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return w.Filesystem.Walk(target, func(path string, info fs.FileInfo, err error) error {
+		rel, rerr := filepath.Rel(target, path)
+		if rerr != nil || rel == "." {
+			// The directory itself is done.
+			return nil
+		}
+		return walkFn(filepath.Join(absPath, rel), info, err)
+	})
+}
+
+// physicalPath returns the absolute path with all symlinks resolved.
+func physicalPath(filesystem fs.Filesystem, path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return resolveSymlinks(filesystem, path, 0)
+}
+
+// reportStreams passes the alternate data streams of the file to
+// StreamsFn.
+func (w *walker) reportStreams(relPath string) {
+	streams, err := w.Filesystem.Streams(filepath.Join(w.Dir, relPath))
+	if err != nil {
+		l.Debugln("streams:", relPath, err)
+		w.reportError(relPath, err)
+		return
+	}
+	w.StreamsFn(relPath, streams)
+}
+
+// typeChanged calls TypeChangeFn if the current file, if any, is not of
+// the given type. All kinds of symlinks are the same type.
+func (w *walker) typeChanged(relPath string, cf protocol.FileInfo, ok bool, to protocol.FileInfoType) {
+	if w.TypeChangeFn == nil || !ok || cf.IsDeleted() {
+		return
+	}
+	if cf.Type == to || cf.IsSymlink() && to == protocol.FileInfoTypeSymlink {
+		return
+	}
+	w.TypeChangeFn(relPath, cf.Type, to)
+}
+
+// repairUTF8 renames the item on disk so that its name is valid UTF8, by
+// replacing invalid bytes with the Unicode replacement character. It
+// returns the new absolute and relative paths, or skip is true.
+func (w *walker) repairUTF8(absPath, relPath string) (newAbsPath, newRelPath string, skip bool) {
+	// Only the last path component can be broken. A broken parent would
+	// have been repaired or skipped already.
+	dir, name := filepath.Split(relPath)
+	var buf bytes.Buffer
+	for len(name) > 0 {
+		r, size := utf8.DecodeRuneInString(name)
+		if r == utf8.RuneError && size == 1 {
+			buf.WriteRune(utf8.RuneError)
+		} else {
+			buf.WriteString(name[:size])
+		}
+		name = name[size:]
+	}
+
+	newRelPath = dir + buf.String()
+	newAbsPath = filepath.Join(w.Dir, newRelPath)
+	if _, err := w.Filesystem.Lstat(newAbsPath); !fs.IsNotExist(err) {
+		l.Infof(`File name %q conflicts with another file after UTF8 repair; ignoring.`, relPath)
+		w.reportError(relPath, errRepairConflict)
+		return "", "", true
+	}
+	if w.AllowRenameFn != nil && !w.AllowRenameFn(relPath, newRelPath) {
+		w.warnf("File name %q is not in UTF8 encoding and may not be renamed; skipping.", relPath)
+		w.reportError(relPath, errRepairNotAllowed)
+		return "", "", true
+	}
+	if err := w.Filesystem.Rename(absPath, newAbsPath); err != nil {
+		l.Infof(`Error repairing UTF8 encoding of file %q: %v`, relPath, err)
+		w.reportError(relPath, err)
+		return "", "", true
+	}
+
+	l.Infof(`Repaired UTF8 encoding of file name %q.`, relPath)
+	w.renamed(relPath, newRelPath)
+	return newAbsPath, newRelPath, false
+}
+
+const utf8BOM = "\ufeff"
+
+// hasBOM returns whether the last component of the path starts with a byte
+// order mark, and is more than just that.
+func hasBOM(relPath string) bool {
+	name := filepath.Base(relPath)
+	return strings.HasPrefix(name, utf8BOM) && len(name) > len(utf8BOM)
+}
+
+// stripBOM renames the item on disk to remove the byte order mark from the
+// start of its name, if StripFilenameBOM is set. Otherwise it just reports
+// it and returns the paths unchanged. It returns the new absolute and
+// relative paths, or skip is true.
+func (w *walker) stripBOM(absPath, relPath string) (newAbsPath, newRelPath string, skip bool) {
+	if !w.StripFilenameBOM {
+		w.warnf("File name %q starts with a byte order mark.", relPath)
+		w.reportError(relPath, errFilenameBOM)
+		return absPath, relPath, false
+	}
+
+	dir, name := filepath.Split(relPath)
+	newRelPath = dir + strings.TrimPrefix(name, utf8BOM)
+	newAbsPath = filepath.Join(w.Dir, newRelPath)
+	if _, err := w.Filesystem.Lstat(newAbsPath); !fs.IsNotExist(err) {
+		l.Infof(`File name %q conflicts with another file without its byte order mark; ignoring.`, relPath)
+		w.reportError(relPath, errStripBOMConflict)
+		return "", "", true
+	}
+	if w.AllowRenameFn != nil && !w.AllowRenameFn(relPath, newRelPath) {
+		w.warnf("File name %q starts with a byte order mark and may not be renamed; skipping.", relPath)
+		w.reportError(relPath, errStripBOMNotAllowed)
+		return "", "", true
+	}
+	if err := w.Filesystem.Rename(absPath, newAbsPath); err != nil {
+		l.Infof(`Error removing byte order mark from file name %q: %v`, relPath, err)
+		w.reportError(relPath, err)
+		return "", "", true
+	}
+
+	l.Infof(`Removed byte order mark from file name %q.`, relPath)
+	w.renamed(relPath, newRelPath)
+	return newAbsPath, newRelPath, false
+}
+
 // normalizePath returns the normalized relative path (possibly after fixing
 // it on disk), or skip is true.
 func (w *walker) normalizePath(absPath, relPath string) (normPath string, skip bool) {
-	if runtime.GOOS == "darwin" {
-		// Mac OS X file names should always be NFD normalized.
-		normPath = norm.NFD.String(relPath)
-	} else {
-		// Every other OS in the known universe uses NFC or just plain
-		// doesn't bother to define an encoding. In our case *we* do care,
-		// so we enforce NFC regardless.
-		normPath = norm.NFC.String(relPath)
+	form, ok := w.normalizationForm()
+	if !ok {
+		// Anything goes.
+		return relPath, false
+	}
+	if w.NormalizationCacheSize > 0 && normCache.has(form, relPath) {
+		return relPath, false
+	}
+	normPath = form.String(relPath)
+
+	if relPath == normPath && w.NormalizationCacheSize > 0 {
+		normCache.add(form, relPath, w.NormalizationCacheSize)
 	}
 
 	if relPath != normPath {
@@ -438,7 +2361,7 @@ func (w *walker) normalizePath(absPath, relPath string) (normPath string, skip b
 		if !w.AutoNormalize {
 			// We're not authorized to do anything about it, so complain and skip.
 
-			l.Warnf("File name %q is not in the correct UTF8 normalization form; skipping.", relPath)
+			w.warnf("File name %q is not in the correct UTF8 normalization form; skipping.", relPath)
 			return "", true
 		}
 
@@ -446,15 +2369,23 @@ func (w *walker) normalizePath(absPath, relPath string) (normPath string, skip b
 		normalizedPath := filepath.Join(w.Dir, normPath)
 		if _, err := w.Filesystem.Lstat(normalizedPath); fs.IsNotExist(err) {
 			// Nothing exists with the normalized filename. Good.
+			if w.AllowRenameFn != nil && !w.AllowRenameFn(relPath, normPath) {
+				w.warnf("File name %q is not in the correct UTF8 normalization form and may not be renamed; skipping.", relPath)
+				w.reportError(relPath, errNormalizeNotAllowed)
+				return "", true
+			}
 			if err = w.Filesystem.Rename(absPath, normalizedPath); err != nil {
 				l.Infof(`Error normalizing UTF8 encoding of file "%s": %v`, relPath, err)
+				w.reportError(relPath, err)
 				return "", true
 			}
 			l.Infof(`Normalized UTF8 encoding of file name "%s".`, relPath)
+			w.renamed(relPath, normPath)
 		} else {
 			// There is something already in the way at the normalized
 			// file name.
 			l.Infof(`File "%s" has UTF8 encoding conflict with another file; ignoring.`, relPath)
+			w.reportError(relPath, errNormalizationConflict)
 			return "", true
 		}
 	}
@@ -462,9 +2393,449 @@ func (w *walker) normalizePath(absPath, relPath string) (normPath string, skip b
 	return normPath, false
 }
 
+// normalizationForm returns the Unicode normalization form that names are
+// expected to be in, or false if any form goes.
+func (w *walker) normalizationForm() (norm.Form, bool) {
+	switch {
+	case w.NormalizationForm == NormalizationNone:
+		return 0, false
+	case w.NormalizationForm == NormalizationNFD:
+		return norm.NFD, true
+	case w.NormalizationForm == NormalizationNFC:
+		return norm.NFC, true
+	case runtime.GOOS == "darwin":
+		// Mac OS X file names should always be NFD normalized.
+		return norm.NFD, true
+	default:
+		// Every other OS in the known universe uses NFC or just plain
+		// doesn't bother to define an encoding. In our case *we* do care,
+		// so we enforce NFC regardless.
+		return norm.NFC, true
+	}
+}
+
+// symlinkEscapes returns whether the relative target of the symlink at
+// relPath points outside of the folder.
+func symlinkEscapes(relPath, target string) bool {
+	if filepath.IsAbs(target) {
+		return false
+	}
+	return outsideFolder(filepath.Join(filepath.Dir(relPath), target))
+}
+
+// outsideFolder returns whether the clean relative path is outside of the
+// folder.
+func outsideFolder(relPath string) bool {
+	return relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
+
+// resolveSymlink follows the chain of symlinks starting with the one at
+// relPath, with the given target, for MaxSymlinkDepth links, or
+// maxSymlinkDepth if unset. It returns errSymlinkChainLoop if the chain
+// leads back to one of its links, errSymlinkDepth if it is longer than
+// that, and errSymlinkEscapes if RestrictSymlinkTargets is set and the
+// chain leaves the folder. Where it leaves the folder otherwise, it is not
+// followed any further.
+func (w *walker) resolveSymlink(relPath, target string) error {
+	maxDepth := w.MaxSymlinkDepth
+	if maxDepth <= 0 {
+		maxDepth = maxSymlinkDepth
+	}
+	seen := map[string]struct{}{relPath: {}}
+	for depth := 1; ; depth++ {
+		relPath = w.symlinkTargetPath(relPath, target)
+		if outsideFolder(relPath) {
+			if w.RestrictSymlinkTargets {
+				return errSymlinkEscapes
+			}
+			return nil
+		}
+		if _, ok := seen[relPath]; ok {
+			return errSymlinkChainLoop
+		}
+		seen[relPath] = struct{}{}
+
+		absPath := filepath.Join(w.Dir, relPath)
+		info, err := w.Filesystem.Lstat(absPath)
+		if err != nil || !info.IsSymlink() {
+			// The end of the chain, whether it exists or not.
+			return nil
+		}
+		if depth >= maxDepth {
+			return errSymlinkDepth
+		}
+		if target, err = w.Filesystem.ReadSymlink(absPath); err != nil {
+			return nil
+		}
+	}
+}
+
+// pathDepth returns how many levels below Dir the item at relPath is, one
+// being directly in Dir.
+func pathDepth(relPath string) int {
+	return strings.Count(relPath, string(filepath.Separator)) + 1
+}
+
+// symlinkTargetPath returns the path, relative to Dir, that the symlink at
+// relPath with the given target points to. Targets outside of Dir result in
+// paths starting with "..".
+func (w *walker) symlinkTargetPath(relPath, target string) string {
+	if !filepath.IsAbs(target) {
+		return filepath.Join(filepath.Dir(relPath), target)
+	}
+	root, err := filepath.Abs(w.Dir)
+	if err != nil {
+		return ".."
+	}
+	if relPath, err = filepath.Rel(root, target); err != nil {
+		return ".."
+	}
+	return relPath
+}
+
+// lstatRetry is Lstat, retrying transient errors as per LstatRetries.
+func (w *walker) lstatRetry(absPath string) (fs.FileInfo, error) {
+	info, err := w.Filesystem.Lstat(absPath)
+
+	delay := w.LstatRetryDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	for attempt := 0; err != nil && attempt < w.LstatRetries && transientError(err); attempt++ {
+		l.Debugf("lstat failed, retrying %s in %v: %v", absPath, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-w.Cancel:
+			return nil, err
+		}
+		delay *= 2
+		info, err = w.Filesystem.Lstat(absPath)
+	}
+	return info, err
+}
+
+// setSmallFileHasher lets the walker hash files that fit in a single block
+// itself, using ph, and send them straight to its outbox. That's not done
+// where the hashers keep the order of the files or hash a directory at a
+// time, and not when locked files are retried, which could hold up the
+// walk. The walker then counts as one more hasher towards
+// MaxHashCPUPercent.
+func (w *walker) setSmallFileHasher(ph *parallelHasher) {
+	if w.Deterministic || w.SequentialPerDir || w.RetryLockedFiles > 0 {
+		return
+	}
+	ph.inline = true
+	w.smallFiles = ph
+}
+
+// emitPendingDirs sends the pending parent directories of the given item,
+// which are now known not to be empty.
+func (w *walker) emitPendingDirs(relPath string, dchan chan protocol.FileInfo) error {
+	for _, f := range w.pendingDirs.take(relPath) {
+		select {
+		case dchan <- f:
+		case <-w.Cancel:
+			return errors.New("cancelled")
+		}
+	}
+	return nil
+}
+
+// currentFile returns the file as seen at last scan, from the directory
+// cache if there is one.
+func (w *walker) currentFile(relPath string) (protocol.FileInfo, bool) {
+	if w.dirFiles != nil {
+		return w.dirFiles.get(relPath)
+	}
+	return w.CurrentFiler.CurrentFile(relPath)
+}
+
+// addCurrentFile records the file as seen at last scan for DirHashFn, when
+// we don't look at it any closer.
+func (w *walker) addCurrentFile(relPath string) {
+	if w.dirTree == nil {
+		return
+	}
+	if cf, ok := w.currentFile(relPath); ok {
+		w.dirTree.addFile(cf)
+	}
+}
+
+// otherFilesystem returns whether the given directory is on another
+// filesystem than Dir and should not be walked, as per SingleFilesystem.
+func (w *walker) otherFilesystem(absPath string) bool {
+	if !w.SingleFilesystem {
+		return false
+	}
+	dev, err := w.Filesystem.DeviceID(absPath)
+	if err != nil {
+		// Walk it as usual; any problem will surface there.
+		l.Debugln("device ID:", absPath, err)
+		return false
+	}
+	return dev != w.rootDevice
+}
+
+// bytesToHash returns the number of bytes the hashers will read for the
+// file, i.e. excluding any reused blocks.
+func (cfg *Config) bytesToHash(f protocol.FileInfo) int64 {
+	if cfg.noHash(f.Name, f.Size) {
+		return 0
+	}
+	if !cfg.reusesBlocks(f) {
+		return f.Size
+	}
+	var reused int64
+	for _, b := range f.Blocks {
+		reused += int64(b.Size)
+	}
+	if reused > f.Size {
+		// The file has shrunk and the blocks won't be reused after all.
+		return f.Size
+	}
+	return f.Size - reused
+}
+
+// reusesBlocks returns whether the hashers keep the blocks already on the
+// file, rather than hashing it from the start. This follows the choices
+// made in parallelHasher.hashOne.
+func (cfg *Config) reusesBlocks(f protocol.FileInfo) bool {
+	if cfg.DigestFn != nil && len(cfg.ExtraDigests) > 0 && cfg.HasherFactory == nil {
+		// The digests need the whole file.
+		return false
+	}
+	if cfg.BlockFn != nil && cfg.StreamBlocksThreshold > 0 && f.Size >= cfg.StreamBlocksThreshold {
+		// All blocks go to BlockFn.
+		return false
+	}
+	if cfg.DecompressFilter != nil {
+		if _, ok := cfg.DecompressFilter(f.Name); ok {
+			// The reused blocks are of the raw file.
+			return false
+		}
+	}
+	return true
+}
+
+// useWeakHashes returns whether the file is hashed with weak hashes.
+func (cfg *Config) useWeakHashes(relPath string, size int64) bool {
+	if cfg.WeakHashFn != nil {
+		return cfg.WeakHashFn(relPath, size)
+	}
+	return cfg.UseWeakHashes
+}
+
+// hashCost returns the relative cost of hashing a byte, with or without
+// weak hashes.
+func (cfg *Config) hashCost(weak bool) float64 {
+	if !weak {
+		return 1
+	}
+	if cfg.WeakHashOverhead > 0 {
+		return 1 + cfg.WeakHashOverhead
+	}
+	return 1 + DefaultWeakHashOverhead
+}
+
+// modTime returns the modification time of the item, as per ModTimeFn if
+// set.
+func (w *walker) modTime(relPath string, info fs.FileInfo) time.Time {
+	if w.ModTimeFn == nil {
+		return info.ModTime()
+	}
+	return w.ModTimeFn(relPath, info)
+}
+
+// checkModTime returns the modification time to record for the file, and
+// whether it's unchanged from the current file. Modification times in the
+// future are reported, and clamped as per ClampFutureMtimes.
+func (w *walker) checkModTime(relPath string, modTime time.Time, cf protocol.FileInfo) (time.Time, bool) {
+	now := timeNow()
+	if !modTime.After(now.Add(futureModTimeTolerance)) {
+		return modTime, cf.ModTime().Equal(modTime)
+	}
+
+	l.Debugln("future modtime:", relPath, modTime)
+	w.reportError(relPath, errFutureModTime)
+	if !w.ClampFutureMtimes {
+		return modTime, cf.ModTime().Equal(modTime)
+	}
+	// What was recorded is when we last saw it, or the time it had before
+	// it went into the future.
+	return now, !cf.ModTime().After(now)
+}
+
+// fileLimitReached returns whether MaxFilesPerScan files have been handed
+// to the hashers.
+func (w *walker) fileLimitReached() bool {
+	return w.MaxFilesPerScan > 0 && atomic.LoadInt64(&w.filesQueued) >= int64(w.MaxFilesPerScan)
+}
+
+// pastDeadline returns whether the Deadline, if any, has passed.
+func (cfg *Config) pastDeadline() bool {
+	return !cfg.Deadline.IsZero() && !timeNow().Before(cfg.Deadline)
+}
+
+// noHash returns whether the file is exempt from hashing as per
+// NoHashExtensions or the size band.
+func (cfg *Config) noHash(name string, size int64) bool {
+	if cfg.outsideSizeBand(size) {
+		return true
+	}
+	if len(cfg.NoHashExtensions) == 0 {
+		return false
+	}
+	ext := strings.TrimPrefix(filepath.Ext(name), ".")
+	if ext == "" {
+		return false
+	}
+	for _, noHashExt := range cfg.NoHashExtensions {
+		if strings.EqualFold(ext, strings.TrimPrefix(noHashExt, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReadChunkSize returns an error if ReadChunkSize is set to something
+// other than a multiple of BlockSize.
+func (cfg *Config) checkReadChunkSize() error {
+	if cfg.ReadChunkSize > 0 && (cfg.BlockSize <= 0 || cfg.ReadChunkSize%cfg.BlockSize != 0) {
+		return fmt.Errorf("read chunk size %d is not a multiple of the block size %d", cfg.ReadChunkSize, cfg.BlockSize)
+	}
+	return nil
+}
+
+// outsideSizeBand returns whether size is outside the band set by
+// MinFileSize and MaxFileSize.
+func (cfg *Config) outsideSizeBand(size int64) bool {
+	return size < cfg.MinFileSize || cfg.MaxFileSize > 0 && size > cfg.MaxFileSize
+}
+
+// reportError passes a problem with the given item to the ErrorFn, if any.
+func (cfg *Config) reportError(relPath string, err error) {
+	if cfg.ErrorFn == nil {
+		return
+	}
+	e := ScanError{Path: relPath, ScanID: cfg.ScanID, Err: err}
+	if cfg.Filesystem != nil {
+		absPath := filepath.Join(cfg.Dir, relPath)
+		if physPath := resolveSymlinks(cfg.Filesystem, absPath, 0); physPath != absPath {
+			e.PhysicalPath = physPath
+		}
+	}
+	cfg.ErrorFn(e)
+}
+
+// resolveSymlinks returns the given path with any symlinks along the way
+// replaced by their targets. Components that can't be resolved, for
+// example because they don't exist, are kept as they are.
+func resolveSymlinks(filesystem fs.Filesystem, path string, depth int) string {
+	path = filepath.Clean(path)
+	vol := filepath.VolumeName(path)
+	rest := path[len(vol):]
+
+	resolved := vol
+	if strings.HasPrefix(rest, string(filepath.Separator)) {
+		resolved += string(filepath.Separator)
+	}
+	parts := strings.Split(rest, string(filepath.Separator))
+	for i, part := range parts {
+		if part == "" || part == "." {
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		if depth < maxSymlinkDepth {
+			if info, err := filesystem.Lstat(next); err == nil && info.IsSymlink() {
+				if target, err := filesystem.ReadSymlink(next); err == nil {
+					if !filepath.IsAbs(target) {
+						target = filepath.Join(resolved, target)
+					}
+					rest := append([]string{target}, parts[i+1:]...)
+					return resolveSymlinks(filesystem, filepath.Join(rest...), depth+1)
+				}
+			}
+		}
+		resolved = next
+	}
+	return resolved
+}
+
+// renamed announces that an item has been renamed on disk by the walker.
+func (w *walker) renamed(from, to string) {
+	normCache.remove(from)
+	if !w.DisableEvents {
+		events.Default.Log(events.LocalItemRenamed, map[string]string{
+			"folder": w.Folder,
+			"scanID": w.ScanID,
+			"from":   from,
+			"to":     to,
+		})
+	}
+	if w.RenameFn != nil {
+		w.RenameFn(from, to)
+	}
+}
+
+// newVersion returns the version vector for an item that has changed since
+// the current file cf. If permOnly is true, the permissions are the only
+// change.
+func (w *walker) newVersion(cf protocol.FileInfo, permOnly bool) protocol.Vector {
+	if permOnly && w.PermissionChangeVersioning == PermissionChangeKeepVersion {
+		return cf.Version
+	}
+	return cf.Version.Update(w.ShortID)
+}
+
+// warnf logs a warning about something encountered during the walk,
+// unless warnings have been suppressed for this walk.
+func (w *walker) warnf(format string, vals ...interface{}) {
+	if w.SuppressWarnings {
+		l.Debugf(format, vals...)
+		return
+	}
+	l.Warnf(format, vals...)
+}
+
+// tempExpired returns whether the temporary file with the given
+// modification time is old enough to be removed.
+func (w *walker) tempExpired(relPath string, modTime, now time.Time) bool {
+	lifetime := w.TempLifetime
+	if w.TempLifetimeFn != nil {
+		lifetime = w.TempLifetimeFn(relPath)
+		if lifetime <= 0 {
+			return false
+		}
+	}
+	return modTime.Add(lifetime).Before(now)
+}
+
+// reusableBlocks returns the leading full size blocks of the given block
+// list. A trailing partial block is not reusable as it will have changed if
+// the file grew.
+func reusableBlocks(blocks []protocol.BlockInfo, blockSize int) []protocol.BlockInfo {
+	var offset int64
+	for i, b := range blocks {
+		if int(b.Size) != blockSize || b.Offset != offset {
+			return blocks[:i]
+		}
+		offset += int64(b.Size)
+	}
+	return blocks
+}
+
 func (w *walker) checkDir() error {
 	if info, err := w.Filesystem.Lstat(w.Dir); err != nil {
 		return err
+	} else if info.IsSymlink() && w.ResolveDirSymlink {
+		if info, err := w.Filesystem.Stat(w.Dir); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return errors.New(w.Dir + ": not a directory")
+		}
+		target := resolveSymlinks(w.Filesystem, w.Dir, 0)
+		l.Debugln("checkDir", w.Dir, "resolved to", target)
+		w.Dir = target
 	} else if !info.IsDir() {
 		return errors.New(w.Dir + ": not a directory")
 	} else {
@@ -473,6 +2844,145 @@ func (w *walker) checkDir() error {
 	return nil
 }
 
+// dirFilesCache keeps the current files of the directories along the path
+// currently being walked. As the walk is depth first, a directory that is
+// not a parent of the current item is done with and can be forgotten.
+type dirFilesCache struct {
+	cf    DirCurrentFiler
+	mut   sync.Mutex
+	dirs  []string
+	files []map[string]protocol.FileInfo
+}
+
+func newDirFilesCache(cf DirCurrentFiler) *dirFilesCache {
+	return &dirFilesCache{
+		cf:  cf,
+		mut: sync.NewMutex(),
+	}
+}
+
+func (c *dirFilesCache) get(relPath string) (protocol.FileInfo, bool) {
+	dir := filepath.Dir(relPath)
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		if c.dirs[i] == dir {
+			f, ok := c.files[i][relPath]
+			return f, ok
+		}
+		if c.dirs[i] == "." || strings.HasPrefix(dir, c.dirs[i]+string(filepath.Separator)) {
+			break
+		}
+		c.dirs, c.files = c.dirs[:i], c.files[:i]
+	}
+
+	files := c.cf.CurrentFilesInDir(dir)
+	c.dirs = append(c.dirs, dir)
+	c.files = append(c.files, files)
+	f, ok := files[relPath]
+	return f, ok
+}
+
+// A rateLimit allows something at most once per interval.
+type rateLimit struct {
+	mut      sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimit(interval time.Duration) *rateLimit {
+	if interval <= 0 {
+		interval = time.Second / 4
+	}
+	return &rateLimit{
+		mut:      sync.NewMutex(),
+		interval: interval,
+	}
+}
+
+// allow returns true if the interval has passed since it last did.
+func (r *rateLimit) allow() bool {
+	now := timeNow()
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if now.Before(r.next) {
+		return false
+	}
+	r.next = now.Add(r.interval)
+	return true
+}
+
+// pendingDirs keeps track of the changed directories that have not been
+// emitted yet, as they may turn out to be empty. As the walk is depth
+// first, a pending directory that is not a parent of the current item has
+// been walked in full without finding anything and can be forgotten.
+type pendingDirs struct {
+	mut  sync.Mutex
+	dirs []protocol.FileInfo
+}
+
+func newPendingDirs() *pendingDirs {
+	return &pendingDirs{
+		mut: sync.NewMutex(),
+	}
+}
+
+// enter prunes the pending directories as we enter the given directory.
+func (p *pendingDirs) enter(relPath string) {
+	p.mut.Lock()
+	p.prune(relPath)
+	p.mut.Unlock()
+}
+
+func (p *pendingDirs) add(f protocol.FileInfo) {
+	p.mut.Lock()
+	p.dirs = append(p.dirs, f)
+	p.mut.Unlock()
+}
+
+// take returns the pending parents of the given item, which is not a
+// directory, and forgets about them.
+func (p *pendingDirs) take(relPath string) []protocol.FileInfo {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.prune(relPath)
+	dirs := p.dirs
+	p.dirs = nil
+	return dirs
+}
+
+// prune drops the directories that are not parents of relPath. Must be
+// called with the mutex held.
+func (p *pendingDirs) prune(relPath string) {
+	kept := p.dirs[:0]
+	for _, d := range p.dirs {
+		if strings.HasPrefix(relPath, d.Name+string(filepath.Separator)) {
+			kept = append(kept, d)
+		}
+	}
+	p.dirs = kept
+}
+
+// osFileInfo implements the fs.FileInfo interface on top of an os.FileInfo,
+// as given by filepath.Walk.
+type osFileInfo struct {
+	os.FileInfo
+}
+
+func (i osFileInfo) Mode() fs.FileMode {
+	return fs.FileMode(i.FileInfo.Mode())
+}
+
+func (i osFileInfo) IsRegular() bool {
+	return i.FileInfo.Mode().IsRegular()
+}
+
+func (i osFileInfo) IsSymlink() bool {
+	return i.FileInfo.Mode()&os.ModeSymlink != 0
+}
+
 func PermsEqual(a, b uint32) bool {
 	switch runtime.GOOS {
 	case "windows":
@@ -530,6 +3040,19 @@ func (c *byteCounter) Close() {
 	close(c.stop)
 }
 
+// workCounter counts the bytes hashed, and the work done hashing them: the
+// bytes weighted by their cost, as per hashCost.
+type workCounter struct {
+	bytes *byteCounter
+	work  *byteCounter
+	cost  float64
+}
+
+func (c workCounter) Update(bytes int64) {
+	c.bytes.Update(bytes)
+	c.work.Update(int64(float64(bytes) * c.cost))
+}
+
 // A no-op CurrentFiler
 
 type noCurrentFiler struct{}
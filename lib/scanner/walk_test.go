@@ -8,18 +8,31 @@ package scanner
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	rdebug "runtime/debug"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/d4l3k/messagediff"
+	"github.com/rcrowley/go-metrics"
+	"github.com/syncthing/syncthing/lib/events"
 	"github.com/syncthing/syncthing/lib/fs"
 	"github.com/syncthing/syncthing/lib/ignore"
 	"github.com/syncthing/syncthing/lib/osutil"
@@ -88,373 +101,5309 @@ func TestWalkSub(t *testing.T) {
 	}
 }
 
-func TestWalk(t *testing.T) {
-	ignores := ignore.New(false)
-	err := ignores.Load("testdata/.stignore")
-	if err != nil {
-		t.Fatal(err)
-	}
-	t.Log(ignores)
-
+func TestWalkSubDone(t *testing.T) {
+	var done []string
 	fchan, err := Walk(Config{
 		Dir:       "testdata",
+		Subs:      []string{"dir1", "dir2"},
 		BlockSize: 128 * 1024,
-		Matcher:   ignores,
 		Hashers:   2,
+		SubDoneFn: func(sub string) { done = append(done, sub) },
 	})
-
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	var tmp []protocol.FileInfo
-	for f := range fchan {
-		tmp = append(tmp, f)
+	for range fchan {
 	}
-	sort.Sort(fileList(tmp))
-	files := fileList(tmp).testfiles()
 
-	if diff, equal := messagediff.PrettyDiff(testdata, files); !equal {
-		t.Errorf("Walk returned unexpected data. Diff:\n%s", diff)
+	if len(done) != 2 || done[0] != "dir1" || done[1] != "dir2" {
+		t.Errorf("unexpected completed subs %v", done)
 	}
 }
 
-func TestWalkError(t *testing.T) {
-	_, err := Walk(Config{
-		Dir:       "testdata-missing",
-		BlockSize: 128 * 1024,
-		Hashers:   2,
-	})
+// fakeDeviceFilesystem reports the directories in mounts as being on
+// another device.
+type fakeDeviceFilesystem struct {
+	fs.Filesystem
+	mounts map[string]bool
+}
 
-	if err == nil {
-		t.Error("no error from missing directory")
+func (f fakeDeviceFilesystem) DeviceID(name string) (uint64, error) {
+	if f.mounts[filepath.Clean(name)] {
+		return 2, nil
 	}
+	return 1, nil
+}
 
-	_, err = Walk(Config{
-		Dir:       "testdata/bar",
-		BlockSize: 128 * 1024,
-	})
+// fakeStreamsFilesystem gives afile an alternate data stream.
+type fakeStreamsFilesystem struct {
+	fs.Filesystem
+}
 
-	if err == nil {
-		t.Error("no error from non-directory")
+func (fakeStreamsFilesystem) Streams(name string) ([]fs.Stream, error) {
+	if filepath.Base(name) == "afile" {
+		return []fs.Stream{{Name: "Zone.Identifier", Size: 26}}, nil
 	}
+	return nil, nil
 }
 
-func TestVerify(t *testing.T) {
-	blocksize := 16
-	// data should be an even multiple of blocksize long
-	data := []byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. Ut e")
-	buf := bytes.NewBuffer(data)
-	progress := newByteCounter()
-	defer progress.Close()
-
-	blocks, err := Blocks(buf, blocksize, -1, progress, false)
+func TestWalkScanADS(t *testing.T) {
+	var mut sync.Mutex
+	reported := make(map[string][]fs.Stream)
+	fchan, err := Walk(Config{
+		Dir:                   "testdata",
+		Subs:                  []string{"afile", "dir1"},
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		Filesystem:            fakeStreamsFilesystem{fs.DefaultFilesystem},
+		ScanADS:               true,
+		StreamsFn: func(relPath string, streams []fs.Stream) {
+			mut.Lock()
+			reported[relPath] = streams
+			mut.Unlock()
+		},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if exp := len(data) / blocksize; len(blocks) != exp {
-		t.Fatalf("Incorrect number of blocks %d != %d", len(blocks), exp)
+	for range fchan {
 	}
 
-	if int64(len(data)) != progress.Total() {
-		t.Fatalf("Incorrect counter value %d  != %d", len(data), progress.Total())
+	expected := map[string][]fs.Stream{
+		"afile":                        {{Name: "Zone.Identifier", Size: 26}},
+		filepath.Join("dir1", "cfile"): nil,
+		filepath.Join("dir1", "dfile"): nil,
 	}
-
-	buf = bytes.NewBuffer(data)
-	err = Verify(buf, blocksize, blocks)
-	t.Log(err)
-	if err != nil {
-		t.Fatal("Unexpected verify failure", err)
+	if diff, equal := messagediff.PrettyDiff(expected, reported); !equal {
+		t.Errorf("unexpected streams:\n%s", diff)
 	}
+}
 
-	buf = bytes.NewBuffer(append(data, '\n'))
-	err = Verify(buf, blocksize, blocks)
-	t.Log(err)
-	if err == nil {
-		t.Fatal("Unexpected verify success")
+func TestWalkSingleFilesystem(t *testing.T) {
+	filesystem := fakeDeviceFilesystem{
+		Filesystem: fs.DefaultFilesystem,
+		mounts:     map[string]bool{filepath.Join("testdata", "dir2"): true},
 	}
 
-	buf = bytes.NewBuffer(data[:len(data)-1])
-	err = Verify(buf, blocksize, blocks)
-	t.Log(err)
-	if err == nil {
-		t.Fatal("Unexpected verify success")
+	fchan, err := Walk(Config{
+		Dir:              "testdata",
+		BlockSize:        128 * 1024,
+		Hashers:          2,
+		Filesystem:       filesystem,
+		SingleFilesystem: true,
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	data[42] = 42
-	buf = bytes.NewBuffer(data)
-	err = Verify(buf, blocksize, blocks)
-	t.Log(err)
-	if err == nil {
-		t.Fatal("Unexpected verify success")
+	var sawDir1 bool
+	for f := range fchan {
+		if f.Name == "dir2" || strings.HasPrefix(f.Name, "dir2"+string(filepath.Separator)) {
+			t.Errorf("unexpected item %q on another filesystem", f.Name)
+		}
+		if f.Name == "dir1" {
+			sawDir1 = true
+		}
+	}
+	if !sawDir1 {
+		t.Error("dir1 was not scanned")
 	}
 }
 
-func TestNormalization(t *testing.T) {
-	if runtime.GOOS == "darwin" {
-		t.Skip("Normalization test not possible on darwin")
-		return
+func TestWalkDeterministic(t *testing.T) {
+	walkNames := func(progressInterval int) []string {
+		fchan, err := Walk(Config{
+			Dir:                   "testdata",
+			BlockSize:             128 * 1024,
+			Hashers:               4,
+			ProgressTickIntervalS: progressInterval,
+			Deterministic:         true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for f := range fchan {
+			names = append(names, f.Name)
+		}
+		return names
 	}
 
-	os.RemoveAll("testdata/normalization")
-	defer os.RemoveAll("testdata/normalization")
+	// The walk is in lexical order, so that is also the output order.
+	var expected []string
+	filepath.Walk("testdata", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel("testdata", path)
+		if rel == "." {
+			return nil
+		}
+		if !ignore.IsInternal(rel) {
+			expected = append(expected, rel)
+		}
+		return nil
+	})
 
-	tests := []string{
-		"0-A",            // ASCII A -- accepted
-		"1-\xC3\x84",     // NFC 'Ä' -- conflicts with the entry below, accepted
-		"1-\x41\xCC\x88", // NFD 'Ä' -- conflicts with the entry above, ignored
-		"2-\xC3\x85",     // NFC 'Å' -- accepted
-		"3-\x41\xCC\x83", // NFD 'Ã' -- converted to NFC
-		"4-\xE2\x98\x95", // U+2615 HOT BEVERAGE (☕) -- accepted
-		"5-\xCD\xE2",     // EUC-CN "wài" (外) -- ignored (not UTF8)
+	for _, interval := range []int{-1, 0} {
+		names := walkNames(interval)
+		if len(names) != len(expected) {
+			t.Fatalf("incorrect number of items %d != %d", len(names), len(expected))
+		}
+		for i := range names {
+			if names[i] != expected[i] {
+				t.Errorf("item %d is %q, not %q", i, names[i], expected[i])
+			}
+		}
 	}
-	numInvalid := 2
+}
 
-	if runtime.GOOS == "windows" {
-		// On Windows, in case 5 the character gets replaced with a
-		// replacement character \xEF\xBF\xBD at the point it's written to disk,
-		// which means it suddenly becomes valid (sort of).
-		numInvalid--
+func TestWalkMetricsRegistry(t *testing.T) {
+	registry := metrics.NewRegistry()
+	fchan, err := Walk(Config{
+		Dir:             "testdata",
+		BlockSize:       128 * 1024,
+		Hashers:         2,
+		MetricsRegistry: registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
 	}
 
-	numValid := len(tests) - numInvalid
-
-	for _, s1 := range tests {
-		// Create a directory for each of the interesting strings above
-		if err := osutil.MkdirAll(filepath.Join("testdata/normalization", s1), 0755); err != nil {
-			t.Fatal(err)
+	// Everything is back to zero once the walk is complete.
+	for _, name := range []string{"scanner.queued", "scanner.hashers.active", "scanner.hashers.idle"} {
+		c, ok := registry.Get(name).(metrics.Counter)
+		if !ok {
+			t.Errorf("%s is not registered", name)
+			continue
 		}
-
-		for _, s2 := range tests {
-			// Within each dir, create a file with each of the interesting
-			// file names. Ensure that the file doesn't exist when it's
-			// created. This detects and fails if there's file name
-			// normalization stuff at the filesystem level.
-			if fd, err := os.OpenFile(filepath.Join("testdata/normalization", s1, s2), os.O_CREATE|os.O_EXCL, 0644); err != nil {
-				t.Fatal(err)
-			} else {
-				fd.WriteString("test")
-				fd.Close()
-			}
+		if c.Count() != 0 {
+			t.Errorf("%s is %d, not zero", name, c.Count())
 		}
 	}
 
-	// We can normalize a directory name, but we can't descend into it in the
-	// same pass due to how filepath.Walk works. So we run the scan twice to
-	// make sure it all gets done. In production, things will be correct
-	// eventually...
-
-	_, err := walkDir("testdata/normalization")
+	// A walker hashing small files itself counts as a hasher while it
+	// does, next to the idle one.
+	registry = metrics.NewRegistry()
+	var once sync.Once
+	fchan, err = Walk(Config{
+		Dir:                   "testdata",
+		BlockSize:             128 * 1024,
+		Hashers:               1,
+		ProgressTickIntervalS: -1,
+		MetricsRegistry:       registry,
+		BlockFn: func(relPath string, blockIndex int, hash []byte, offset, size int64) {
+			once.Do(func() {
+				active := registry.Get("scanner.hashers.active").(metrics.Counter)
+				idle := registry.Get("scanner.hashers.idle").(metrics.Counter)
+				for start := time.Now(); active.Count() != 1 || idle.Count() != 1; {
+					if time.Since(start) > 2*time.Second {
+						t.Errorf("%d active and %d idle hashers, expected one each", active.Count(), idle.Count())
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			})
+		},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	tmp, err := walkDir("testdata/normalization")
-	if err != nil {
-		t.Fatal(err)
+	for range fchan {
 	}
+}
 
-	files := fileList(tmp).testfiles()
+// failingOpenFilesystem fails to open any file.
+type failingOpenFilesystem struct {
+	fs.Filesystem
+}
 
-	// We should have one file per combination, plus the directories
-	// themselves
+func (failingOpenFilesystem) Open(name string) (fs.File, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
 
-	expectedNum := numValid*numValid + numValid
-	if len(files) != expectedNum {
-		t.Errorf("Expected %d files, got %d", expectedNum, len(files))
+func TestWalkPlaceholderOnHashError(t *testing.T) {
+	var errs []ScanError
+	fchan, err := Walk(Config{
+		Dir:                        "testdata",
+		Subs:                       []string{"afile"},
+		BlockSize:                  128 * 1024,
+		Hashers:                    2,
+		Filesystem:                 failingOpenFilesystem{fs.DefaultFilesystem},
+		EmitPlaceholderOnHashError: true,
+		ErrorFn:                    func(e ScanError) { errs = append(errs, e) },
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// The file names should all be in NFC form.
+	var files []protocol.FileInfo
+	for f := range fchan {
+		files = append(files, f)
+	}
 
-	for _, f := range files {
-		t.Logf("%q (% x) %v", f.name, f.name, norm.NFC.IsNormalString(f.name))
-		if !norm.NFC.IsNormalString(f.name) {
-			t.Errorf("File name %q is not NFC normalized", f.name)
-		}
+	if len(files) != 1 {
+		t.Fatalf("expected one file, not %d", len(files))
+	}
+	f := files[0]
+	if f.Name != "afile" || !f.Invalid || len(f.Blocks) != 0 || f.Size != 4 {
+		t.Errorf("unexpected placeholder %v", f)
+	}
+	if len(errs) != 1 || errs[0].Path != "afile" || !os.IsPermission(errs[0].Err) {
+		t.Errorf("unexpected errors %v", errs)
 	}
 }
 
-func TestIssue1507(t *testing.T) {
-	w := &walker{}
-	c := make(chan protocol.FileInfo, 100)
-	fn := w.walkAndHashFiles(c, c)
+var errFakeLocked = errors.New("locked")
 
-	fn("", nil, protocol.ErrClosed)
+// lockedFilesystem fails to open files while locks is above zero, counting
+// it down with every attempt.
+type lockedFilesystem struct {
+	fs.Filesystem
+	locks *int32
 }
 
-func TestWalkSymlinkUnix(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("skipping unsupported symlink test")
-		return
+func (f lockedFilesystem) Open(name string) (fs.File, error) {
+	if atomic.AddInt32(f.locks, -1) >= 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errFakeLocked}
 	}
+	return f.Filesystem.Open(name)
+}
 
-	// Create a folder with a symlink in it
+func TestWalkRetryLockedFiles(t *testing.T) {
+	defer func(fn func(error) bool) { lockedFile = fn }(lockedFile)
+	lockedFile = func(err error) bool {
+		if perr, ok := err.(*os.PathError); ok {
+			err = perr.Err
+		}
+		return err == errFakeLocked
+	}
 
-	os.RemoveAll("_symlinks")
-	defer os.RemoveAll("_symlinks")
+	walk := func(locks int32) ([]protocol.FileInfo, []ScanError) {
+		var errs []ScanError
+		fchan, err := Walk(Config{
+			Dir:                   "testdata",
+			Subs:                  []string{"afile"},
+			BlockSize:             128 * 1024,
+			Hashers:               1,
+			ProgressTickIntervalS: -1,
+			Filesystem:            lockedFilesystem{fs.DefaultFilesystem, &locks},
+			RetryLockedFiles:      2,
+			RetryLockedDelay:      time.Millisecond,
+			ErrorFn:               func(e ScanError) { errs = append(errs, e) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		return files, errs
+	}
 
-	os.Mkdir("_symlinks", 0755)
-	os.Symlink("destination", "_symlinks/link")
+	// Unlocked after the second retry.
+	files, errs := walk(2)
+	if len(files) != 1 || files[0].Invalid || len(files[0].Blocks) != 1 {
+		t.Errorf("expected the file to be hashed, got %v", files)
+	}
+	if len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
 
-	// Scan it
+	// Still locked after all retries.
+	files, errs = walk(3)
+	if len(files) != 1 || !files[0].Invalid || len(files[0].Blocks) != 0 {
+		t.Errorf("expected a placeholder, got %v", files)
+	}
+	if len(errs) != 1 || errs[0].Path != "afile" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
 
-	fchan, err := Walk(Config{
-		Dir:       "_symlinks",
-		BlockSize: 128 * 1024,
-	})
+// clockFilesystem moves the clock forward by an hour whenever a file is
+// opened.
+type clockFilesystem struct {
+	fs.Filesystem
+	now *int64
+}
+
+func (f clockFilesystem) Open(name string) (fs.File, error) {
+	atomic.AddInt64(f.now, int64(time.Hour))
+	return f.Filesystem.Open(name)
+}
 
+func TestWalkDeadline(t *testing.T) {
+	start := time.Now()
+	var offset int64
+	timeNow = func() time.Time { return start.Add(time.Duration(atomic.LoadInt64(&offset))) }
+	defer func() { timeNow = time.Now }()
+
+	var mut sync.Mutex
+	var errs []ScanError
+	fchan, control, err := WalkWithControl(Config{
+		Dir:        "testdata",
+		Subs:       []string{"dir1", "dir2"},
+		BlockSize:  128 * 1024,
+		Hashers:    1,
+		Filesystem: clockFilesystem{fs.DefaultFilesystem, &offset},
+		Deadline:   start.Add(time.Minute),
+		ErrorFn: func(e ScanError) {
+			mut.Lock()
+			errs = append(errs, e)
+			mut.Unlock()
+		},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var files []protocol.FileInfo
+	// The walk is complete before anything is hashed. The first file is
+	// hashed, moving the clock past the deadline. The second one is
+	// waiting for the hasher by then and the rest are not handed out.
+	var files []string
 	for f := range fchan {
-		files = append(files, f)
+		if !f.IsDirectory() {
+			files = append(files, f.Name)
+		}
 	}
-
-	// Verify that we got one symlink and with the correct attributes
-
-	if len(files) != 1 {
-		t.Errorf("expected 1 symlink, not %d", len(files))
+	if len(files) != 1 || files[0] != filepath.Join("dir1", "cfile") {
+		t.Errorf("unexpected files %v", files)
 	}
-	if len(files[0].Blocks) != 0 {
-		t.Errorf("expected zero blocks for symlink, not %d", len(files[0].Blocks))
+	var dropped []string
+	for _, e := range errs {
+		if e.Err != errDeadline {
+			t.Errorf("unexpected error %v", e)
+		}
+		dropped = append(dropped, e.Path)
 	}
-	if files[0].SymlinkTarget != "destination" {
-		t.Errorf("expected symlink to have target destination, not %q", files[0].SymlinkTarget)
+	sort.Strings(dropped)
+	expected := []string{filepath.Join("dir1", "dfile"), filepath.Join("dir2", "cfile"), filepath.Join("dir2", "dfile")}
+	if strings.Join(dropped, ",") != strings.Join(expected, ",") {
+		t.Errorf("dropped %v, expected %v", dropped, expected)
+	}
+	if !control.Truncated() {
+		t.Error("walk should be truncated")
 	}
 }
 
-func TestWalkSymlinkWindows(t *testing.T) {
-	if runtime.GOOS != "windows" {
-		t.Skip("skipping unsupported symlink test")
-	}
+func TestWalkEnterDirFn(t *testing.T) {
+	defer func() { timeNow = time.Now }()
 
-	// Create a folder with a symlink in it
+	walk := func() (entered, dirs []string) {
+		var mut sync.Mutex
+		fchan, err := Walk(Config{
+			Dir:              "testdata",
+			BlockSize:        128 * 1024,
+			Hashers:          2,
+			EnterDirInterval: time.Second,
+			EnterDirFn: func(relPath string) {
+				mut.Lock()
+				entered = append(entered, relPath)
+				mut.Unlock()
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for f := range fchan {
+			if f.IsDirectory() {
+				dirs = append(dirs, f.Name)
+			}
+		}
+		sort.Strings(entered)
+		sort.Strings(dirs)
+		return entered, dirs
+	}
 
-	os.RemoveAll("_symlinks")
-	defer os.RemoveAll("_symlinks")
+	// With the clock moving a second at a time, all directories are
+	// reported.
+	var offset int64
+	start := time.Now()
+	timeNow = func() time.Time {
+		return start.Add(time.Duration(atomic.AddInt64(&offset, int64(time.Second))))
+	}
+	entered, dirs := walk()
+	if len(dirs) == 0 || strings.Join(entered, ",") != strings.Join(dirs, ",") {
+		t.Errorf("entered %v, expected %v", entered, dirs)
+	}
 
-	os.Mkdir("_symlinks", 0755)
-	if err := os.Symlink("destination", "_symlinks/link"); err != nil {
-		// Probably we require permissions we don't have.
-		t.Skip(err)
+	// With the clock standing still, only the first one is.
+	timeNow = func() time.Time { return start }
+	entered, _ = walk()
+	if len(entered) != 1 {
+		t.Errorf("expected one directory to be reported, not %v", entered)
 	}
+}
 
-	// Scan it
+func TestWalkMemoryLimit(t *testing.T) {
+	defer func(d time.Duration) { memorySampleInterval = d }(memorySampleInterval)
+	memorySampleInterval = time.Millisecond
 
+	usage := int64(200)
 	fchan, err := Walk(Config{
-		Dir:       "_symlinks",
-		BlockSize: 128 * 1024,
+		Dir:                   "testdata",
+		BlockSize:             128 * 1024,
+		Hashers:               4,
+		ProgressTickIntervalS: -1,
+		MemoryLimit:           100,
+		MemoryFn:              func() int64 { return atomic.LoadInt64(&usage) },
 	})
-
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var files []protocol.FileInfo
-	for f := range fchan {
-		files = append(files, f)
+	// Over the limit, nothing is walked.
+	select {
+	case f := <-fchan:
+		t.Fatalf("got %v while over the memory limit", f)
+	case <-time.After(50 * time.Millisecond):
 	}
 
-	// Verify that we got zero symlinks
+	// Still nothing just under the limit.
+	atomic.StoreInt64(&usage, 95)
+	select {
+	case f := <-fchan:
+		t.Fatalf("got %v while close to the memory limit", f)
+	case <-time.After(50 * time.Millisecond):
+	}
 
-	if len(files) != 0 {
-		t.Errorf("expected zero symlinks, not %d", len(files))
+	// Well under the limit, the walk completes.
+	atomic.StoreInt64(&usage, 50)
+	var files int
+	for range fchan {
+		files++
+	}
+	if files == 0 {
+		t.Error("nothing was walked")
 	}
 }
 
-func walkDir(dir string) ([]protocol.FileInfo, error) {
-	fchan, err := Walk(Config{
-		Dir:           dir,
-		BlockSize:     128 * 1024,
-		AutoNormalize: true,
-		Hashers:       2,
-	})
+func TestWalkFutureModTime(t *testing.T) {
+	info, err := os.Stat("testdata/afile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend afile will be modified in an hour.
+	now := info.ModTime().Add(-time.Hour)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	walkFiles := func(clamp bool, cf CurrentFiler) ([]protocol.FileInfo, []ScanError) {
+		var errs []ScanError
+		fchan, err := Walk(Config{
+			Dir:                   "testdata",
+			Subs:                  []string{"afile"},
+			BlockSize:             128 * 1024,
+			Hashers:               2,
+			ProgressTickIntervalS: -1,
+			CurrentFiler:          cf,
+			ClampFutureMtimes:     clamp,
+			ErrorFn:               func(e ScanError) { errs = append(errs, e) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		return files, errs
+	}
+
+	files, errs := walkFiles(false, nil)
+	if len(files) != 1 || !files[0].ModTime().Equal(info.ModTime()) {
+		t.Errorf("expected afile with its own modification time, not %v", files)
+	}
+	if len(errs) != 1 || errs[0].Err != errFutureModTime {
+		t.Errorf("expected the future modification time to be reported, not %v", errs)
+	}
+
+	files, errs = walkFiles(true, nil)
+	if len(files) != 1 || !files[0].ModTime().Equal(now) {
+		t.Fatalf("expected afile with the current time, not %v", files)
+	}
+	if len(errs) != 1 || errs[0].Err != errFutureModTime {
+		t.Errorf("expected the future modification time to be reported, not %v", errs)
+	}
+
+	// Next time around it's unchanged.
+	now = now.Add(time.Minute)
+	files, _ = walkFiles(true, fakeCurrentFiler{"afile": files[0]})
+	if len(files) != 0 {
+		t.Errorf("afile should be unchanged, not %v", files)
+	}
+}
 
+func TestWalkMinFileAge(t *testing.T) {
+	info, err := os.Stat("testdata/afile")
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
 
-	var tmp []protocol.FileInfo
+	// Pretend afile was modified a minute ago.
+	timeNow = func() time.Time { return info.ModTime().Add(time.Minute) }
+	defer func() { timeNow = time.Now }()
+
+	walkFiles := func(minAge time.Duration) ([]protocol.FileInfo, map[string]time.Time) {
+		deferred := make(map[string]time.Time)
+		fchan, err := Walk(Config{
+			Dir:        "testdata",
+			Subs:       []string{"afile", "dir1"},
+			BlockSize:  128 * 1024,
+			Hashers:    2,
+			MinFileAge: minAge,
+			DeferredFn: func(relPath string, readyAt time.Time) { deferred[relPath] = readyAt },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		return files, deferred
+	}
+
+	files, deferred := walkFiles(30 * time.Second)
+	var scanned bool
+	for _, f := range files {
+		if f.Name == "afile" {
+			scanned = true
+		}
+	}
+	if !scanned {
+		t.Error("afile should have been scanned")
+	}
+	if len(deferred) != 0 {
+		t.Errorf("unexpected deferred files %v", deferred)
+	}
+
+	files, deferred = walkFiles(time.Hour)
+	for _, f := range files {
+		if f.Name == "afile" {
+			t.Error("afile should have been deferred")
+		}
+	}
+	if readyAt, ok := deferred["afile"]; !ok || !readyAt.Equal(info.ModTime().Add(time.Hour)) {
+		t.Errorf("afile not deferred until the right time: %v", deferred)
+	}
+}
+
+func TestNewWalkFunc(t *testing.T) {
+	walkFn, fchan, finish, err := NewWalkFunc(Config{
+		Dir:       "testdata",
+		BlockSize: 128 * 1024,
+		Hashers:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		filepath.Walk(filepath.Join("testdata", "dir1"), walkFn)
+		finish()
+	}()
+
+	var names []string
 	for f := range fchan {
-		tmp = append(tmp, f)
+		names = append(names, f.Name)
 	}
-	sort.Sort(fileList(tmp))
+	sort.Strings(names)
 
-	return tmp, nil
+	expected := []string{"dir1", filepath.Join("dir1", "cfile"), filepath.Join("dir1", "dfile")}
+	if len(names) != len(expected) {
+		t.Fatalf("unexpected items %v", names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("item %d is %q, not %q", i, names[i], expected[i])
+		}
+	}
 }
 
-type fileList []protocol.FileInfo
+func TestWalkDirHashes(t *testing.T) {
+	os.RemoveAll("_dirhashes")
+	defer os.RemoveAll("_dirhashes")
 
-func (l fileList) Len() int {
-	return len(l)
+	for _, name := range []string{"a/b/file1", "a/file2", "c/file3", "-d/file4"} {
+		path := filepath.Join("_dirhashes", filepath.FromSlash(name))
+		if err := osutil.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walkHashes := func(cf CurrentFiler) (map[string][]byte, []string) {
+		hashes := make(map[string][]byte)
+		var order []string
+		fchan, err := Walk(Config{
+			Dir:          "_dirhashes",
+			BlockSize:    128 * 1024,
+			Hashers:      2,
+			CurrentFiler: cf,
+			DirHashFn: func(relPath string, hash []byte) {
+				hashes[relPath] = hash
+				order = append(order, relPath)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range fchan {
+		}
+		return hashes, order
+	}
+
+	first, order := walkHashes(nil)
+	expected := []string{filepath.Join("a", "b"), "-d", "a", "c", "."}
+	if len(order) != len(expected) {
+		t.Fatalf("unexpected directories %v", order)
+	}
+	for i := range order {
+		if order[i] != expected[i] {
+			t.Errorf("directory %d is %q, not %q", i, order[i], expected[i])
+		}
+	}
+
+	// A rescan where nothing has changed, and thus nothing is hashed,
+	// results in the same hashes.
+
+	cf := make(fakeCurrentFiler)
+	fchan, err := Walk(Config{Dir: "_dirhashes", BlockSize: 128 * 1024, Hashers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f := range fchan {
+		cf[f.Name] = f
+	}
+	second, _ := walkHashes(cf)
+	for name, hash := range first {
+		if !bytes.Equal(second[name], hash) {
+			t.Errorf("hash of %q changed on unchanged rescan", name)
+		}
+	}
+
+	// Changing a file changes the hashes of its parents only.
+
+	if err := ioutil.WriteFile(filepath.Join("_dirhashes", "a", "b", "file1"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	third, _ := walkHashes(nil)
+	for _, name := range []string{filepath.Join("a", "b"), "a", "."} {
+		if bytes.Equal(third[name], first[name]) {
+			t.Errorf("hash of %q did not change", name)
+		}
+	}
+	if !bytes.Equal(third["c"], first["c"]) {
+		t.Error("hash of c changed")
+	}
 }
 
-func (l fileList) Less(a, b int) bool {
-	return l[a].Name < l[b].Name
+func TestNewWalkFuncDirHashes(t *testing.T) {
+	var dirs []string
+	walkFn, fchan, finish, err := NewWalkFunc(Config{
+		Dir:       "testdata",
+		BlockSize: 128 * 1024,
+		Hashers:   2,
+		DirHashFn: func(relPath string, hash []byte) {
+			dirs = append(dirs, relPath)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		filepath.Walk(filepath.Join("testdata", "dir1"), walkFn)
+		finish()
+	}()
+	for range fchan {
+	}
+
+	// Only part of the folder was walked, so there's no root hash.
+	if !reflect.DeepEqual(dirs, []string{"dir1"}) {
+		t.Errorf("unexpected directory hashes for %v", dirs)
+	}
 }
 
-func (l fileList) Swap(a, b int) {
-	l[a], l[b] = l[b], l[a]
+func TestWalkDetectSparse(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("allocated size is not available on Windows")
+	}
+
+	os.RemoveAll("_sparse")
+	defer os.RemoveAll("_sparse")
+	os.Mkdir("_sparse", 0755)
+
+	// A file with a large hole in the middle.
+	fd, err := os.Create("_sparse/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte("start"))
+	fd.WriteAt([]byte("end"), 16<<20)
+	fd.Close()
+	if err := ioutil.WriteFile("_sparse/dense", bytes.Repeat([]byte("x"), 64<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	type allocation struct {
+		sparse    bool
+		allocated int64
+	}
+	var mut sync.Mutex
+	allocations := make(map[string]allocation)
+	fchan, err := Walk(Config{
+		Dir:          "_sparse",
+		BlockSize:    128 * 1024,
+		Hashers:      2,
+		DetectSparse: true,
+		AllocationFn: func(relPath string, sparse bool, allocated int64) {
+			mut.Lock()
+			allocations[relPath] = allocation{sparse, allocated}
+			mut.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+
+	if a := allocations["dense"]; a.sparse || a.allocated < 64<<10 {
+		t.Errorf("dense file reported as %+v", a)
+	}
+	// Not all filesystems support holes, so this can only be checked if
+	// the file actually turned out sparse.
+	if a, ok := allocations["sparse"]; !ok {
+		t.Error("sparse file not reported")
+	} else if a.allocated < 16<<20 && !a.sparse {
+		t.Errorf("sparse file reported as %+v", a)
+	}
 }
 
-func (l fileList) testfiles() testfileList {
-	testfiles := make(testfileList, len(l))
-	for i, f := range l {
-		if len(f.Blocks) > 1 {
-			panic("simple test case stuff only supports a single block per file")
+func TestWalkSkipEmptyDirs(t *testing.T) {
+	os.RemoveAll("_emptydirs")
+	defer os.RemoveAll("_emptydirs")
+
+	for _, dir := range []string{"empty", "nested/empty", "full/sub", "ignored"} {
+		if err := osutil.MkdirAll(filepath.Join("_emptydirs", filepath.FromSlash(dir)), 0755); err != nil {
+			t.Fatal(err)
 		}
-		testfiles[i] = testfile{name: f.Name, length: f.FileSize()}
-		if len(f.Blocks) == 1 {
-			testfiles[i].hash = fmt.Sprintf("%x", f.Blocks[0].Hash)
+	}
+	for _, file := range []string{"full/sub/file", "ignored/file"} {
+		if err := ioutil.WriteFile(filepath.Join("_emptydirs", filepath.FromSlash(file)), []byte("test"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ignores := ignore.New(false)
+	if err := ignores.Parse(bytes.NewBufferString("ignored/file\n"), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+
+	fchan, err := Walk(Config{
+		Dir:           "_emptydirs",
+		BlockSize:     128 * 1024,
+		Hashers:       2,
+		Matcher:       ignores,
+		SkipEmptyDirs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for f := range fchan {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+
+	expected := []string{"full", filepath.Join("full", "sub"), filepath.Join("full", "sub", "file")}
+	if len(names) != len(expected) {
+		t.Fatalf("unexpected items %v", names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("item %d is %q, not %q", i, names[i], expected[i])
 		}
 	}
-	return testfiles
 }
 
-func (l testfileList) String() string {
-	var b bytes.Buffer
-	b.WriteString("{\n")
-	for _, f := range l {
-		fmt.Fprintf(&b, "  %s (%d bytes): %s\n", f.name, f.length, f.hash)
+func TestWalkFileSizeBand(t *testing.T) {
+	os.RemoveAll("_sizeband")
+	defer os.RemoveAll("_sizeband")
+	os.Mkdir("_sizeband", 0755)
+
+	sizes := map[string]int{"small": 1, "medium": 10, "large": 100}
+	for name, size := range sizes {
+		if err := ioutil.WriteFile(filepath.Join("_sizeband", name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(policy FileSizePolicy) map[string]protocol.FileInfo {
+		fchan, err := Walk(Config{
+			Dir:            "_sizeband",
+			BlockSize:      128 * 1024,
+			Hashers:        2,
+			MinFileSize:    5,
+			MaxFileSize:    50,
+			FileSizePolicy: policy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]protocol.FileInfo)
+		for f := range fchan {
+			files[f.Name] = f
+		}
+		return files
+	}
+
+	files := walk(FileSizeMetadataOnly)
+	for _, name := range []string{"small", "large"} {
+		if f, ok := files[name]; !ok || !f.Invalid || len(f.Blocks) != 0 || f.Size != int64(sizes[name]) {
+			t.Errorf("%s was not returned as metadata only: %v", name, f)
+		}
+	}
+	if f := files["medium"]; f.Invalid || len(f.Blocks) != 1 {
+		t.Errorf("medium was not hashed: %v", f)
+	}
+
+	files = walk(FileSizeSkip)
+	if _, ok := files["small"]; ok {
+		t.Error("small should be skipped")
+	}
+	if _, ok := files["large"]; ok {
+		t.Error("large should be skipped")
+	}
+	if f := files["medium"]; f.Invalid || len(f.Blocks) != 1 {
+		t.Errorf("medium was not hashed: %v", f)
 	}
-	b.WriteString("}")
-	return b.String()
 }
 
-var initOnce sync.Once
+func TestWalkNoHashExtensions(t *testing.T) {
+	os.RemoveAll("_nohash")
+	defer os.RemoveAll("_nohash")
+	os.Mkdir("_nohash", 0755)
 
-const (
-	testdataSize = 17 << 20
-	testdataName = "_random.data"
-)
+	for _, name := range []string{"image.ISO", "disk.vmdk", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join("_nohash", name), []byte("test"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-func BenchmarkHashFile(b *testing.B) {
-	initOnce.Do(initTestFile)
-	b.ResetTimer()
+	fchan, err := Walk(Config{
+		Dir:              "_nohash",
+		BlockSize:        128 * 1024,
+		Hashers:          2,
+		NoHashExtensions: []string{"iso", ".vmdk"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	for i := 0; i < b.N; i++ {
-		if _, err := HashFile(fs.DefaultFilesystem, testdataName, protocol.BlockSize, nil, true); err != nil {
-			b.Fatal(err)
+	files := make(map[string]protocol.FileInfo)
+	for f := range fchan {
+		files[f.Name] = f
+	}
+
+	for _, name := range []string{"image.ISO", "disk.vmdk"} {
+		f, ok := files[name]
+		if !ok {
+			t.Errorf("%s is missing", name)
+			continue
 		}
+		if !f.Invalid || len(f.Blocks) != 0 || f.Size != 4 {
+			t.Errorf("%s was not returned as metadata only: %v", name, f)
+		}
+	}
+	if f := files["notes.txt"]; f.Invalid || len(f.Blocks) != 1 {
+		t.Errorf("notes.txt was not hashed: %v", f)
 	}
 
-	b.SetBytes(testdataSize)
-	b.ReportAllocs()
+	// The metadata only entries are not changed on rescan.
+
+	fchan, err = Walk(Config{
+		Dir:              "_nohash",
+		BlockSize:        128 * 1024,
+		Hashers:          2,
+		CurrentFiler:     fakeCurrentFiler(files),
+		NoHashExtensions: []string{"iso", ".vmdk"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f := range fchan {
+		t.Errorf("unexpected rescanned file %v", f)
+	}
 }
 
-func initTestFile() {
-	fd, err := os.Create(testdataName)
+func TestWalkReportsErrors(t *testing.T) {
+	var errs []ScanError
+	w := newWalker(Config{
+		Dir:     "testdata",
+		ErrorFn: func(e ScanError) { errs = append(errs, e) },
+	})
+	walkFn := w.walkAndHashFiles(nil, nil)
+
+	// The walk is told about a directory that can't be read and a file
+	// that can't be stat'ed. Neither stops it.
+
+	info, err := w.Filesystem.Lstat(filepath.Join("testdata", "dir1"))
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	if err := walkFn(filepath.Join("testdata", "dir1"), info, os.ErrPermission); err != fs.SkipDir {
+		t.Errorf("unexpected return %v for unreadable directory", err)
+	}
+	if err := walkFn(filepath.Join("testdata", "dir2", "cfile"), nil, os.ErrPermission); err != nil {
+		t.Errorf("unexpected return %v for unreadable file", err)
 	}
 
-	lr := io.LimitReader(rand.Reader, testdataSize)
-	if _, err := io.Copy(fd, lr); err != nil {
-		panic(err)
+	if len(errs) != 2 || errs[0].Path != "dir1" || errs[1].Path != filepath.Join("dir2", "cfile") {
+		t.Errorf("unexpected errors %v", errs)
 	}
+}
 
-	if err := fd.Close(); err != nil {
-		panic(err)
+func TestEstimateScan(t *testing.T) {
+	cfg := Config{
+		Dir:       "testdata",
+		Subs:      []string{"dir1", "afile"},
+		BlockSize: 128 * 1024,
+		Hashers:   2,
+	}
+
+	plan, err := EstimateScan(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected ScanPlan
+	for f := range fchan {
+		if f.IsDirectory() {
+			continue
+		}
+		expected.Files++
+		expected.Bytes += f.Size
+	}
+
+	if expected.Files == 0 || plan != expected {
+		t.Errorf("estimated %+v, not %+v", plan, expected)
+	}
+}
+
+func TestEstimateScanCallbacks(t *testing.T) {
+	missing := filepath.Join("dir1", "missing")
+	cf := &fakeMissingCurrentFiler{
+		fakeCurrentFiler: fakeCurrentFiler{
+			missing: protocol.FileInfo{Name: missing},
+			"dir2":  protocol.FileInfo{Name: "dir2", Type: protocol.FileInfoTypeFile, Permissions: 0644},
+		},
+		missing: map[string]time.Time{"dir2": time.Now().Add(-time.Hour)},
+	}
+	cfg := Config{
+		Dir:               "testdata",
+		Subs:              []string{missing, "dir1", "dir2"},
+		BlockSize:         128 * 1024,
+		CurrentFiler:      cf,
+		EmitDeletes:       true,
+		DeleteGracePeriod: time.Minute,
+		ExtraDigests:      []DigestType{DigestMD5},
+		DetectSparse:      true,
+		ScanADS:           true,
+		ContentDedup:      true,
+		EnterDirInterval:  time.Nanosecond,
+		MinFileAge:        time.Hour,
+	}
+
+	// These decide what has changed, and so are called.
+	deciding := map[string]bool{
+		"ContentSniffFilter": true,
+		"IsInternal":         true,
+		"SymlinkPolicyFn":    true,
+		"UnchangedFn":        true,
+		"ModTimeFn":          true,
+		"DecompressFilter":   true,
+	}
+	var mut sync.Mutex
+	var called []string
+	v := reflect.ValueOf(&cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Type.Kind() != reflect.Func || deciding[field.Name] {
+			continue
+		}
+		name := field.Name
+		v.Field(i).Set(reflect.MakeFunc(field.Type, func(args []reflect.Value) []reflect.Value {
+			mut.Lock()
+			called = append(called, name)
+			mut.Unlock()
+			res := make([]reflect.Value, field.Type.NumOut())
+			for j := range res {
+				res[j] = reflect.Zero(field.Type.Out(j))
+			}
+			return res
+		}))
+	}
+
+	if _, err := EstimateScan(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(called) != 0 {
+		t.Errorf("callbacks called during an estimate: %v", called)
+	}
+	if _, ok := cf.missing["dir2"]; !ok {
+		t.Error("missing items were updated during an estimate")
+	}
+	if _, ok := cf.missing[missing]; ok {
+		t.Error("missing items were updated during an estimate")
+	}
+}
+
+// dirTrackingFilesystem records the directories of files that are opened
+// while files in another directory are still open.
+type dirTrackingFilesystem struct {
+	fs.Filesystem
+	mut     *sync.Mutex
+	open    map[string]int
+	overlap *bool
+}
+
+type dirTrackingFile struct {
+	fs.File
+	fs  dirTrackingFilesystem
+	dir string
+}
+
+func (f dirTrackingFilesystem) Open(name string) (fs.File, error) {
+	fd, err := f.Filesystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(name)
+	f.mut.Lock()
+	for other, n := range f.open {
+		if other != dir && n > 0 {
+			*f.overlap = true
+		}
+	}
+	f.open[dir]++
+	f.mut.Unlock()
+	// Give the other hashers a chance to get in the way.
+	time.Sleep(time.Millisecond)
+	return dirTrackingFile{fd, f, dir}, nil
+}
+
+func (f dirTrackingFile) Close() error {
+	f.fs.mut.Lock()
+	f.fs.open[f.dir]--
+	f.fs.mut.Unlock()
+	return f.File.Close()
+}
+
+func TestWalkSequentialPerDir(t *testing.T) {
+	var overlap bool
+	filesystem := dirTrackingFilesystem{
+		Filesystem: fs.DefaultFilesystem,
+		mut:        new(sync.Mutex),
+		open:       make(map[string]int),
+		overlap:    &overlap,
+	}
+
+	fchan, err := Walk(Config{
+		Dir:                   "testdata",
+		Subs:                  []string{"dir1", "dir2", "dir3"},
+		BlockSize:             128 * 1024,
+		Hashers:               4,
+		ProgressTickIntervalS: -1,
+		Filesystem:            filesystem,
+		SequentialPerDir:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files int
+	for f := range fchan {
+		if !f.IsDirectory() {
+			files++
+		}
+	}
+
+	if files != 6 {
+		t.Errorf("expected 6 files, not %d", files)
+	}
+	if overlap {
+		t.Error("files from different directories were hashed at the same time")
+	}
+}
+
+func TestWalkBlockFn(t *testing.T) {
+	var mut sync.Mutex
+	reported := make(map[string][]protocol.BlockInfo)
+
+	fchan, err := Walk(Config{
+		Dir:                   "testdata",
+		BlockSize:             16,
+		Hashers:               4,
+		ProgressTickIntervalS: -1,
+		BlockFn: func(relPath string, blockIndex int, hash []byte, offset, size int64) {
+			mut.Lock()
+			defer mut.Unlock()
+			blocks := reported[relPath]
+			for len(blocks) <= blockIndex {
+				blocks = append(blocks, protocol.BlockInfo{})
+			}
+			blocks[blockIndex] = protocol.BlockInfo{Hash: hash, Offset: offset, Size: int32(size)}
+			reported[relPath] = blocks
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files int
+	for f := range fchan {
+		if f.IsDirectory() || f.IsSymlink() || f.Size == 0 {
+			continue
+		}
+		files++
+		mut.Lock()
+		blocks := reported[f.Name]
+		mut.Unlock()
+		if len(blocks) != len(f.Blocks) {
+			t.Errorf("%s: reported %d blocks, not %d", f.Name, len(blocks), len(f.Blocks))
+			continue
+		}
+		for i, b := range f.Blocks {
+			if b.Offset != blocks[i].Offset || b.Size != blocks[i].Size || !bytes.Equal(b.Hash, blocks[i].Hash) {
+				t.Errorf("%s: block %d reported as %v, not %v", f.Name, i, blocks[i], b)
+			}
+		}
+	}
+	if files == 0 {
+		t.Error("no files were hashed")
+	}
+}
+
+func TestWalkStreamBlocks(t *testing.T) {
+	os.RemoveAll("_stream")
+	defer os.RemoveAll("_stream")
+
+	os.Mkdir("_stream", 0755)
+	if err := ioutil.WriteFile("_stream/big", bytes.Repeat([]byte("0123456789"), 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("_stream/small", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mut sync.Mutex
+	var streamed []protocol.BlockInfo
+	fchan, err := Walk(Config{
+		Dir:                   "_stream",
+		BlockSize:             16,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		StreamBlocksThreshold: 50,
+		BlockFn: func(relPath string, blockIndex int, hash []byte, offset, size int64) {
+			if relPath != "big" {
+				return
+			}
+			mut.Lock()
+			defer mut.Unlock()
+			if blockIndex != len(streamed) {
+				t.Errorf("block %d out of order", blockIndex)
+			}
+			streamed = append(streamed, protocol.BlockInfo{Hash: hash, Offset: offset, Size: int32(size)})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]protocol.FileInfo)
+	for f := range fchan {
+		files[f.Name] = f
+	}
+
+	if big := files["big"]; big.Size != 100 || len(big.Blocks) != 0 {
+		t.Errorf("big: expected size 100 without blocks, not %d with %d", big.Size, len(big.Blocks))
+	}
+	if small := files["small"]; small.Size != 10 || len(small.Blocks) != 1 {
+		t.Errorf("small: expected size 10 with a block, not %d with %d", small.Size, len(small.Blocks))
+	}
+
+	expected, err := HashFile(fs.DefaultFilesystem, "_stream/big", 16, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mut.Lock()
+	defer mut.Unlock()
+	if diff, equal := messagediff.PrettyDiff(expected, streamed); !equal {
+		t.Errorf("streamed blocks differ:\n%s", diff)
+	}
+}
+
+func TestScanFile(t *testing.T) {
+	f, err := ScanFile(filepath.Join("testdata", "dir2", "dfile"), Config{
+		BlockSize:     128 * 1024,
+		UseWeakHashes: true,
+		IgnorePerms:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "dfile" {
+		t.Errorf("unexpected name %q", f.Name)
+	}
+	if !f.NoPermissions {
+		t.Error("permissions should be ignored")
+	}
+
+	fd, err := os.Open(filepath.Join("testdata", "dir2", "dfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	blocks, err := Blocks(fd, 128*1024, -1, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !BlocksEqual(f.Blocks, blocks) || f.Blocks[0].WeakHash != blocks[0].WeakHash {
+		t.Errorf("unexpected blocks %v, expected %v", f.Blocks, blocks)
+	}
+
+	if _, err := ScanFile("testdata", Config{BlockSize: 128 * 1024}); err == nil {
+		t.Error("scanning a directory should fail")
+	}
+	if _, err := ScanFile(filepath.Join("testdata", "nonexistent"), Config{BlockSize: 128 * 1024}); err == nil {
+		t.Error("scanning a nonexistent file should fail")
+	}
+}
+
+func TestWalkDirsScanned(t *testing.T) {
+	w := newWalker(Config{
+		Dir:                   "testdata",
+		Folder:                "dirs",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+	})
+	fchan, err := w.walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs int64
+	for f := range fchan {
+		if f.IsDirectory() {
+			dirs++
+		}
+	}
+	if scanned := atomic.LoadInt64(&w.dirsScanned); scanned != dirs {
+		t.Errorf("scanned %d directories, expected %d", scanned, dirs)
+	}
+
+	sub := events.Default.Subscribe(events.FolderScanProgress)
+	defer events.Default.Unsubscribe(sub)
+	w.progressEvent(0, 1, 0, -1)
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ev.Data.(map[string]interface{})
+	if data["folder"] != "dirs" || data["dirsScanned"] != dirs {
+		t.Errorf("unexpected event data %v", data)
+	}
+	if _, ok := data["eta"]; ok {
+		t.Errorf("unexpected eta without a rate: %v", data)
+	}
+}
+
+func TestWalkDisableEvents(t *testing.T) {
+	sub := events.Default.Subscribe(events.FolderScanProgress)
+	defer events.Default.Unsubscribe(sub)
+
+	w := newWalker(Config{
+		Dir:           "testdata",
+		Folder:        "noevents",
+		BlockSize:     128 * 1024,
+		Hashers:       2,
+		DisableEvents: true,
+	})
+	w.progressEvent(0, 1, 0, -1)
+	if ev, err := sub.Poll(100 * time.Millisecond); err == nil {
+		t.Errorf("unexpected event %v", ev)
+	}
+}
+
+func TestWalkPriorityPaths(t *testing.T) {
+	fchan, err := Walk(Config{
+		Dir:           "testdata",
+		Subs:          []string{"dir1", "dir2", "dir3"},
+		BlockSize:     128 * 1024,
+		Hashers:       1,
+		PriorityPaths: []string{"dir3", filepath.Join("dir2", "dfile"), "missing"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for f := range fchan {
+		if !f.IsDirectory() {
+			names = append(names, f.Name)
+		}
+	}
+
+	expected := []string{
+		filepath.Join("dir2", "dfile"),
+		filepath.Join("dir3", "cfile"),
+		filepath.Join("dir3", "dfile"),
+		filepath.Join("dir1", "cfile"),
+		filepath.Join("dir1", "dfile"),
+		filepath.Join("dir2", "cfile"),
+	}
+	if diff, equal := messagediff.PrettyDiff(expected, names); !equal {
+		t.Errorf("unexpected hashing order:\n%s", diff)
+	}
+}
+
+// countingHasher hashes as usual, but counts the files and tags the blocks
+// as its own.
+type countingHasher struct {
+	files *int32
+}
+
+func (h countingHasher) Blocks(r io.Reader, blocksize int, sizehint int64, counter Counter, useWeakHashes bool) ([]protocol.BlockInfo, error) {
+	atomic.AddInt32(h.files, 1)
+	blocks, err := Blocks(r, blocksize, sizehint, counter, useWeakHashes)
+	for i := range blocks {
+		blocks[i].WeakHash = 42
+	}
+	return blocks, err
+}
+
+func TestWalkHasherFactory(t *testing.T) {
+	var created, files int32
+	fchan, err := Walk(Config{
+		Dir:                   "testdata",
+		Subs:                  []string{"dir1", "dir2"},
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		HasherFactory: func() Hasher {
+			atomic.AddInt32(&created, 1)
+			return countingHasher{&files}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashed int32
+	for f := range fchan {
+		if f.IsDirectory() {
+			continue
+		}
+		hashed++
+		if len(f.Blocks) != 1 || f.Blocks[0].WeakHash != 42 {
+			t.Errorf("%s: not hashed by the custom hasher: %v", f.Name, f.Blocks)
+		}
+	}
+
+	if created != 2 {
+		t.Errorf("expected a hasher per hasher routine, not %d", created)
+	}
+	if hashed != 4 || files != hashed {
+		t.Errorf("custom hasher saw %d files of %d", files, hashed)
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	var walks int32
+	c := NewCoalescer(Config{
+		Dir:                   "testdata",
+		BlockSize:             128 * 1024,
+		Hashers:               1,
+		ProgressTickIntervalS: -1,
+		CoalesceWindow:        200 * time.Millisecond,
+		HasherFactory: func() Hasher {
+			// Once per walk, with a single hasher.
+			atomic.AddInt32(&walks, 1)
+			return countingHasher{new(int32)}
+		},
+	})
+
+	requests := [][]string{
+		{"dir1"},
+		{"dir2", filepath.Join("dir1", "cfile")},
+		{filepath.Join("dir2", "dfile")},
+	}
+	results := make([][]string, len(requests))
+	var wg sync.WaitGroup
+	for i, subs := range requests {
+		wg.Add(1)
+		go func(i int, subs []string) {
+			defer wg.Done()
+			fchan, err := c.Walk(subs)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for f := range fchan {
+				results[i] = append(results[i], f.Name)
+			}
+			sort.Strings(results[i])
+		}(i, subs)
+	}
+	wg.Wait()
+
+	if walks != 1 {
+		t.Errorf("expected a single walk, not %d", walks)
+	}
+	expected := [][]string{
+		{"dir1", filepath.Join("dir1", "cfile"), filepath.Join("dir1", "dfile")},
+		{filepath.Join("dir1", "cfile"), "dir2", filepath.Join("dir2", "cfile"), filepath.Join("dir2", "dfile")},
+		{filepath.Join("dir2", "dfile")},
+	}
+	if diff, equal := messagediff.PrettyDiff(expected, results); !equal {
+		t.Errorf("unexpected results:\n%s", diff)
+	}
+}
+
+func TestCoalescerOverlap(t *testing.T) {
+	var walks int32
+	cancel := make(chan struct{})
+	c := NewCoalescer(Config{
+		Dir:                   "testdata",
+		BlockSize:             128 * 1024,
+		Hashers:               1,
+		ProgressTickIntervalS: -1,
+		CoalesceWindow:        50 * time.Millisecond,
+		Cancel:                cancel,
+		HasherFactory: func() Hasher {
+			atomic.AddInt32(&walks, 1)
+			return countingHasher{new(int32)}
+		},
+	})
+
+	first, err := c.Walk([]string{"dir1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A walk requested while the first one runs waits for it.
+	second := make(chan chan protocol.FileInfo)
+	go func() {
+		fchan, err := c.Walk([]string{"dir2"})
+		if err != nil {
+			t.Error(err)
+		}
+		second <- fchan
+	}()
+	select {
+	case <-second:
+		t.Fatal("second walk started while the first was running")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	for range first {
+	}
+	var fchan chan protocol.FileInfo
+	select {
+	case fchan = <-second:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second walk not started after the first")
+	}
+	if n := atomic.LoadInt32(&walks); n != 2 {
+		t.Errorf("expected two walks, not %d", n)
+	}
+
+	// Nobody reads the results once cancelled.
+	close(cancel)
+	done := make(chan struct{})
+	go func() {
+		for range fchan {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("results not closed after cancel")
+	}
+}
+
+func TestMergeSubs(t *testing.T) {
+	cases := []struct {
+		subs, merged []string
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}},
+		{[]string{"a", "a"}, []string{"a"}},
+		{[]string{filepath.Join("a", "b"), "a"}, []string{"a"}},
+		{[]string{"ab", "a"}, []string{"ab", "a"}},
+	}
+	for _, c := range cases {
+		if merged := mergeSubs(c.subs); !reflect.DeepEqual(merged, c.merged) {
+			t.Errorf("mergeSubs(%v) = %v, expected %v", c.subs, merged, c.merged)
+		}
+	}
+}
+
+func TestWalkMatchFn(t *testing.T) {
+	ignores := ignore.New(false)
+	if err := ignores.Load("testdata/.stignore"); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := make(map[string]ignore.PatternSource)
+	fchan, err := Walk(Config{
+		Dir:                   "testdata",
+		BlockSize:             128 * 1024,
+		Matcher:               ignores,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		MatchFn: func(relPath string, source ignore.PatternSource) {
+			sources[relPath] = source
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+
+	if s := sources["bfile"]; s.File != "testdata/.stignore" || s.Line != 3 || s.Text != "bfile" {
+		t.Errorf("unexpected source for bfile: %+v", s)
+	}
+	if s := sources["dir3"]; s.File != filepath.Join("testdata", "further-excludes") || s.Line != 1 {
+		t.Errorf("unexpected source for dir3: %+v", s)
+	}
+}
+
+func TestWalkMaxFilesPerScan(t *testing.T) {
+	fchan, control, err := WalkWithControl(Config{
+		Dir:                   "testdata",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		MaxFilesPerScan:       3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	for f := range fchan {
+		if !f.IsDirectory() {
+			files = append(files, f.Name)
+		}
+	}
+	sort.Strings(files)
+
+	expected := []string{"afile", "bfile", filepath.Join("dir1", "cfile")}
+	if diff, equal := messagediff.PrettyDiff(expected, files); !equal {
+		t.Errorf("unexpected files:\n%s", diff)
+	}
+	if !control.Truncated() {
+		t.Error("walk should be truncated")
+	}
+	if last := control.LastPath(); last != filepath.Join("dir1", "cfile") {
+		t.Errorf("unexpected last path %q", last)
+	}
+}
+
+func TestWalkScanID(t *testing.T) {
+	var errs []ScanError
+	fchan, control, err := WalkWithControl(Config{
+		Dir:                   "testdata",
+		Subs:                  []string{"missing"},
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		ScanID:                "sub-scan",
+		ErrorFn: func(e ScanError) {
+			errs = append(errs, e)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+
+	if id := control.ScanID(); id != "sub-scan" {
+		t.Errorf("unexpected scan ID %q", id)
+	}
+	if len(errs) != 1 || errs[0].ScanID != "sub-scan" {
+		t.Errorf("expected one error from the scan, not %v", errs)
+	}
+
+	// Without one, each scan gets its own.
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		fchan, control, err := WalkWithControl(Config{
+			Dir:                   "testdata",
+			Subs:                  []string{"dir1"},
+			BlockSize:             128 * 1024,
+			Hashers:               2,
+			ProgressTickIntervalS: -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range fchan {
+		}
+		if control.ScanID() == "" {
+			t.Error("no scan ID generated")
+		}
+		ids[control.ScanID()] = true
+	}
+	if len(ids) != 2 {
+		t.Errorf("expected distinct scan IDs, got %v", ids)
+	}
+}
+
+func TestWalkMissingSub(t *testing.T) {
+	missing := filepath.Join("dir1", "missing")
+	cf := fakeCurrentFiler{
+		missing: protocol.FileInfo{
+			Name:    missing,
+			Type:    protocol.FileInfoTypeDirectory,
+			Version: protocol.Vector{}.Update(1),
+		},
+	}
+
+	var errs []ScanError
+	cfg := Config{
+		Dir:                   "testdata",
+		Subs:                  []string{missing, "dir2"},
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		CurrentFiler:          cf,
+		ShortID:               2,
+		ErrorFn: func(e ScanError) {
+			errs = append(errs, e)
+		},
+	}
+
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f := range fchan {
+		if f.Name == missing {
+			t.Error("missing sub should not be returned without EmitDeletes")
+		}
+	}
+	if len(errs) != 1 || errs[0].Path != missing {
+		t.Errorf("expected the missing sub to be reported, got %v", errs)
+	}
+
+	errs = nil
+	cfg.EmitDeletes = true
+	fchan, err = Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deleted []protocol.FileInfo
+	for f := range fchan {
+		if f.IsDeleted() {
+			deleted = append(deleted, f)
+		}
+	}
+	if len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	if len(deleted) != 1 {
+		t.Fatalf("expected one delete, got %v", deleted)
+	}
+	if d := deleted[0]; d.Name != missing || !d.IsDirectory() || d.Version.Compare(cf[missing].Version) != protocol.Greater {
+		t.Errorf("unexpected delete %v", d)
+	}
+}
+
+type fakeMissingCurrentFiler struct {
+	fakeCurrentFiler
+	missing map[string]time.Time
+}
+
+func (cf *fakeMissingCurrentFiler) MissingSince(name string, now time.Time) time.Time {
+	if since, ok := cf.missing[name]; ok {
+		return since
+	}
+	cf.missing[name] = now
+	return now
+}
+
+func (cf *fakeMissingCurrentFiler) Found(name string) {
+	delete(cf.missing, name)
+}
+
+func TestWalkDeleteGracePeriod(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	missing := filepath.Join("dir1", "missing")
+	cf := &fakeMissingCurrentFiler{
+		fakeCurrentFiler: fakeCurrentFiler{
+			missing: protocol.FileInfo{Name: missing, Version: protocol.Vector{}.Update(1)},
+			"dir2":  protocol.FileInfo{Name: "dir2", Type: protocol.FileInfoTypeDirectory},
+		},
+		missing: map[string]time.Time{"dir2": now.Add(-time.Hour)},
+	}
+	cfg := Config{
+		Dir:                   "testdata",
+		Subs:                  []string{missing, "dir2"},
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		CurrentFiler:          cf,
+		EmitDeletes:           true,
+		DeleteGracePeriod:     time.Minute,
+	}
+
+	deletes := func() int {
+		fchan, err := Walk(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for f := range fchan {
+			if f.IsDeleted() {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := deletes(); n != 0 {
+		t.Errorf("expected no deletes on first sight, got %d", n)
+	}
+	if _, ok := cf.missing["dir2"]; ok {
+		t.Error("dir2 exists and should no longer be missing")
+	}
+
+	now = now.Add(30 * time.Second)
+	if n := deletes(); n != 0 {
+		t.Errorf("expected no deletes within the grace period, got %d", n)
+	}
+
+	now = now.Add(time.Minute)
+	if n := deletes(); n != 1 {
+		t.Errorf("expected a delete after the grace period, got %d", n)
+	}
+}
+
+func TestWalkSlashedNames(t *testing.T) {
+	fchan, err := Walk(Config{
+		Dir:                   "testdata",
+		Subs:                  []string{filepath.Join("dir1", "dfile")},
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		SlashedNames:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for f := range fchan {
+		names = append(names, f.Name)
+	}
+	if len(names) != 1 || names[0] != "dir1/dfile" {
+		t.Errorf("unexpected names %v", names)
+	}
+}
+
+func TestWalkWeakHashFn(t *testing.T) {
+	fchan, err := Walk(Config{
+		Dir:                   "testdata",
+		Subs:                  []string{"dir1"},
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		UseWeakHashes:         true,
+		WeakHashFn: func(relPath string, size int64) bool {
+			return filepath.Base(relPath) == "cfile"
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files int
+	for f := range fchan {
+		if f.IsDirectory() {
+			continue
+		}
+		files++
+		weak := f.Blocks[0].WeakHash != 0
+		if expected := filepath.Base(f.Name) == "cfile"; weak != expected {
+			t.Errorf("%s: weak hash %v, expected %v", f.Name, weak, expected)
+		}
+	}
+	if files != 2 {
+		t.Errorf("expected two files, not %d", files)
+	}
+}
+
+func TestWalkTypeChangeFn(t *testing.T) {
+	cf := fakeCurrentFiler{
+		"dir1":                         protocol.FileInfo{Name: "dir1", Type: protocol.FileInfoTypeFile},
+		filepath.Join("dir1", "cfile"): protocol.FileInfo{Name: filepath.Join("dir1", "cfile"), Type: protocol.FileInfoTypeDirectory},
+		filepath.Join("dir1", "dfile"): protocol.FileInfo{Name: filepath.Join("dir1", "dfile"), Type: protocol.FileInfoTypeFile},
+	}
+
+	var mut sync.Mutex
+	changes := make(map[string][2]protocol.FileInfoType)
+	fchan, err := Walk(Config{
+		Dir:                   "testdata",
+		Subs:                  []string{"dir1"},
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		CurrentFiler:          cf,
+		TypeChangeFn: func(relPath string, from, to protocol.FileInfoType) {
+			mut.Lock()
+			changes[relPath] = [2]protocol.FileInfoType{from, to}
+			mut.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+
+	expected := map[string][2]protocol.FileInfoType{
+		"dir1":                         {protocol.FileInfoTypeFile, protocol.FileInfoTypeDirectory},
+		filepath.Join("dir1", "cfile"): {protocol.FileInfoTypeDirectory, protocol.FileInfoTypeFile},
+	}
+	if diff, equal := messagediff.PrettyDiff(expected, changes); !equal {
+		t.Errorf("unexpected type changes:\n%s", diff)
+	}
+}
+
+func TestWalkPermChangeFn(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not supported on Windows")
+	}
+
+	os.RemoveAll("_permchange")
+	defer os.RemoveAll("_permchange")
+	os.Mkdir("_permchange", 0755)
+	for _, name := range []string{"perms", "both"} {
+		if err := ioutil.WriteFile(filepath.Join("_permchange", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := Config{
+		Dir:                   "_permchange",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+	}
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := make(fakeCurrentFiler)
+	for f := range fchan {
+		cf[f.Name] = f
+	}
+
+	for _, name := range []string{"perms", "both"} {
+		if err := os.Chmod(filepath.Join("_permchange", name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join("_permchange", "both"), []byte("more contents"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var mut sync.Mutex
+	changes := make(map[string][2]uint32)
+	cfg.CurrentFiler = cf
+	cfg.PermChangeFn = func(relPath string, from, to uint32) {
+		mut.Lock()
+		changes[relPath] = [2]uint32{from, to}
+		mut.Unlock()
+	}
+	fchan, err = Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both files were changed, and so are all there is to the next scan.
+	changed := make(fakeCurrentFiler)
+	for f := range fchan {
+		changed[f.Name] = f
+	}
+
+	expected := map[string][2]uint32{"perms": {0644, 0600}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("unexpected permission changes %v", changes)
+	}
+
+	// Files returned for other reasons, with the same permissions, are
+	// not permission changes.
+	changes = make(map[string][2]uint32)
+	cfg.CurrentFiler = changed
+	cfg.UnchangedFn = func(protocol.FileInfo, fs.FileInfo) bool { return false }
+	fchan, err = Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+	if len(changes) != 0 {
+		t.Errorf("unexpected permission changes %v", changes)
+	}
+}
+
+func TestWalkReadChunkSize(t *testing.T) {
+	os.RemoveAll("_chunks")
+	defer os.RemoveAll("_chunks")
+	os.Mkdir("_chunks", 0755)
+
+	data := make([]byte, 1000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("_chunks", "data"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(chunkSize int) map[string]protocol.FileInfo {
+		fchan, err := Walk(Config{
+			Dir:                   "_chunks",
+			BlockSize:             16,
+			Hashers:               2,
+			ProgressTickIntervalS: -1,
+			ReadChunkSize:         chunkSize,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]protocol.FileInfo)
+		for f := range fchan {
+			files[f.Name] = f
+		}
+		return files
+	}
+
+	expected := walk(0)
+	chunked := walk(64)
+	if len(chunked) != len(expected) {
+		t.Fatalf("got %d files, expected %d", len(chunked), len(expected))
+	}
+	for name, f := range expected {
+		if !BlocksEqual(chunked[name].Blocks, f.Blocks) {
+			t.Errorf("%s: blocks differ when read in chunks", name)
+		}
+	}
+
+	if len(expected["data"].Blocks) != 63 {
+		t.Errorf("expected 63 blocks, not %d", len(expected["data"].Blocks))
+	}
+
+	_, err := Walk(Config{
+		Dir:           "_chunks",
+		BlockSize:     16,
+		Hashers:       2,
+		ReadChunkSize: 40,
+	})
+	if err == nil {
+		t.Error("read chunk size that is not a multiple of the block size should be rejected")
+	}
+}
+
+func TestWalkDirCurrentFiler(t *testing.T) {
+	cfg := Config{
+		Dir:                   "testdata",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+	}
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(fakeCurrentFiler)
+	for f := range fchan {
+		files[f.Name] = f
+	}
+
+	cf := &fakeDirCurrentFiler{fakeCurrentFiler: files, dirs: make(map[string]int)}
+	cfg.CurrentFiler = cf
+	fchan, err = Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f := range fchan {
+		t.Errorf("unexpected change %v", f)
+	}
+
+	if cf.single != 0 {
+		t.Errorf("expected no single lookups, got %d", cf.single)
+	}
+	for dir, n := range cf.dirs {
+		if n != 1 {
+			t.Errorf("%s: looked up %d times", dir, n)
+		}
+	}
+	if cf.dirs["."] != 1 || cf.dirs["dir1"] != 1 {
+		t.Errorf("unexpected directory lookups %v", cf.dirs)
+	}
+}
+
+func TestHashFileMmap(t *testing.T) {
+	os.RemoveAll("_mmap")
+	defer os.RemoveAll("_mmap")
+	os.Mkdir("_mmap", 0755)
+
+	name := filepath.Join("_mmap", "data")
+	data := make([]byte, 4*protocol.BlockSize+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := hashOptions{blockSize: protocol.BlockSize, useWeakHashes: true}
+	expected, err := hashFile(fs.DefaultFilesystem, name, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.mmap = true
+	blocks, err := hashFile(fs.DefaultFilesystem, name, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff, equal := messagediff.PrettyDiff(expected, blocks); !equal {
+		t.Errorf("blocks differ when mapped:\n%s", diff)
+	}
+
+	// Reused blocks at the start are kept as they are.
+	blocks, err = hashFile(fs.DefaultFilesystem, name, expected[:2], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff, equal := messagediff.PrettyDiff(expected, blocks); !equal {
+		t.Errorf("blocks differ when mapped with a prefix:\n%s", diff)
+	}
+
+	// The file shrinking under the mapping is an error, not a crash.
+	opts.counter = truncatingCounter(name)
+	if _, err := hashFile(fs.DefaultFilesystem, name, nil, opts); err == nil {
+		t.Error("expected an error for a file that shrank while hashing")
+	}
+}
+
+// truncatingCounter truncates the file once the first block is hashed.
+type truncatingCounter string
+
+func (c truncatingCounter) Update(bytes int64) {
+	os.Truncate(string(c), 0)
+}
+
+func TestWalk(t *testing.T) {
+	ignores := ignore.New(false)
+	err := ignores.Load("testdata/.stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(ignores)
+
+	fchan, err := Walk(Config{
+		Dir:       "testdata",
+		BlockSize: 128 * 1024,
+		Matcher:   ignores,
+		Hashers:   2,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tmp []protocol.FileInfo
+	for f := range fchan {
+		tmp = append(tmp, f)
+	}
+	sort.Sort(fileList(tmp))
+	files := fileList(tmp).testfiles()
+
+	if diff, equal := messagediff.PrettyDiff(testdata, files); !equal {
+		t.Errorf("Walk returned unexpected data. Diff:\n%s", diff)
+	}
+}
+
+func TestWalkError(t *testing.T) {
+	_, err := Walk(Config{
+		Dir:       "testdata-missing",
+		BlockSize: 128 * 1024,
+		Hashers:   2,
+	})
+
+	if err == nil {
+		t.Error("no error from missing directory")
+	}
+
+	_, err = Walk(Config{
+		Dir:       "testdata/bar",
+		BlockSize: 128 * 1024,
+	})
+
+	if err == nil {
+		t.Error("no error from non-directory")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	blocksize := 16
+	// data should be an even multiple of blocksize long
+	data := []byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. Ut e")
+	buf := bytes.NewBuffer(data)
+	progress := newByteCounter()
+	defer progress.Close()
+
+	blocks, err := Blocks(buf, blocksize, -1, progress, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := len(data) / blocksize; len(blocks) != exp {
+		t.Fatalf("Incorrect number of blocks %d != %d", len(blocks), exp)
+	}
+
+	if int64(len(data)) != progress.Total() {
+		t.Fatalf("Incorrect counter value %d  != %d", len(data), progress.Total())
+	}
+
+	buf = bytes.NewBuffer(data)
+	err = Verify(buf, blocksize, blocks)
+	t.Log(err)
+	if err != nil {
+		t.Fatal("Unexpected verify failure", err)
+	}
+
+	buf = bytes.NewBuffer(append(data, '\n'))
+	err = Verify(buf, blocksize, blocks)
+	t.Log(err)
+	if err == nil {
+		t.Fatal("Unexpected verify success")
+	}
+
+	buf = bytes.NewBuffer(data[:len(data)-1])
+	err = Verify(buf, blocksize, blocks)
+	t.Log(err)
+	if err == nil {
+		t.Fatal("Unexpected verify success")
+	}
+
+	data[42] = 42
+	buf = bytes.NewBuffer(data)
+	err = Verify(buf, blocksize, blocks)
+	t.Log(err)
+	if err == nil {
+		t.Fatal("Unexpected verify success")
+	}
+}
+
+func TestNormalizationCache(t *testing.T) {
+	defer normCache.remove(filepath.Join("dir1", "cfile"))
+
+	fchan, err := Walk(Config{
+		Dir:                    "testdata",
+		Subs:                   []string{"afile", "dir1"},
+		BlockSize:              128 * 1024,
+		Hashers:                2,
+		ProgressTickIntervalS:  -1,
+		NormalizationForm:      NormalizationNFC,
+		NormalizationCacheSize: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+
+	// Only the last two names are kept.
+	if normCache.has(norm.NFC, "afile") || normCache.has(norm.NFC, "dir1") {
+		t.Error("expected the first names to have been evicted")
+	}
+	if normCache.has(norm.NFD, filepath.Join("dir1", "dfile")) {
+		t.Error("names are cached per form")
+	}
+	if !normCache.has(norm.NFC, filepath.Join("dir1", "dfile")) {
+		t.Error("expected dir1/dfile to be cached")
+	}
+
+	normCache.remove(filepath.Join("dir1", "dfile"))
+	if normCache.has(norm.NFC, filepath.Join("dir1", "dfile")) {
+		t.Error("expected dir1/dfile to be gone once removed")
+	}
+}
+
+func TestNormalization(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("Normalization test not possible on darwin")
+		return
+	}
+
+	os.RemoveAll("testdata/normalization")
+	defer os.RemoveAll("testdata/normalization")
+
+	tests := []string{
+		"0-A",            // ASCII A -- accepted
+		"1-\xC3\x84",     // NFC 'Ä' -- conflicts with the entry below, accepted
+		"1-\x41\xCC\x88", // NFD 'Ä' -- conflicts with the entry above, ignored
+		"2-\xC3\x85",     // NFC 'Å' -- accepted
+		"3-\x41\xCC\x83", // NFD 'Ã' -- converted to NFC
+		"4-\xE2\x98\x95", // U+2615 HOT BEVERAGE (☕) -- accepted
+		"5-\xCD\xE2",     // EUC-CN "wài" (外) -- ignored (not UTF8)
+	}
+	numInvalid := 2
+
+	if runtime.GOOS == "windows" {
+		// On Windows, in case 5 the character gets replaced with a
+		// replacement character \xEF\xBF\xBD at the point it's written to disk,
+		// which means it suddenly becomes valid (sort of).
+		numInvalid--
+	}
+
+	numValid := len(tests) - numInvalid
+
+	for _, s1 := range tests {
+		// Create a directory for each of the interesting strings above
+		if err := osutil.MkdirAll(filepath.Join("testdata/normalization", s1), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, s2 := range tests {
+			// Within each dir, create a file with each of the interesting
+			// file names. Ensure that the file doesn't exist when it's
+			// created. This detects and fails if there's file name
+			// normalization stuff at the filesystem level.
+			if fd, err := os.OpenFile(filepath.Join("testdata/normalization", s1, s2), os.O_CREATE|os.O_EXCL, 0644); err != nil {
+				t.Fatal(err)
+			} else {
+				fd.WriteString("test")
+				fd.Close()
+			}
+		}
+	}
+
+	// We can normalize a directory name, but we can't descend into it in the
+	// same pass due to how filepath.Walk works. So we run the scan twice to
+	// make sure it all gets done. In production, things will be correct
+	// eventually...
+
+	renames := 0
+	fchan, err := Walk(Config{
+		Dir:           "testdata/normalization",
+		BlockSize:     128 * 1024,
+		AutoNormalize: true,
+		Hashers:       2,
+		RenameFn: func(from, to string) {
+			if from == to || norm.NFC.String(from) != to {
+				t.Errorf("unexpected rename %q -> %q", from, to)
+			}
+			renames++
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+	if renames == 0 {
+		t.Error("expected some files to be renamed")
+	}
+
+	tmp, err := walkDir("testdata/normalization")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := fileList(tmp).testfiles()
+
+	// We should have one file per combination, plus the directories
+	// themselves
+
+	expectedNum := numValid*numValid + numValid
+	if len(files) != expectedNum {
+		t.Errorf("Expected %d files, got %d", expectedNum, len(files))
+	}
+
+	// The file names should all be in NFC form.
+
+	for _, f := range files {
+		t.Logf("%q (% x) %v", f.name, f.name, norm.NFC.IsNormalString(f.name))
+		if !norm.NFC.IsNormalString(f.name) {
+			t.Errorf("File name %q is not NFC normalized", f.name)
+		}
+	}
+}
+
+func TestNormalizationForm(t *testing.T) {
+	os.RemoveAll("testdata/normalization")
+	defer os.RemoveAll("testdata/normalization")
+
+	nfd := "3-\x41\xCC\x83" // NFD 'Ã'
+	if err := osutil.MkdirAll("testdata/normalization", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("testdata/normalization", nfd), []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, form := range []NormalizationForm{NormalizationNFD, NormalizationNone} {
+		fchan, err := Walk(Config{
+			Dir:               "testdata/normalization",
+			BlockSize:         128 * 1024,
+			AutoNormalize:     true,
+			NormalizationForm: form,
+			Hashers:           2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+
+		if len(files) != 1 || files[0].Name != nfd {
+			t.Errorf("form %d: expected unchanged NFD name, got %v", form, files)
+		}
+	}
+}
+
+func TestAllowRenameFn(t *testing.T) {
+	os.RemoveAll("testdata/normalization")
+	defer os.RemoveAll("testdata/normalization")
+
+	nfd := "3-\x41\xCC\x83" // NFD 'Ã'
+	nfc := "3-\xC3\x83"     // NFC 'Ã'
+	if err := osutil.MkdirAll("testdata/normalization", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("testdata/normalization", nfd), []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(allow bool) ([]protocol.FileInfo, []ScanError) {
+		var asked [][2]string
+		var errs []ScanError
+		fchan, err := Walk(Config{
+			Dir:               "testdata/normalization",
+			BlockSize:         128 * 1024,
+			AutoNormalize:     true,
+			NormalizationForm: NormalizationNFC,
+			Hashers:           2,
+			AllowRenameFn: func(from, to string) bool {
+				asked = append(asked, [2]string{from, to})
+				return allow
+			},
+			ErrorFn: func(e ScanError) { errs = append(errs, e) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		if len(asked) != 1 || asked[0] != [2]string{nfd, nfc} {
+			t.Errorf("unexpected renames asked for: %q", asked)
+		}
+		return files, errs
+	}
+
+	files, errs := walk(false)
+	if len(files) != 0 {
+		t.Errorf("expected no files, got %v", files)
+	}
+	if len(errs) != 1 || errs[0].Path != nfd || errs[0].Err != errNormalizeNotAllowed {
+		t.Errorf("expected an error for the file, not %v", errs)
+	}
+	if _, err := os.Lstat(filepath.Join("testdata/normalization", nfd)); err != nil {
+		t.Error("the file should not have been renamed:", err)
+	}
+
+	files, errs = walk(true)
+	if len(files) != 1 || files[0].Name != nfc {
+		t.Errorf("expected the normalized file, got %v", files)
+	}
+	if len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestRepairInvalidUTF8(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("invalid UTF8 file names are not possible on this platform")
+	}
+
+	os.RemoveAll("testdata/invalid")
+	defer os.RemoveAll("testdata/invalid")
+
+	if err := osutil.MkdirAll("testdata/invalid", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("testdata/invalid/5-\xCD\xE2", []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []ScanError
+	fchan, err := Walk(Config{
+		Dir:       "testdata/invalid",
+		BlockSize: 128 * 1024,
+		Hashers:   2,
+		ErrorFn:   func(e ScanError) { errs = append(errs, e) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f := range fchan {
+		t.Errorf("unexpected file %v", f)
+	}
+	if len(errs) != 1 || errs[0].Path != "5-\xCD\xE2" {
+		t.Errorf("expected an error for the invalid name, not %v", errs)
+	}
+
+	fchan, err = Walk(Config{
+		Dir:               "testdata/invalid",
+		BlockSize:         128 * 1024,
+		Hashers:           2,
+		RepairInvalidUTF8: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []protocol.FileInfo
+	for f := range fchan {
+		files = append(files, f)
+	}
+	if len(files) != 1 || files[0].Name != "5-\uFFFD\uFFFD" {
+		t.Errorf("expected a repaired file name, not %v", files)
+	}
+}
+
+func TestStripFilenameBOM(t *testing.T) {
+	os.RemoveAll("testdata/bom")
+	defer os.RemoveAll("testdata/bom")
+
+	if err := osutil.MkdirAll("testdata/bom", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"\ufeffbom", "\ufeffconflict", "conflict"} {
+		if err := ioutil.WriteFile(filepath.Join("testdata/bom", name), []byte("test"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(strip bool) ([]string, []ScanError) {
+		var errs []ScanError
+		fchan, err := Walk(Config{
+			Dir:                   "testdata/bom",
+			BlockSize:             128 * 1024,
+			Hashers:               2,
+			ProgressTickIntervalS: -1,
+			SuppressWarnings:      true,
+			StripFilenameBOM:      strip,
+			ErrorFn:               func(e ScanError) { errs = append(errs, e) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for f := range fchan {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		return names, errs
+	}
+
+	// Reported, but returned as is.
+	names, errs := walk(false)
+	if diff, equal := messagediff.PrettyDiff([]string{"conflict", "\ufeffbom", "\ufeffconflict"}, names); !equal {
+		t.Errorf("unexpected files:\n%s", diff)
+	}
+	if len(errs) != 2 || errs[0].Err != errFilenameBOM || errs[1].Err != errFilenameBOM {
+		t.Errorf("expected errors for both names, not %v", errs)
+	}
+
+	// Renamed, unless in the way of another file.
+	names, errs = walk(true)
+	if diff, equal := messagediff.PrettyDiff([]string{"bom", "conflict"}, names); !equal {
+		t.Errorf("unexpected files:\n%s", diff)
+	}
+	if len(errs) != 1 || errs[0].Path != "\ufeffconflict" || errs[0].Err != errStripBOMConflict {
+		t.Errorf("expected an error for the conflict, not %v", errs)
+	}
+	if _, err := os.Lstat("testdata/bom/bom"); err != nil {
+		t.Error("file was not renamed:", err)
+	}
+}
+
+func TestIssue1507(t *testing.T) {
+	w := &walker{}
+	c := make(chan protocol.FileInfo, 100)
+	fn := w.walkAndHashFiles(c, c)
+
+	fn("", nil, protocol.ErrClosed)
+}
+
+func TestWalkSymlinkUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping unsupported symlink test")
+		return
+	}
+
+	// Create a folder with a symlink in it
+
+	os.RemoveAll("_symlinks")
+	defer os.RemoveAll("_symlinks")
+
+	os.Mkdir("_symlinks", 0755)
+	os.Symlink("destination", "_symlinks/link")
+
+	// Scan it
+
+	fchan, err := Walk(Config{
+		Dir:       "_symlinks",
+		BlockSize: 128 * 1024,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []protocol.FileInfo
+	for f := range fchan {
+		files = append(files, f)
+	}
+
+	// Verify that we got one symlink and with the correct attributes
+
+	if len(files) != 1 {
+		t.Errorf("expected 1 symlink, not %d", len(files))
+	}
+	if len(files[0].Blocks) != 0 {
+		t.Errorf("expected zero blocks for symlink, not %d", len(files[0].Blocks))
+	}
+	if files[0].SymlinkTarget != "destination" {
+		t.Errorf("expected symlink to have target destination, not %q", files[0].SymlinkTarget)
+	}
+}
+
+func TestWalkSymlinkWindows(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("skipping unsupported symlink test")
+	}
+
+	// Create a folder with a symlink in it
+
+	os.RemoveAll("_symlinks")
+	defer os.RemoveAll("_symlinks")
+
+	os.Mkdir("_symlinks", 0755)
+	if err := os.Symlink("destination", "_symlinks/link"); err != nil {
+		// Probably we require permissions we don't have.
+		t.Skip(err)
+	}
+
+	// Scan it
+
+	fchan, err := Walk(Config{
+		Dir:       "_symlinks",
+		BlockSize: 128 * 1024,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []protocol.FileInfo
+	for f := range fchan {
+		files = append(files, f)
+	}
+
+	// Verify that we got zero symlinks
+
+	if len(files) != 0 {
+		t.Errorf("expected zero symlinks, not %d", len(files))
+	}
+}
+
+func TestWalkSmallFilesInline(t *testing.T) {
+	walk := func(progress int) []protocol.FileInfo {
+		fchan, err := Walk(Config{
+			Dir:                   "testdata",
+			BlockSize:             128 * 1024,
+			Hashers:               2,
+			ProgressTickIntervalS: progress,
+			UseWeakHashes:         true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		sort.Sort(fileList(files))
+		return files
+	}
+
+	// Without progress events the small files are hashed by the walker;
+	// with them they all go through the hashers.
+	inline := walk(-1)
+	hashed := walk(0)
+	if diff, equal := messagediff.PrettyDiff(hashed, inline); !equal {
+		t.Errorf("files hashed inline differ:\n%s", diff)
+	}
+	if len(inline) == 0 {
+		t.Error("no files")
+	}
+}
+
+func TestWalkSymlinkTargets(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping unsupported symlink test")
+	}
+
+	os.RemoveAll("_symlinks")
+	defer os.RemoveAll("_symlinks")
+
+	os.MkdirAll("_symlinks/dir", 0755)
+	links := map[string]string{
+		"dir/inside":  "../other",
+		"dir/escapes": "../../other",
+		"dir/nfd":     "a\u0308", // "ä" in NFD
+		"absolute":    "/etc/passwd",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join("_symlinks", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var errs []string
+	fchan, err := Walk(Config{
+		Dir:                    "_symlinks",
+		BlockSize:              128 * 1024,
+		Hashers:                2,
+		ProgressTickIntervalS:  -1,
+		NormalizationForm:      NormalizationNFC,
+		RestrictSymlinkTargets: true,
+		ErrorFn: func(err ScanError) {
+			errs = append(errs, err.Path)
+			if err.Err != errSymlinkEscapes {
+				t.Errorf("%s: unexpected error %v", err.Path, err.Err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := make(map[string]string)
+	for f := range fchan {
+		if f.IsSymlink() {
+			targets[f.Name] = f.SymlinkTarget
+		}
+	}
+
+	expected := map[string]string{
+		filepath.Join("dir", "inside"): "../other",
+		filepath.Join("dir", "nfd"):    "\u00e4",
+		"absolute":                     "/etc/passwd",
+	}
+	if diff, equal := messagediff.PrettyDiff(expected, targets); !equal {
+		t.Errorf("unexpected targets:\n%s", diff)
+	}
+	if len(errs) != 1 || errs[0] != filepath.Join("dir", "escapes") {
+		t.Errorf("expected only the escaping link to be reported, not %v", errs)
+	}
+}
+
+func TestWalkBrokenSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping unsupported symlink test")
+	}
+
+	os.RemoveAll("_symlinks")
+	defer os.RemoveAll("_symlinks")
+
+	os.Mkdir("_symlinks", 0755)
+	if err := ioutil.WriteFile("_symlinks/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", "_symlinks/good"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing", "_symlinks/broken"); err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []ScanError
+	fchan, err := Walk(Config{
+		Dir:                   "_symlinks",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		ReportBrokenSymlinks:  true,
+		ErrorFn: func(err ScanError) {
+			errs = append(errs, err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := make(map[string]string)
+	for f := range fchan {
+		if f.IsSymlink() {
+			targets[f.Name] = f.SymlinkTarget
+		}
+	}
+
+	// The broken link is still a link.
+	expected := map[string]string{
+		"good":   "file",
+		"broken": "missing",
+	}
+	if diff, equal := messagediff.PrettyDiff(expected, targets); !equal {
+		t.Errorf("unexpected symlinks:\n%s", diff)
+	}
+	if len(errs) != 1 || errs[0].Path != "broken" || errs[0].Err != errBrokenSymlink {
+		t.Errorf("expected only the broken link to be reported, not %v", errs)
+	}
+}
+
+func TestWalkSymlinkChains(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping unsupported symlink test")
+	}
+
+	os.RemoveAll("_symchains")
+	defer os.RemoveAll("_symchains")
+
+	os.Mkdir("_symchains", 0755)
+	if err := ioutil.WriteFile("_symchains/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := [][2]string{
+		{"file", "one"},
+		{"one", "two"},
+		{"two", "three"},
+		{"loopb", "loopa"},
+		{"loopa", "loopb"},
+		{"..", "out"},
+		{"out", "viaout"},
+	}
+	for _, link := range links {
+		if err := os.Symlink(link[0], filepath.Join("_symchains", link[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mut sync.Mutex
+	errs := make(map[string]error)
+	fchan, err := Walk(Config{
+		Dir:                    "_symchains",
+		BlockSize:              128 * 1024,
+		Hashers:                2,
+		ProgressTickIntervalS:  -1,
+		RestrictSymlinkTargets: true,
+		MaxSymlinkDepth:        2,
+		ErrorFn: func(err ScanError) {
+			mut.Lock()
+			errs[err.Path] = err.Err
+			mut.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var returned []string
+	for f := range fchan {
+		if f.IsSymlink() {
+			returned = append(returned, f.Name)
+		}
+	}
+	sort.Strings(returned)
+
+	if !reflect.DeepEqual(returned, []string{"one", "two"}) {
+		t.Errorf("unexpected symlinks returned: %v", returned)
+	}
+	expected := map[string]error{
+		"three":  errSymlinkDepth,
+		"loopa":  errSymlinkDepth,
+		"loopb":  errSymlinkDepth,
+		"out":    errSymlinkEscapes,
+		"viaout": errSymlinkEscapes,
+	}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestWalkSymlinkPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping unsupported symlink test")
+	}
+
+	os.RemoveAll("_sympolicy")
+	defer os.RemoveAll("_sympolicy")
+
+	os.MkdirAll("_sympolicy/real", 0755)
+	if err := ioutil.WriteFile("_sympolicy/real/inner", []byte("inner"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("_sympolicy/data", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := [][2]string{
+		{"real", "dirlink"},
+		{"data", "filelink"},
+		{"data", "plain"},
+		{"data", "mismatch"},
+		{".", "loop"},
+		{"..", "up"},
+	}
+	for _, link := range links {
+		if err := os.Symlink(link[0], filepath.Join("_sympolicy", link[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policies := map[string]SymlinkPolicy{
+		"dirlink":  SymlinkFollowDir,
+		"filelink": SymlinkDereference,
+		"mismatch": SymlinkFollowDir,
+		"loop":     SymlinkFollowDir,
+		"up":       SymlinkFollowDir,
+	}
+	var mut sync.Mutex
+	errs := make(map[string]error)
+	fchan, err := Walk(Config{
+		Dir:                    "_sympolicy",
+		BlockSize:              128 * 1024,
+		Hashers:                2,
+		ProgressTickIntervalS:  -1,
+		RestrictSymlinkTargets: true,
+		SymlinkPolicyFn: func(relPath, target string) SymlinkPolicy {
+			return policies[relPath]
+		},
+		ErrorFn: func(err ScanError) {
+			mut.Lock()
+			errs[err.Path] = err.Err
+			mut.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[string]protocol.FileInfoType)
+	for f := range fchan {
+		types[f.Name] = f.Type
+	}
+
+	expected := map[string]protocol.FileInfoType{
+		"real":                            protocol.FileInfoTypeDirectory,
+		filepath.Join("real", "inner"):    protocol.FileInfoTypeFile,
+		"data":                            protocol.FileInfoTypeFile,
+		"dirlink":                         protocol.FileInfoTypeDirectory,
+		filepath.Join("dirlink", "inner"): protocol.FileInfoTypeFile,
+		"filelink":                        protocol.FileInfoTypeFile,
+		"plain":                           protocol.FileInfoTypeSymlink,
+		"mismatch":                        protocol.FileInfoTypeSymlink,
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("unexpected items %v", types)
+	}
+	expectedErrs := map[string]error{
+		"loop": errSymlinkLoop,
+		"up":   errSymlinkEscapes,
+	}
+	if !reflect.DeepEqual(errs, expectedErrs) {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestWalkSymlinkFollowDirChecks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping unsupported symlink test")
+	}
+
+	os.RemoveAll("_symfollow")
+	defer os.RemoveAll("_symfollow")
+
+	for _, dir := range []string{"_symfollow/real/deep", "_symfollow/marked", "_symfollow/empty"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"_symfollow/real/f", "_symfollow/real/deep/g", "_symfollow/marked/.nobackup", "_symfollow/marked/x"} {
+		if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, link := range [][2]string{{"real", "link"}, {"marked", "mlink"}, {"empty", "elink"}} {
+		if err := os.Symlink(link[0], filepath.Join("_symfollow", link[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(cfg Config) []string {
+		cfg.Dir = "_symfollow"
+		cfg.BlockSize = 128 * 1024
+		cfg.Hashers = 2
+		cfg.SymlinkPolicyFn = func(relPath, target string) SymlinkPolicy {
+			return SymlinkFollowDir
+		}
+		fchan, err := Walk(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for f := range fchan {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// A followed directory with a marker is skipped like a real one, and
+	// left out if empty.
+
+	names := walk(Config{
+		SkipDirMarkers: []string{".nobackup"},
+		SkipEmptyDirs:  true,
+	})
+	expected := []string{
+		"link",
+		filepath.Join("link", "deep"),
+		filepath.Join("link", "deep", "g"),
+		filepath.Join("link", "f"),
+		"real",
+		filepath.Join("real", "deep"),
+		filepath.Join("real", "deep", "g"),
+		filepath.Join("real", "f"),
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected items %v", names)
+	}
+
+	// Nor are the contents of one at MaxDepth walked.
+
+	names = walk(Config{
+		MaxDepth: 1,
+	})
+	expected = []string{"elink", "empty", "link", "marked", "mlink", "real"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected items with MaxDepth %v", names)
+	}
+}
+
+func TestWalkIncrementalBlocks(t *testing.T) {
+	os.RemoveAll("_incremental")
+	defer os.RemoveAll("_incremental")
+
+	os.Mkdir("_incremental", 0755)
+	data := []byte("0123456789abcdef0123456789abcdefappended")
+	if err := ioutil.WriteFile("_incremental/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The previous version of the file had two full blocks and a partial
+	// one. The hashes are bogus so that we can tell whether they were
+	// reused or recomputed.
+
+	bogus := bytes.Repeat([]byte{0x42}, 32)
+	cf := fakeCurrentFiler{
+		"file": protocol.FileInfo{
+			Name: "file",
+			Type: protocol.FileInfoTypeFile,
+			Size: 36,
+			Blocks: []protocol.BlockInfo{
+				{Offset: 0, Size: 16, Hash: bogus},
+				{Offset: 16, Size: 16, Hash: bogus},
+				{Offset: 32, Size: 4, Hash: bogus},
+			},
+		},
+	}
+
+	fchan, err := Walk(Config{
+		Dir:               "_incremental",
+		BlockSize:         16,
+		CurrentFiler:      cf,
+		IncrementalBlocks: true,
+		Hashers:           2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []protocol.FileInfo
+	for f := range fchan {
+		files = append(files, f)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, not %d", len(files))
+	}
+	f := files[0]
+	if f.Size != int64(len(data)) {
+		t.Errorf("incorrect size %d != %d", f.Size, len(data))
+	}
+	if len(f.Blocks) != 3 {
+		t.Fatalf("expected 3 blocks, not %d", len(f.Blocks))
+	}
+	for i := 0; i < 2; i++ {
+		if !bytes.Equal(f.Blocks[i].Hash, bogus) {
+			t.Errorf("block %d was not reused", i)
+		}
+	}
+	if bytes.Equal(f.Blocks[2].Hash, bogus) || f.Blocks[2].Offset != 32 || f.Blocks[2].Size != 8 {
+		t.Errorf("block 2 was not rehashed: %v", f.Blocks[2])
+	}
+}
+
+func TestWalkTrustModTime(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not tracked on Windows")
+	}
+
+	os.RemoveAll("_trust")
+	defer os.RemoveAll("_trust")
+
+	os.Mkdir("_trust", 0755)
+	if err := ioutil.WriteFile("_trust/file", []byte("0123456789abcdef0123"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat("_trust/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the permissions differ from last time. The hashes are bogus so
+	// that we can tell whether they were reused or recomputed.
+
+	bogus := bytes.Repeat([]byte{0x42}, 32)
+	cf := fakeCurrentFiler{
+		"file": protocol.FileInfo{
+			Name:        "file",
+			Type:        protocol.FileInfoTypeFile,
+			Size:        20,
+			Permissions: 0600,
+			ModifiedS:   info.ModTime().Unix(),
+			ModifiedNs:  int32(info.ModTime().Nanosecond()),
+			Blocks: []protocol.BlockInfo{
+				{Offset: 0, Size: 16, Hash: bogus},
+				{Offset: 16, Size: 4, Hash: bogus},
+			},
+		},
+	}
+
+	for _, trust := range []bool{true, false} {
+		fchan, err := Walk(Config{
+			Dir:                   "_trust",
+			BlockSize:             16,
+			CurrentFiler:          cf,
+			TrustModTime:          trust,
+			Hashers:               2,
+			ProgressTickIntervalS: -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+
+		if len(files) != 1 {
+			t.Fatalf("expected 1 file, not %d", len(files))
+		}
+		f := files[0]
+		if f.Permissions != 0644 {
+			t.Errorf("incorrect permissions %o", f.Permissions)
+		}
+		if len(f.Blocks) != 2 {
+			t.Fatalf("expected 2 blocks, not %d", len(f.Blocks))
+		}
+		if reused := bytes.Equal(f.Blocks[0].Hash, bogus); reused != trust {
+			t.Errorf("blocks reused %v with TrustModTime %v", reused, trust)
+		}
+	}
+}
+
+func TestScanErrorPhysicalPath(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("invalid UTF8 file names are not possible on this platform")
+	}
+
+	os.RemoveAll("testdata/physical")
+	os.Remove("testdata/physlink")
+	defer os.RemoveAll("testdata/physical")
+	defer os.Remove("testdata/physlink")
+
+	if err := osutil.MkdirAll("testdata/physical/folder", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("testdata/physical/folder/5-\xCD\xE2", []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("physical", "testdata/physlink"); err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []ScanError
+	fchan, err := Walk(Config{
+		Dir:       "testdata/physlink/folder",
+		BlockSize: 128 * 1024,
+		Hashers:   2,
+		ErrorFn:   func(e ScanError) { errs = append(errs, e) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+
+	if len(errs) != 1 {
+		t.Fatalf("expected one error, not %v", errs)
+	}
+	if errs[0].Path != "5-\xCD\xE2" {
+		t.Errorf("incorrect path %q", errs[0].Path)
+	}
+	if exp := filepath.Join("testdata", "physical", "folder", "5-\xCD\xE2"); errs[0].PhysicalPath != exp {
+		t.Errorf("incorrect physical path %q != %q", errs[0].PhysicalPath, exp)
+	}
+}
+
+func TestWalkPriorContent(t *testing.T) {
+	os.RemoveAll("_prior")
+	defer os.RemoveAll("_prior")
+
+	os.Mkdir("_prior", 0755)
+	prior := []byte("aaaaaaaaaaaaaaaabbbbbbbbbbbbbbbb")
+	data := []byte("ccccccccccccccccaaaaaaaaaaaaaaaabbbbbbbbbbbbbbbb")
+	for _, name := range []string{"file", "other"} {
+		if err := ioutil.WriteFile(filepath.Join("_prior", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The previous blocks have the correct weak hashes but bogus strong
+	// ones, so that we can tell whether they were reused.
+
+	bogus := bytes.Repeat([]byte{0x42}, 32)
+	priorBlocks, err := Blocks(bytes.NewReader(prior), 16, -1, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range priorBlocks {
+		priorBlocks[i].Hash = bogus
+	}
+	cf := fakeCurrentFiler{
+		"file":  protocol.FileInfo{Name: "file", Type: protocol.FileInfoTypeFile, Size: 32, Blocks: priorBlocks},
+		"other": protocol.FileInfo{Name: "other", Type: protocol.FileInfoTypeFile, Size: 32, Blocks: priorBlocks},
+	}
+
+	fchan, err := Walk(Config{
+		Dir:                  "_prior",
+		BlockSize:            16,
+		CurrentFiler:         cf,
+		PriorContentProvider: fakePriorContent{"file": prior},
+		UseWeakHashes:        true,
+		Hashers:              2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := Blocks(bytes.NewReader(data), 16, -1, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]protocol.FileInfo)
+	for f := range fchan {
+		files[f.Name] = f
+	}
+
+	// The shifted blocks of "file" are found in the previous contents,
+	// while "other" has no previous contents and is hashed in full.
+
+	f := files["file"]
+	if len(f.Blocks) != 3 {
+		t.Fatalf("expected 3 blocks, not %d", len(f.Blocks))
+	}
+	if !bytes.Equal(f.Blocks[0].Hash, expected[0].Hash) {
+		t.Error("block 0 was not hashed")
+	}
+	for i := 1; i < 3; i++ {
+		if !bytes.Equal(f.Blocks[i].Hash, bogus) {
+			t.Errorf("block %d was not reused", i)
+		}
+		if f.Blocks[i].Offset != expected[i].Offset || f.Blocks[i].WeakHash != expected[i].WeakHash {
+			t.Errorf("block %d mismatch: %v != %v", i, f.Blocks[i], expected[i])
+		}
+	}
+
+	if other := files["other"]; !BlocksEqual(other.Blocks, expected) {
+		t.Errorf("other was not hashed in full: %v", other.Blocks)
+	}
+}
+
+func TestBytesToHash(t *testing.T) {
+	prefix := []protocol.BlockInfo{{Size: 16}, {Size: 16}}
+	cases := []struct {
+		cfg      Config
+		file     protocol.FileInfo
+		expected int64
+	}{
+		{Config{}, protocol.FileInfo{Name: "file", Size: 40}, 40},
+		{Config{}, protocol.FileInfo{Name: "file", Size: 40, Blocks: prefix}, 8},
+		// The file has shrunk, so nothing can be reused
+		{Config{}, protocol.FileInfo{Name: "file", Size: 20, Blocks: prefix}, 20},
+		// The digests need the whole file
+		{Config{ExtraDigests: []DigestType{DigestMD5}, DigestFn: func(string, map[DigestType][]byte) {}}, protocol.FileInfo{Name: "file", Size: 40, Blocks: prefix}, 40},
+		{Config{NoHashExtensions: []string{"iso"}}, protocol.FileInfo{Name: "file.iso", Size: 40}, 0},
+		// All blocks go to BlockFn
+		{Config{StreamBlocksThreshold: 32, BlockFn: func(string, int, []byte, int64, int64) {}}, protocol.FileInfo{Name: "file", Size: 40, Blocks: prefix}, 40},
+		{Config{StreamBlocksThreshold: 64, BlockFn: func(string, int, []byte, int64, int64) {}}, protocol.FileInfo{Name: "file", Size: 40, Blocks: prefix}, 8},
+		// The decompressed contents are hashed in full
+		{Config{DecompressFilter: func(string) (ReaderWrapper, bool) { return nil, true }}, protocol.FileInfo{Name: "file", Size: 40, Blocks: prefix}, 40},
+		{Config{DecompressFilter: func(string) (ReaderWrapper, bool) { return nil, false }}, protocol.FileInfo{Name: "file", Size: 40, Blocks: prefix}, 8},
+	}
+
+	for i, tc := range cases {
+		if n := tc.cfg.bytesToHash(tc.file); n != tc.expected {
+			t.Errorf("case %d: %d bytes to hash, not %d", i, n, tc.expected)
+		}
+	}
+}
+
+func TestWalkHashTimings(t *testing.T) {
+	timings := metrics.NewHistogram(metrics.NewUniformSample(100))
+
+	fchan, err := Walk(Config{
+		Dir:         "testdata",
+		BlockSize:   128 * 1024,
+		Hashers:     2,
+		HashTimings: timings,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var blocks int64
+	for f := range fchan {
+		blocks += int64(len(f.Blocks))
+	}
+
+	if timings.Count() != blocks {
+		t.Errorf("expected %d timings, got %d", blocks, timings.Count())
+	}
+
+	// A pause in the next counter, as by a cpuThrottle, is not part of
+	// the time to hash the next block.
+	timings = metrics.NewHistogram(metrics.NewUniformSample(100))
+	c := newTimingCounter(sleepCounter(100*time.Millisecond), timings)
+	c.Update(1)
+	c.Update(1)
+	if max := time.Duration(timings.Max()); max >= 100*time.Millisecond {
+		t.Errorf("pause recorded as %v of hashing", max)
+	}
+}
+
+type sleepCounter time.Duration
+
+func (c sleepCounter) Update(bytes int64) {
+	time.Sleep(time.Duration(c))
+}
+
+func TestWalkPermissionChangeVersioning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not fully supported on Windows")
+	}
+
+	os.RemoveAll("_perms")
+	defer os.RemoveAll("_perms")
+
+	os.Mkdir("_perms", 0755)
+	if err := ioutil.WriteFile("_perms/file", []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat("_perms/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The current file is identical apart from the permissions.
+	version := protocol.Vector{}.Update(1)
+	cf := fakeCurrentFiler{
+		"file": protocol.FileInfo{
+			Name:        "file",
+			Type:        protocol.FileInfoTypeFile,
+			Size:        info.Size(),
+			ModifiedS:   info.ModTime().Unix(),
+			ModifiedNs:  int32(info.ModTime().Nanosecond()),
+			Permissions: 0600,
+			Version:     version,
+		},
+	}
+
+	for _, mode := range []PermissionChangeVersioning{PermissionChangeUpdateVersion, PermissionChangeKeepVersion} {
+		fchan, err := Walk(Config{
+			Dir:                        "_perms",
+			BlockSize:                  128 * 1024,
+			CurrentFiler:               cf,
+			ShortID:                    2,
+			Hashers:                    2,
+			PermissionChangeVersioning: mode,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+
+		if len(files) != 1 {
+			t.Fatalf("expected 1 file, not %d", len(files))
+		}
+		if files[0].Permissions != 0644 {
+			t.Errorf("incorrect permissions %o", files[0].Permissions)
+		}
+		kept := files[0].Version.Equal(version)
+		if kept != (mode == PermissionChangeKeepVersion) {
+			t.Errorf("mode %d: unexpected version %v", mode, files[0].Version)
+		}
+	}
+}
+
+func TestWalkScanNewerThan(t *testing.T) {
+	// Nothing in testdata can be newer than an hour from now, but the
+	// directories must still be descended into.
+	fchan, err := Walk(Config{
+		Dir:           "testdata",
+		BlockSize:     128 * 1024,
+		Hashers:       2,
+		ScanNewerThan: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for f := range fchan {
+		t.Errorf("unexpected file %v", f)
+	}
+
+	// The cutoff applies to the modification time from ModTimeFn.
+	later := time.Now().Add(2 * time.Hour)
+	fchan, err = Walk(Config{
+		Dir:           "testdata",
+		BlockSize:     128 * 1024,
+		Hashers:       2,
+		ScanNewerThan: time.Now().Add(time.Hour),
+		ModTimeFn: func(relPath string, info fs.FileInfo) time.Time {
+			if relPath == "afile" {
+				return later
+			}
+			return info.ModTime()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for f := range fchan {
+		names = append(names, f.Name)
+	}
+	if len(names) != 1 || names[0] != "afile" {
+		t.Errorf("unexpected items %v", names)
+	}
+}
+
+func TestScanControl(t *testing.T) {
+	c := newScanControl()
+	if !c.wait(nil) {
+		t.Fatal("unexpected cancel while not paused")
+	}
+
+	c.Pause()
+	if !c.Paused() {
+		t.Fatal("not paused after Pause")
+	}
+
+	res := make(chan bool)
+	go func() {
+		res <- c.wait(nil)
+	}()
+	select {
+	case <-res:
+		t.Fatal("wait returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.Resume()
+	if !<-res {
+		t.Error("unexpected cancel on resume")
+	}
+
+	c.Pause()
+	cancel := make(chan struct{})
+	close(cancel)
+	if c.wait(cancel) {
+		t.Error("expected cancel while paused")
+	}
+}
+
+func TestWalkExtraDigests(t *testing.T) {
+	var mut sync.Mutex
+	digests := make(map[string]map[DigestType][]byte)
+
+	fchan, err := Walk(Config{
+		Dir:          "testdata",
+		BlockSize:    128 * 1024,
+		Hashers:      2,
+		ExtraDigests: []DigestType{DigestMD5, DigestCRC32C},
+		DigestFn: func(relPath string, d map[DigestType][]byte) {
+			mut.Lock()
+			digests[relPath] = d
+			mut.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+
+	bs, err := ioutil.ReadFile("testdata/afile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md5sum := md5.Sum(bs)
+	crc := crc32.Checksum(bs, crc32.MakeTable(crc32.Castagnoli))
+
+	d, ok := digests["afile"]
+	if !ok {
+		t.Fatal("no digests for afile")
+	}
+	if !bytes.Equal(d[DigestMD5], md5sum[:]) {
+		t.Errorf("incorrect md5 %x != %x", d[DigestMD5], md5sum)
+	}
+	if got := binary.BigEndian.Uint32(d[DigestCRC32C]); got != crc {
+		t.Errorf("incorrect crc32c %08x != %08x", got, crc)
+	}
+}
+
+func TestWalkTempReaped(t *testing.T) {
+	os.RemoveAll("_temporaries")
+	defer os.RemoveAll("_temporaries")
+
+	os.Mkdir("_temporaries", 0755)
+	tempName := filepath.Join("_temporaries", ".syncthing.file.tmp")
+	if err := ioutil.WriteFile(tempName, []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(tempName, old, old)
+
+	var reaped []string
+	fchan, err := Walk(Config{
+		Dir:          "_temporaries",
+		BlockSize:    128 * 1024,
+		TempLifetime: time.Hour,
+		TempReapedFn: func(relPath string, size int64, modTime time.Time) {
+			if size != 4 {
+				t.Errorf("incorrect size %d for %s", size, relPath)
+			}
+			reaped = append(reaped, relPath)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+
+	if len(reaped) != 1 || reaped[0] != ".syncthing.file.tmp" {
+		t.Errorf("unexpected reaped files %v", reaped)
+	}
+	if _, err := os.Lstat(tempName); !os.IsNotExist(err) {
+		t.Error("temporary file was not removed")
+	}
+}
+
+func TestWalkReadOnly(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("the filesystem normalizes names on this platform")
+	}
+
+	os.RemoveAll("_readonly")
+	defer os.RemoveAll("_readonly")
+
+	os.Mkdir("_readonly", 0755)
+	tempName := filepath.Join("_readonly", ".syncthing.file.tmp")
+	nfdName := filepath.Join("_readonly", "a\u0308")
+	for _, name := range []string{tempName, nfdName} {
+		if err := ioutil.WriteFile(name, []byte("test"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(tempName, old, old)
+
+	fchan, err := Walk(Config{
+		Dir:                   "_readonly",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		TempLifetime:          time.Hour,
+		NormalizationForm:     NormalizationNFC,
+		AutoNormalize:         true,
+		SuppressWarnings:      true,
+		ReadOnly:              true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f := range fchan {
+		t.Errorf("unexpected file %s", f.Name)
+	}
+
+	for _, name := range []string{tempName, nfdName} {
+		if _, err := os.Lstat(name); err != nil {
+			t.Errorf("%s was changed: %v", name, err)
+		}
+	}
+
+	// Anything that slips through is refused.
+	var ro fs.Filesystem = readOnlyFilesystem{fs.DefaultFilesystem}
+	if err := ro.Remove(tempName); err != errReadOnly {
+		t.Errorf("unexpected error %v from Remove", err)
+	}
+}
+
+func TestWalkTempLifetimeFn(t *testing.T) {
+	os.RemoveAll("_temporaries")
+	defer os.RemoveAll("_temporaries")
+
+	os.Mkdir("_temporaries", 0755)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{".syncthing.keep.tmp", ".syncthing.reap.tmp", "~syncthing~never.tmp"} {
+		tempName := filepath.Join("_temporaries", name)
+		if err := ioutil.WriteFile(tempName, []byte("test"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(tempName, old, old)
+	}
+
+	fchan, err := Walk(Config{
+		Dir:          "_temporaries",
+		BlockSize:    128 * 1024,
+		TempLifetime: time.Hour,
+		TempLifetimeFn: func(relPath string) time.Duration {
+			switch relPath {
+			case ".syncthing.keep.tmp":
+				return 3 * time.Hour
+			case ".syncthing.reap.tmp":
+				return time.Hour
+			default:
+				return 0
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+
+	for name, exists := range map[string]bool{".syncthing.keep.tmp": true, ".syncthing.reap.tmp": false, "~syncthing~never.tmp": true} {
+		if _, err := os.Lstat(filepath.Join("_temporaries", name)); (err == nil) != exists {
+			t.Errorf("%s: expected exists to be %v", name, exists)
+		}
+	}
+}
+
+func TestWalkScanInternal(t *testing.T) {
+	for _, scanInternal := range []bool{false, true} {
+		fchan, err := Walk(Config{
+			Dir:          "testdata",
+			BlockSize:    128 * 1024,
+			Hashers:      2,
+			ScanInternal: scanInternal,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for f := range fchan {
+			if f.Name == ".stignore" {
+				found = true
+			}
+		}
+		if found != scanInternal {
+			t.Errorf("ScanInternal %v: .stignore found is %v", scanInternal, found)
+		}
+	}
+}
+
+func TestWalkIsInternal(t *testing.T) {
+	fchan, err := Walk(Config{
+		Dir:       "testdata",
+		BlockSize: 128 * 1024,
+		Hashers:   2,
+		IsInternal: func(relPath string) bool {
+			return relPath == "afile"
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var foundAfile, foundStignore bool
+	for f := range fchan {
+		switch f.Name {
+		case "afile":
+			foundAfile = true
+		case ".stignore":
+			foundStignore = true
+		}
+	}
+	if foundAfile {
+		t.Error("afile should have been skipped as internal")
+	}
+	if !foundStignore {
+		t.Error(".stignore should have been scanned")
+	}
+}
+
+func TestWalkSkipFn(t *testing.T) {
+	os.RemoveAll("_skips")
+	defer os.RemoveAll("_skips")
+
+	os.MkdirAll("_skips/.stfolder", 0755)
+	os.MkdirAll("_skips/ignored", 0755)
+	for _, name := range []string{"file", ".syncthing.file.tmp", "ignored/file", "large-file"} {
+		if err := ioutil.WriteFile(filepath.Join("_skips", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ignores := ignore.New(false)
+	if err := ignores.Parse(bytes.NewBufferString("ignored\n"), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+
+	skipped := make(map[string]SkipReason)
+	fchan, err := Walk(Config{
+		Dir:                   "_skips",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		Matcher:               ignores,
+		MaxFileSize:           4,
+		FileSizePolicy:        FileSizeSkip,
+		SkipFn: func(relPath string, reason SkipReason) {
+			skipped[relPath] = reason
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range fchan {
+	}
+
+	expected := map[string]SkipReason{
+		".stfolder":           SkipInternal,
+		".syncthing.file.tmp": SkipTemporary,
+		"ignored":             SkipIgnored,
+		"large-file":          SkipSize,
+	}
+	if !reflect.DeepEqual(skipped, expected) {
+		t.Errorf("unexpected skips %v", skipped)
+	}
+}
+
+func TestWalkSkipDirMarkers(t *testing.T) {
+	os.RemoveAll("_markers")
+	defer os.RemoveAll("_markers")
+
+	os.MkdirAll("_markers/cache/sub", 0755)
+	os.MkdirAll("_markers/keep", 0755)
+	for _, name := range []string{"cache/CACHEDIR.TAG", "cache/sub/file", "keep/file"} {
+		if err := ioutil.WriteFile(filepath.Join("_markers", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, emit := range []bool{false, true} {
+		skipped := make(map[string]SkipReason)
+		fchan, err := Walk(Config{
+			Dir:                   "_markers",
+			BlockSize:             128 * 1024,
+			Hashers:               2,
+			ProgressTickIntervalS: -1,
+			SkipDirMarkers:        []string{".nobackup", "CACHEDIR.TAG"},
+			EmitMarkedDirs:        emit,
+			SkipFn: func(relPath string, reason SkipReason) {
+				skipped[relPath] = reason
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for f := range fchan {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+
+		expected := []string{"keep", filepath.Join("keep", "file")}
+		if emit {
+			expected = append([]string{"cache"}, expected...)
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("EmitMarkedDirs %v: unexpected items %v", emit, names)
+		}
+		if !reflect.DeepEqual(skipped, map[string]SkipReason{"cache": SkipMarkedDir}) {
+			t.Errorf("EmitMarkedDirs %v: unexpected skips %v", emit, skipped)
+		}
+	}
+}
+
+func TestScanBlockHashes(t *testing.T) {
+	os.RemoveAll("_blockrefs")
+	defer os.RemoveAll("_blockrefs")
+
+	os.Mkdir("_blockrefs", 0755)
+	files := map[string][]byte{
+		"a": bytes.Repeat([]byte("x"), 32),
+		"b": bytes.Repeat([]byte("x"), 16),
+		"c": []byte("something else"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join("_blockrefs", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	refs, err := ScanBlockHashes(Config{
+		Dir:                   "_blockrefs",
+		BlockSize:             16,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := make(map[string]BlockRef)
+	for ref := range refs {
+		if _, ok := hashes[string(ref.Hash)]; ok {
+			t.Errorf("duplicate block %v", ref)
+		}
+		hashes[string(ref.Hash)] = ref
+	}
+
+	if len(hashes) != 2 {
+		t.Fatalf("expected two distinct blocks, got %d", len(hashes))
+	}
+	other := sha256.Sum256(files["c"])
+	if ref, ok := hashes[string(other[:])]; !ok || ref.Path != "c" || ref.Offset != 0 || ref.Size != 14 {
+		t.Errorf("unexpected block for c: %v", ref)
+	}
+}
+
+func TestWalkResolveDirSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping unsupported symlink test")
+	}
+
+	os.Remove("_dirlink")
+	defer os.Remove("_dirlink")
+	if err := os.Symlink("testdata", "_dirlink"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		Dir:                   "_dirlink",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+	}
+	if _, err := Walk(cfg); err == nil {
+		t.Error("expected an error walking a symlinked Dir by default")
+	}
+
+	cfg.ResolveDirSymlink = true
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for f := range fchan {
+		if f.Name == "afile" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected the target of the symlink to be walked")
+	}
+}
+
+func TestNewWalkFuncResolveDirSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping unsupported symlink test")
+	}
+
+	os.Remove("_dirlink")
+	defer os.Remove("_dirlink")
+	if err := os.Symlink("testdata", "_dirlink"); err != nil {
+		t.Fatal(err)
+	}
+
+	walkFn, fchan, finish, err := NewWalkFunc(Config{
+		Dir:               "_dirlink",
+		BlockSize:         128 * 1024,
+		Hashers:           2,
+		ResolveDirSymlink: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		filepath.Walk(filepath.Join("_dirlink", "dir1"), walkFn)
+		finish()
+	}()
+
+	var names []string
+	for f := range fchan {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+
+	expected := []string{"dir1", filepath.Join("dir1", "cfile"), filepath.Join("dir1", "dfile")}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected items %v, expected %v", names, expected)
+	}
+}
+
+type fakeCheckpointer struct {
+	mut       sync.Mutex
+	completed []Checkpoint
+	saved     []string
+	flushes   int
+}
+
+func (c *fakeCheckpointer) Save(cp Checkpoint) {
+	c.mut.Lock()
+	c.saved = append(c.saved, cp.Name)
+	c.mut.Unlock()
+}
+
+func (c *fakeCheckpointer) Completed() []Checkpoint {
+	return c.completed
+}
+
+func (c *fakeCheckpointer) Flush() {
+	c.mut.Lock()
+	c.flushes++
+	c.mut.Unlock()
+}
+
+func TestWalkCheckpointer(t *testing.T) {
+	checkpoint := func(name string) Checkpoint {
+		info, err := os.Stat(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Checkpoint{Name: name, Size: info.Size(), ModTime: info.ModTime()}
+	}
+	changed := checkpoint("bfile")
+	changed.ModTime = changed.ModTime.Add(-time.Second)
+	cp := &fakeCheckpointer{completed: []Checkpoint{checkpoint("afile"), changed}}
+	fchan, control, err := WalkWithControl(Config{
+		Dir:                   "testdata",
+		Subs:                  []string{"afile", "bfile", "dir1"},
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		Checkpointer:          cp,
+		CheckpointInterval:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	for f := range fchan {
+		if !f.IsDirectory() {
+			files = append(files, f.Name)
+			if f.Name != "bfile" {
+				// Not stored, as if we crashed first.
+				control.Stored(f.Name)
+			}
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(cp.saved)
+
+	expected := []string{"bfile", filepath.Join("dir1", "cfile"), filepath.Join("dir1", "dfile")}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected the unchanged completed file to be skipped, got %v", files)
+	}
+	if expected := expected[1:]; !reflect.DeepEqual(cp.saved, expected) {
+		t.Errorf("unexpected files saved %v", cp.saved)
+	}
+	// What's stored after all are hashed is passed on at once, so there
+	// may be a flush for each of those.
+	if cp.flushes < 1 {
+		t.Errorf("expected a flush, got %d", cp.flushes)
+	}
+}
+
+func TestWalkMinFreeSpace(t *testing.T) {
+	defer func() { diskFreeBytes = osutil.DiskFreeBytes }()
+	diskFreeBytes = func(string) (int64, error) { return 1000, nil }
+
+	os.RemoveAll("_lowspace")
+	defer os.RemoveAll("_lowspace")
+
+	os.MkdirAll("_lowspace/dir", 0755)
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"file", "dir/file", "dir/.syncthing.file.tmp"} {
+		path := filepath.Join("_lowspace", name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, minFree := range []int64{1001, 1000} {
+		var errs []ScanError
+		fchan, err := Walk(Config{
+			Dir:                   "_lowspace",
+			BlockSize:             128 * 1024,
+			Hashers:               2,
+			ProgressTickIntervalS: -1,
+			TempLifetime:          time.Hour,
+			MinFreeSpaceBytes:     minFree,
+			ErrorFn: func(e ScanError) {
+				errs = append(errs, e)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for range fchan {
+			n++
+		}
+
+		if minFree == 1000 {
+			if n != 3 || len(errs) != 0 {
+				t.Errorf("with enough space, expected 3 items and no errors, got %d and %v", n, errs)
+			}
+			continue
+		}
+		if n != 0 {
+			t.Errorf("expected nothing to be returned when low on space, got %d items", n)
+		}
+		if len(errs) != 1 || errs[0].Err != errLowSpace {
+			t.Errorf("expected the low space to be reported, got %v", errs)
+		}
+		if _, err := os.Stat("_lowspace/dir/.syncthing.file.tmp"); !os.IsNotExist(err) {
+			t.Error("expected the expired temporary file to be removed")
+		}
+	}
+}
+
+func TestWalkSkipHidden(t *testing.T) {
+	os.RemoveAll("_hidden")
+	defer os.RemoveAll("_hidden")
+
+	os.MkdirAll("_hidden/.dir", 0755)
+	for _, name := range []string{"visible", ".hidden", ".dir/file"} {
+		if err := ioutil.WriteFile(filepath.Join("_hidden", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		for _, name := range []string{".hidden", ".dir"} {
+			if err := osutil.HideFile(filepath.Join("_hidden", name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	skipped := make(map[string]SkipReason)
+	fchan, err := Walk(Config{
+		Dir:                   "_hidden",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		SkipHidden:            true,
+		SkipFn: func(relPath string, reason SkipReason) {
+			skipped[relPath] = reason
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for f := range fchan {
+		names = append(names, f.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"visible"}) {
+		t.Errorf("expected only the visible file, got %v", names)
+	}
+	expected := map[string]SkipReason{".hidden": SkipHidden, ".dir": SkipHidden}
+	if !reflect.DeepEqual(skipped, expected) {
+		t.Errorf("unexpected skips %v", skipped)
+	}
+}
+
+func TestWalkDecompressFilter(t *testing.T) {
+	os.RemoveAll("_decompress")
+	defer os.RemoveAll("_decompress")
+	os.Mkdir("_decompress", 0755)
+
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	for name, level := range map[string]int{"fast.gz": gzip.BestSpeed, "best.gz": gzip.BestCompression} {
+		var buf bytes.Buffer
+		gw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gw.Write(data)
+		gw.Close()
+		if err := ioutil.WriteFile(filepath.Join("_decompress", name), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join("_decompress", "fake.gz"), []byte("not gzip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mut sync.Mutex
+	var decompressed []string
+	cfg := Config{
+		Dir:                   "_decompress",
+		BlockSize:             1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		DecompressFilter: func(relPath string) (ReaderWrapper, bool) {
+			if filepath.Ext(relPath) != ".gz" {
+				return nil, false
+			}
+			return func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			}, true
+		},
+		DecompressedFn: func(relPath string) {
+			mut.Lock()
+			decompressed = append(decompressed, relPath)
+			mut.Unlock()
+		},
+	}
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(fakeCurrentFiler)
+	for f := range fchan {
+		files[f.Name] = f
+	}
+
+	fast, best := files["fast.gz"], files["best.gz"]
+	if fast.Size != int64(len(data)) || !BlocksEqual(fast.Blocks, best.Blocks) {
+		t.Errorf("expected the same decompressed blocks, got %d bytes in %d and %d blocks", fast.Size, len(fast.Blocks), len(best.Blocks))
+	}
+	if !fast.Decompressed || !best.Decompressed {
+		t.Error("expected the decompressed files to be marked as such")
+	}
+	if fake := files["fake.gz"]; fake.Size != 8 || len(fake.Blocks) != 1 || fake.Decompressed {
+		t.Errorf("expected the raw contents of fake.gz, got %v", fake)
+	}
+	sort.Strings(decompressed)
+	if !reflect.DeepEqual(decompressed, []string{"best.gz", "fast.gz"}) {
+		t.Errorf("unexpected decompressed files %v", decompressed)
+	}
+
+	// The decompressed size is not the size on disk, but the files are
+	// unchanged all the same.
+	cfg.CurrentFiler = files
+	fchan, err = Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f := range fchan {
+		t.Errorf("unexpected change %v", f)
+	}
+}
+
+func walkDir(dir string) ([]protocol.FileInfo, error) {
+	fchan, err := Walk(Config{
+		Dir:           dir,
+		BlockSize:     128 * 1024,
+		AutoNormalize: true,
+		Hashers:       2,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var tmp []protocol.FileInfo
+	for f := range fchan {
+		tmp = append(tmp, f)
+	}
+	sort.Sort(fileList(tmp))
+
+	return tmp, nil
+}
+
+type fileList []protocol.FileInfo
+
+func (l fileList) Len() int {
+	return len(l)
+}
+
+func (l fileList) Less(a, b int) bool {
+	return l[a].Name < l[b].Name
+}
+
+func (l fileList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+func (l fileList) testfiles() testfileList {
+	testfiles := make(testfileList, len(l))
+	for i, f := range l {
+		if len(f.Blocks) > 1 {
+			panic("simple test case stuff only supports a single block per file")
+		}
+		testfiles[i] = testfile{name: f.Name, length: f.FileSize()}
+		if len(f.Blocks) == 1 {
+			testfiles[i].hash = fmt.Sprintf("%x", f.Blocks[0].Hash)
+		}
+	}
+	return testfiles
+}
+
+func (l testfileList) String() string {
+	var b bytes.Buffer
+	b.WriteString("{\n")
+	for _, f := range l {
+		fmt.Fprintf(&b, "  %s (%d bytes): %s\n", f.name, f.length, f.hash)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+type fakeCurrentFiler map[string]protocol.FileInfo
+
+func (fcf fakeCurrentFiler) CurrentFile(name string) (protocol.FileInfo, bool) {
+	f, ok := fcf[name]
+	return f, ok
+}
+
+// fakeDirCurrentFiler counts the lookups made through it.
+type fakeDirCurrentFiler struct {
+	fakeCurrentFiler
+	mut    sync.Mutex
+	single int
+	dirs   map[string]int
+}
+
+func (f *fakeDirCurrentFiler) CurrentFile(name string) (protocol.FileInfo, bool) {
+	f.mut.Lock()
+	f.single++
+	f.mut.Unlock()
+	return f.fakeCurrentFiler.CurrentFile(name)
+}
+
+func (f *fakeDirCurrentFiler) CurrentFilesInDir(dir string) map[string]protocol.FileInfo {
+	f.mut.Lock()
+	f.dirs[dir]++
+	f.mut.Unlock()
+	files := make(map[string]protocol.FileInfo)
+	for name, cf := range f.fakeCurrentFiler {
+		if filepath.Dir(name) == dir {
+			files[name] = cf
+		}
+	}
+	return files
+}
+
+type fakePriorContent map[string][]byte
+
+func (fpc fakePriorContent) PriorContent(relPath string) (io.ReaderAt, error) {
+	bs, ok := fpc[relPath]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return bytes.NewReader(bs), nil
+}
+
+var initOnce sync.Once
+
+const (
+	testdataSize = 17 << 20
+	testdataName = "_random.data"
+)
+
+func BenchmarkHashFile(b *testing.B) {
+	initOnce.Do(initTestFile)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := HashFile(fs.DefaultFilesystem, testdataName, protocol.BlockSize, nil, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.SetBytes(testdataSize)
+	b.ReportAllocs()
+}
+
+func BenchmarkHashFileNoWeakHashes(b *testing.B) {
+	initOnce.Do(initTestFile)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := HashFile(fs.DefaultFilesystem, testdataName, protocol.BlockSize, nil, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.SetBytes(testdataSize)
+	b.ReportAllocs()
+}
+
+func initTestFile() {
+	fd, err := os.Create(testdataName)
+	if err != nil {
+		panic(err)
+	}
+
+	lr := io.LimitReader(rand.Reader, testdataSize)
+	if _, err := io.Copy(fd, lr); err != nil {
+		panic(err)
+	}
+
+	if err := fd.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func TestWalkContentSniffFilter(t *testing.T) {
+	os.RemoveAll("_sniff")
+	defer os.RemoveAll("_sniff")
+
+	os.Mkdir("_sniff", 0755)
+	if err := ioutil.WriteFile("_sniff/archive", []byte("PK\x03\x04rest of the archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("_sniff/text", []byte("just some text"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mut sync.Mutex
+	var errored []string
+	fchan, err := Walk(Config{
+		Dir:                   "_sniff",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+		ContentSniffSize:      4,
+		ContentSniffFilter: func(header []byte, relPath string) bool {
+			if len(header) > 4 {
+				t.Errorf("%s: got %d bytes to sniff, expected at most 4", relPath, len(header))
+			}
+			return bytes.HasPrefix(header, []byte("PK\x03\x04"))
+		},
+		ErrorFn: func(e ScanError) {
+			mut.Lock()
+			defer mut.Unlock()
+			if e.Err != errFilteredByContent {
+				t.Errorf("unexpected error for %s: %v", e.Path, e.Err)
+			}
+			errored = append(errored, e.Path)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for f := range fchan {
+		names = append(names, f.Name)
+	}
+
+	if len(names) != 1 || names[0] != "text" {
+		t.Errorf("expected only text to be returned, not %v", names)
+	}
+	if len(errored) != 1 || errored[0] != "archive" {
+		t.Errorf("expected archive to be reported, not %v", errored)
+	}
+}
+
+func TestWalkAuditOnly(t *testing.T) {
+	os.RemoveAll("_audit")
+	defer os.RemoveAll("_audit")
+
+	os.MkdirAll("_audit/dir", 0755)
+	for _, name := range []string{"good", "bad", "dir/good"} {
+		if err := ioutil.WriteFile(filepath.Join("_audit", name), []byte("contents of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := Config{
+		Dir:                   "_audit",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+	}
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(fakeCurrentFiler)
+	for f := range fchan {
+		files[f.Name] = f
+	}
+
+	// Same size and modification time, different contents.
+	info, err := os.Stat("_audit/bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("_audit/bad", []byte("contents of BAD"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes("_audit/bad", info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	// Not in the index, so not audited.
+	if err := ioutil.WriteFile("_audit/new", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mut sync.Mutex
+	var errored []ScanError
+	cfg.CurrentFiler = files
+	cfg.AuditOnly = true
+	cfg.ErrorFn = func(e ScanError) {
+		mut.Lock()
+		errored = append(errored, e)
+		mut.Unlock()
+	}
+	fchan, err = Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f := range fchan {
+		t.Errorf("unexpected change %v", f)
+	}
+
+	if len(errored) != 1 || errored[0].Path != "bad" || errored[0].Err != errContentDiffers {
+		t.Errorf("expected only bad to differ, not %v", errored)
+	}
+}
+
+func TestWalkPhaseFn(t *testing.T) {
+	for _, tick := range []int{-1, 1} {
+		var mut sync.Mutex
+		var phases []ScanPhase
+		cfg := Config{
+			Dir:                   "testdata",
+			BlockSize:             128 * 1024,
+			Hashers:               2,
+			ProgressTickIntervalS: tick,
+			PhaseFn: func(phase ScanPhase) {
+				mut.Lock()
+				phases = append(phases, phase)
+				mut.Unlock()
+			},
+		}
+		fchan, control, err := WalkWithControl(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range fchan {
+			if phase := control.Phase(); phase == PhaseStarting {
+				t.Errorf("tick %d: got phase %v while receiving files", tick, phase)
+			}
+		}
+
+		expected := []ScanPhase{PhaseEnumerating, PhaseHashing, PhaseDone}
+		mut.Lock()
+		if !reflect.DeepEqual(phases, expected) {
+			t.Errorf("tick %d: phases %v, expected %v", tick, phases, expected)
+		}
+		mut.Unlock()
+		if phase := control.Phase(); phase != PhaseDone {
+			t.Errorf("tick %d: final phase %v, expected %v", tick, phase, PhaseDone)
+		}
+	}
+}
+
+func TestWalkContentDedup(t *testing.T) {
+	os.RemoveAll("_dedup")
+	defer os.RemoveAll("_dedup")
+	os.Mkdir("_dedup", 0755)
+	files := map[string]string{
+		"a":     "same contents",
+		"b":     "same contents",
+		"c":     "same contents",
+		"other": "other contents",
+		"large": "same contents, but too large",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join("_dedup", name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mut sync.Mutex
+	dups := make(map[string]string)
+	cfg := Config{
+		Dir:                   "_dedup",
+		BlockSize:             128 * 1024,
+		Hashers:               1,
+		Deterministic:         true,
+		ProgressTickIntervalS: -1,
+		ContentDedup:          true,
+		ContentDedupMaxSize:   20,
+		DuplicateFn: func(relPath, firstPath string) {
+			mut.Lock()
+			dups[relPath] = firstPath
+			mut.Unlock()
+		},
+	}
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := make(map[string][]protocol.BlockInfo)
+	for f := range fchan {
+		blocks[f.Name] = f.Blocks
+	}
+
+	expected := map[string]string{"b": "a", "c": "a"}
+	mut.Lock()
+	if !reflect.DeepEqual(dups, expected) {
+		t.Errorf("duplicates %v, expected %v", dups, expected)
+	}
+	mut.Unlock()
+	for name := range files {
+		if len(blocks[name]) != 1 {
+			t.Fatalf("%s: got %d blocks, expected 1", name, len(blocks[name]))
+		}
+	}
+	if &blocks["b"][0] != &blocks["a"][0] {
+		t.Error("duplicate doesn't share the block list of the first")
+	}
+}
+
+var errFakeTransient = errors.New("transient")
+
+// flakyLstatFilesystem fails to look up items named "flaky" while failures
+// is above zero, counting it down with every attempt.
+type flakyLstatFilesystem struct {
+	fs.Filesystem
+	failures *int32
+}
+
+func (f flakyLstatFilesystem) Lstat(name string) (fs.FileInfo, error) {
+	if filepath.Base(name) == "flaky" && atomic.AddInt32(f.failures, -1) >= 0 {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: errFakeTransient}
+	}
+	return f.Filesystem.Lstat(name)
+}
+
+func TestWalkLstatRetries(t *testing.T) {
+	defer func(fn func(error) bool) { transientError = fn }(transientError)
+	transientError = func(err error) bool {
+		if perr, ok := err.(*os.PathError); ok {
+			err = perr.Err
+		}
+		return err == errFakeTransient
+	}
+
+	os.RemoveAll("_lstatretry")
+	defer os.RemoveAll("_lstatretry")
+	os.Mkdir("_lstatretry", 0755)
+	if err := ioutil.WriteFile(filepath.Join("_lstatretry", "flaky"), []byte("flaky"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(failures int32) ([]protocol.FileInfo, []ScanError) {
+		var errs []ScanError
+		fchan, err := Walk(Config{
+			Dir:                   "_lstatretry",
+			BlockSize:             128 * 1024,
+			Hashers:               1,
+			ProgressTickIntervalS: -1,
+			Filesystem:            flakyLstatFilesystem{fs.DefaultFilesystem, &failures},
+			LstatRetries:          2,
+			LstatRetryDelay:       time.Millisecond,
+			ErrorFn:               func(e ScanError) { errs = append(errs, e) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		return files, errs
+	}
+
+	// Found after the second retry.
+	files, errs := walk(2)
+	if len(files) != 1 || files[0].Name != "flaky" {
+		t.Errorf("expected the file to be found, got %v", files)
+	}
+	if len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	// Still failing after all retries.
+	files, errs = walk(3)
+	if len(files) != 0 {
+		t.Errorf("expected no files, got %v", files)
+	}
+	if len(errs) != 1 || errs[0].Path != "flaky" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestWalkSerialized(t *testing.T) {
+	cfg := Config{
+		Dir:                   "testdata",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+	}
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]protocol.FileInfo)
+	for f := range fchan {
+		expected[f.Name] = f
+	}
+
+	bchan, err := WalkSerialized(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for bs := range bchan {
+		var f protocol.FileInfo
+		if err := f.Unmarshal(bs); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		// The names are as on the wire.
+		e, ok := expected[filepath.FromSlash(f.Name)]
+		if !ok || f.Name != filepath.ToSlash(e.Name) {
+			t.Errorf("unexpected file %s", f.Name)
+			continue
+		}
+		if f.Size != e.Size || f.ModifiedS != e.ModifiedS || f.Type != e.Type || !BlocksEqual(f.Blocks, e.Blocks) {
+			t.Errorf("%s: got %v, expected %v", f.Name, f, e)
+		}
+	}
+	if n != len(expected) {
+		t.Errorf("got %d files, expected %d", n, len(expected))
+	}
+}
+
+func TestWalkDetectSymlinkLoops(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping unsupported symlink test")
+	}
+
+	os.RemoveAll("_symloops")
+	defer os.RemoveAll("_symloops")
+
+	os.Mkdir("_symloops", 0755)
+	if err := ioutil.WriteFile("_symloops/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := [][2]string{
+		{"file", "one"},
+		{"one", "two"},
+		{"self", "self"},
+		{"loopb", "loopa"},
+		{"loopa", "loopb"},
+		{"loopa", "intoloop"},
+		{"missing", "broken"},
+	}
+	for _, link := range links {
+		if err := os.Symlink(link[0], filepath.Join("_symloops", link[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(maxDepth int) ([]string, map[string]error) {
+		var mut sync.Mutex
+		errs := make(map[string]error)
+		fchan, err := Walk(Config{
+			Dir:                   "_symloops",
+			BlockSize:             128 * 1024,
+			Hashers:               2,
+			ProgressTickIntervalS: -1,
+			DetectSymlinkLoops:    true,
+			MaxSymlinkDepth:       maxDepth,
+			ErrorFn: func(err ScanError) {
+				mut.Lock()
+				errs[err.Path] = err.Err
+				mut.Unlock()
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var returned []string
+		for f := range fchan {
+			if f.IsSymlink() {
+				returned = append(returned, f.Name)
+			}
+		}
+		sort.Strings(returned)
+		return returned, errs
+	}
+
+	// Loops are reported, but returned all the same.
+	returned, errs := walk(0)
+	if !reflect.DeepEqual(returned, []string{"broken", "intoloop", "loopa", "loopb", "one", "self", "two"}) {
+		t.Errorf("unexpected symlinks returned: %v", returned)
+	}
+	expected := map[string]error{
+		"self":     errSymlinkChainLoop,
+		"loopa":    errSymlinkChainLoop,
+		"loopb":    errSymlinkChainLoop,
+		"intoloop": errSymlinkChainLoop,
+	}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	// With MaxSymlinkDepth, they are still reported as loops, but left
+	// out.
+	returned, errs = walk(10)
+	if !reflect.DeepEqual(returned, []string{"broken", "one", "two"}) {
+		t.Errorf("unexpected symlinks returned with MaxSymlinkDepth: %v", returned)
+	}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("unexpected errors with MaxSymlinkDepth %v", errs)
+	}
+}
+
+func TestWalkMaxDepth(t *testing.T) {
+	os.RemoveAll("_maxdepth")
+	defer os.RemoveAll("_maxdepth")
+	if err := os.MkdirAll(filepath.Join("_maxdepth", "a", "b", "c"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"top", "a/one", "a/b/two", "a/b/c/three"} {
+		if err := ioutil.WriteFile(filepath.Join("_maxdepth", filepath.FromSlash(name)), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		maxDepth int
+		expected []string
+	}{
+		{0, []string{"a", "a/b", "a/b/c", "a/b/c/three", "a/b/two", "a/one", "top"}},
+		{1, []string{"a", "top"}},
+		{2, []string{"a", "a/b", "a/one", "top"}},
+	}
+	for _, tc := range cases {
+		fchan, err := Walk(Config{
+			Dir:                   "_maxdepth",
+			BlockSize:             128 * 1024,
+			Hashers:               2,
+			ProgressTickIntervalS: -1,
+			MaxDepth:              tc.maxDepth,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for f := range fchan {
+			names = append(names, filepath.ToSlash(f.Name))
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("max depth %d: got %v, expected %v", tc.maxDepth, names, tc.expected)
+		}
+	}
+}
+
+func TestWalkScanNewerThanPruning(t *testing.T) {
+	os.RemoveAll("_newerprune")
+	defer os.RemoveAll("_newerprune")
+	if err := os.MkdirAll(filepath.Join("_newerprune", "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join("_newerprune", "marked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"old", "marked/.nobackup", "marked/new", "a/b/new"} {
+		if err := ioutil.WriteFile(filepath.Join("_newerprune", filepath.FromSlash(name)), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Everything but the new files is older than the cutoff.
+	old := time.Now().Add(-24 * time.Hour)
+	for _, name := range []string{"old", "marked/.nobackup", "marked", "a/b", "a"} {
+		if err := os.Chtimes(filepath.Join("_newerprune", filepath.FromSlash(name)), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		maxDepth int
+		expected []string
+	}{
+		// Old directories are descended into, but the marked one is
+		// still skipped.
+		{0, []string{"a/b/new"}},
+		// Old directories are pruned at the maximum depth.
+		{2, nil},
+	}
+	for _, tc := range cases {
+		fchan, err := Walk(Config{
+			Dir:                   "_newerprune",
+			BlockSize:             128 * 1024,
+			Hashers:               2,
+			ProgressTickIntervalS: -1,
+			ScanNewerThan:         time.Now().Add(-time.Hour),
+			SkipDirMarkers:        []string{".nobackup"},
+			MaxDepth:              tc.maxDepth,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for f := range fchan {
+			names = append(names, filepath.ToSlash(f.Name))
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("max depth %d: got %v, expected %v", tc.maxDepth, names, tc.expected)
+		}
+	}
+}
+
+// vanishingFilesystem pretends that items named "vanishing" have been
+// deleted, once the walk has found them.
+type vanishingFilesystem struct {
+	fs.Filesystem
+}
+
+func (f vanishingFilesystem) Lstat(name string) (fs.FileInfo, error) {
+	if filepath.Base(name) == "vanishing" {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	}
+	return f.Filesystem.Lstat(name)
+}
+
+func TestWalkVanished(t *testing.T) {
+	os.RemoveAll("_vanished")
+	defer os.RemoveAll("_vanished")
+	os.Mkdir("_vanished", 0755)
+	for _, name := range []string{"vanishing", "staying"} {
+		if err := ioutil.WriteFile(filepath.Join("_vanished", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cf := fakeCurrentFiler{
+		"vanishing": protocol.FileInfo{Name: "vanishing", Type: protocol.FileInfoTypeFile, Size: 9, Version: protocol.Vector{}.Update(1)},
+	}
+	for _, emitDeletes := range []bool{false, true} {
+		var errs []ScanError
+		var skipped []SkipReason
+		fchan, err := Walk(Config{
+			Dir:                   "_vanished",
+			BlockSize:             128 * 1024,
+			Hashers:               1,
+			ProgressTickIntervalS: -1,
+			Filesystem:            vanishingFilesystem{fs.DefaultFilesystem},
+			CurrentFiler:          cf,
+			EmitDeletes:           emitDeletes,
+			ErrorFn:               func(e ScanError) { errs = append(errs, e) },
+			SkipFn: func(relPath string, reason SkipReason) {
+				skipped = append(skipped, reason)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]protocol.FileInfo)
+		for f := range fchan {
+			files[f.Name] = f
+		}
+
+		if _, ok := files["staying"]; !ok {
+			t.Errorf("emit deletes %v: staying file missing", emitDeletes)
+		}
+		if !reflect.DeepEqual(skipped, []SkipReason{SkipVanished}) {
+			t.Errorf("emit deletes %v: unexpected skips %v", emitDeletes, skipped)
+		}
+		f, ok := files["vanishing"]
+		if emitDeletes {
+			if !ok || !f.IsDeleted() {
+				t.Errorf("expected a delete, got %v", f)
+			}
+			if len(errs) != 0 {
+				t.Errorf("unexpected errors %v", errs)
+			}
+		} else {
+			if ok {
+				t.Errorf("unexpected file %v", f)
+			}
+			if len(errs) != 1 || errs[0].Path != "vanishing" || errs[0].Err != errVanished {
+				t.Errorf("unexpected errors %v", errs)
+			}
+		}
+	}
+}
+
+// flickeringFilesystem pretends that items named "flickering" have been
+// deleted, once the walk has found them, while gone is set.
+type flickeringFilesystem struct {
+	fs.Filesystem
+	gone *bool
+}
+
+func (f flickeringFilesystem) Lstat(name string) (fs.FileInfo, error) {
+	if *f.gone && filepath.Base(name) == "flickering" {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	}
+	return f.Filesystem.Lstat(name)
+}
+
+func TestWalkVanishedGracePeriod(t *testing.T) {
+	os.RemoveAll("_flickering")
+	defer os.RemoveAll("_flickering")
+	os.Mkdir("_flickering", 0755)
+	if err := ioutil.WriteFile(filepath.Join("_flickering", "flickering"), []byte("flickering"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { timeNow = time.Now }()
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	cf := &fakeMissingCurrentFiler{
+		fakeCurrentFiler: fakeCurrentFiler{
+			"flickering": protocol.FileInfo{Name: "flickering", Type: protocol.FileInfoTypeFile, Size: 10, Version: protocol.Vector{}.Update(1)},
+		},
+		missing: make(map[string]time.Time),
+	}
+	gone := false
+	cfg := Config{
+		Dir:                   "_flickering",
+		BlockSize:             128 * 1024,
+		Hashers:               1,
+		ProgressTickIntervalS: -1,
+		Filesystem:            flickeringFilesystem{fs.DefaultFilesystem, &gone},
+		CurrentFiler:          cf,
+		EmitDeletes:           true,
+		DeleteGracePeriod:     time.Minute,
+	}
+	deletes := func() int {
+		fchan, err := Walk(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for f := range fchan {
+			if f.IsDeleted() {
+				n++
+			}
+		}
+		return n
+	}
+
+	gone = true
+	if n := deletes(); n != 0 {
+		t.Errorf("expected no deletes on first sight, got %d", n)
+	}
+
+	gone = false
+	now = now.Add(30 * time.Second)
+	deletes()
+	if _, ok := cf.missing["flickering"]; ok {
+		t.Error("the file is back and should no longer be missing")
+	}
+
+	// Gone again, long after it first went missing, but the grace
+	// period starts over.
+	gone = true
+	now = now.Add(time.Hour)
+	if n := deletes(); n != 0 {
+		t.Errorf("expected no deletes within the new grace period, got %d", n)
+	}
+}
+
+func TestWalkUnchangedFn(t *testing.T) {
+	os.RemoveAll("_unchangedfn")
+	defer os.RemoveAll("_unchangedfn")
+	os.Mkdir("_unchangedfn", 0755)
+	for _, name := range []string{"touched", "grown"} {
+		if err := ioutil.WriteFile(filepath.Join("_unchangedfn", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := Config{
+		Dir:                   "_unchangedfn",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+	}
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := make(fakeCurrentFiler)
+	for f := range fchan {
+		cf[f.Name] = f
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join("_unchangedfn", "touched"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("_unchangedfn", "grown"), []byte("grown some"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(fn func(cur protocol.FileInfo, info fs.FileInfo) bool) []string {
+		cfg.CurrentFiler = cf
+		cfg.UnchangedFn = fn
+		fchan, err := Walk(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for f := range fchan {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if names := walk(nil); !reflect.DeepEqual(names, []string{"grown", "touched"}) {
+		t.Errorf("built in: got %v", names)
+	}
+	sizeOnly := func(cur protocol.FileInfo, info fs.FileInfo) bool {
+		return cur.Type == protocol.FileInfoTypeFile && info.IsRegular() && cur.Size == info.Size()
+	}
+	if names := walk(sizeOnly); !reflect.DeepEqual(names, []string{"grown"}) {
+		t.Errorf("size only: got %v", names)
+	}
+}
+
+func TestWeakHashWork(t *testing.T) {
+	os.RemoveAll("_weakwork")
+	defer os.RemoveAll("_weakwork")
+	os.Mkdir("_weakwork", 0755)
+	sizes := map[string]int{"weak": 1000, "strong": 500}
+	for name, size := range sizes {
+		if err := ioutil.WriteFile(filepath.Join("_weakwork", name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	progress := newByteCounter()
+	defer progress.Close()
+	work := newByteCounter()
+	defer work.Close()
+
+	cfg := Config{
+		Dir:              "_weakwork",
+		Filesystem:       fs.DefaultFilesystem,
+		BlockSize:        128 * 1024,
+		Hashers:          1,
+		WeakHashOverhead: 0.5,
+		WeakHashFn: func(relPath string, size int64) bool {
+			return relPath == "weak"
+		},
+	}
+	inbox := make(chan protocol.FileInfo, len(sizes))
+	outbox := make(chan protocol.FileInfo, len(sizes))
+	for name, size := range sizes {
+		inbox <- protocol.FileInfo{Name: name, Type: protocol.FileInfoTypeFile, Size: int64(size)}
+	}
+	close(inbox)
+	newParallelHasher(cfg, outbox, inbox, workCounter{progress, work, 1}, nil, newScanControl())
+	for range outbox {
+	}
+
+	if n := progress.Total(); n != 1500 {
+		t.Errorf("hashed %d bytes, expected 1500", n)
+	}
+	// The weak hashes make the 1000 bytes count as 1500.
+	if n := work.Total(); n != 2000 {
+		t.Errorf("work done %d, expected 2000", n)
+	}
+}
+
+func TestWalkChanges(t *testing.T) {
+	os.RemoveAll("_changes")
+	defer os.RemoveAll("_changes")
+	os.Mkdir("_changes", 0755)
+	for _, name := range []string{"modified", "perms", "deleted", "same"} {
+		if err := ioutil.WriteFile(filepath.Join("_changes", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := Config{
+		Dir:                   "_changes",
+		BlockSize:             128 * 1024,
+		Hashers:               2,
+		ProgressTickIntervalS: -1,
+	}
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := make(fakeCurrentFiler)
+	for f := range fchan {
+		cf[f.Name] = f
+	}
+
+	if err := ioutil.WriteFile(filepath.Join("_changes", "modified"), []byte("modified contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("_changes", "created"), []byte("created"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join("_changes", "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]ChangeKind{
+		"modified": ChangeModified,
+		"created":  ChangeCreated,
+		"deleted":  ChangeDeleted,
+	}
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(filepath.Join("_changes", "perms"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		expected["perms"] = ChangePermissions
+	}
+
+	cfg.CurrentFiler = cf
+	cfg.EmitDeletes = true
+	cfg.Subs = []string{"modified", "perms", "created", "deleted", "same"}
+	changes, err := WalkChanges(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]ChangeKind)
+	for c := range changes {
+		kinds[c.New.Name] = c.Kind
+		if old, ok := cf[c.New.Name]; ok != (c.Old != nil) || ok && old.Size != c.Old.Size {
+			t.Errorf("%s: unexpected old file %v", c.New.Name, c.Old)
+		}
+	}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("got changes %v, expected %v", kinds, expected)
+	}
+}
+
+func TestCPUThrottle(t *testing.T) {
+	cases := []struct {
+		busy     time.Duration
+		share    float64
+		expected time.Duration
+	}{
+		{time.Second, 0.5, time.Second},
+		{time.Second, 0.25, 3 * time.Second},
+		{time.Second, 1, 0},
+		{time.Second, 2, 0},
+	}
+	for _, tc := range cases {
+		if pause := throttlePause(tc.busy, tc.share); pause != tc.expected {
+			t.Errorf("busy %v, share %v: pause %v, expected %v", tc.busy, tc.share, pause, tc.expected)
+		}
+	}
+
+	if share := (&Config{MaxHashCPUPercent: 50}).hashCPUShare(2); share != 0.25 {
+		t.Errorf("share %v, expected 0.25", share)
+	}
+
+	// The walker hashing small files itself is one more hasher.
+	ph := &parallelHasher{Config: Config{Hashers: 2}}
+	if n := ph.hashingRoutines(); n != 2 {
+		t.Errorf("%d hashing routines, expected 2", n)
+	}
+	ph.inline = true
+	if n := ph.hashingRoutines(); n != 3 {
+		t.Errorf("%d hashing routines with the walker, expected 3", n)
+	}
+
+	// A long pause ends at once when cancelled.
+	defer func(fn func() time.Time) { timeNow = fn }(timeNow)
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	cancel := make(chan struct{})
+	c := newCPUThrottle(nil, 0.01, cancel)
+	now = now.Add(time.Hour)
+	close(cancel)
+	start := time.Now()
+	c.Update(1)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("paused for %v after cancel", d)
+	}
+}
+
+func TestWalkSkipAppleMetadata(t *testing.T) {
+	os.RemoveAll("_applemeta")
+	defer os.RemoveAll("_applemeta")
+
+	os.MkdirAll("_applemeta/.Spotlight-V100", 0755)
+	os.MkdirAll("_applemeta/dir", 0755)
+	for _, name := range []string{"file", "._file", ".DS_Store", "dir/.DS_Store", ".Spotlight-V100/store", ".other"} {
+		if err := ioutil.WriteFile(filepath.Join("_applemeta", filepath.FromSlash(name)), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	skipped := make(map[string]SkipReason)
+	fchan, err := Walk(Config{
+		Dir:                   "_applemeta",
+		BlockSize:             128 * 1024,
+		Hashers:               1,
+		ProgressTickIntervalS: -1,
+		SkipAppleMetadata:     true,
+		SkipFn: func(relPath string, reason SkipReason) {
+			skipped[filepath.ToSlash(relPath)] = reason
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for f := range fchan {
+		names = append(names, filepath.ToSlash(f.Name))
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{".other", "dir", "file"}) {
+		t.Errorf("unexpected files %v", names)
+	}
+	expected := map[string]SkipReason{
+		"._file":          SkipAppleMetadata,
+		".DS_Store":       SkipAppleMetadata,
+		"dir/.DS_Store":   SkipAppleMetadata,
+		".Spotlight-V100": SkipAppleMetadata,
+	}
+	if !reflect.DeepEqual(skipped, expected) {
+		t.Errorf("unexpected skips %v", skipped)
+	}
+}
+
+func TestWalkModTimeFn(t *testing.T) {
+	os.RemoveAll("_modtimefn")
+	defer os.RemoveAll("_modtimefn")
+
+	os.MkdirAll("_modtimefn/dir", 0755)
+	if err := ioutil.WriteFile("_modtimefn/file", []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	supplied := time.Unix(1234567890, 123456789)
+	cfg := Config{
+		Dir:                   "_modtimefn",
+		BlockSize:             128 * 1024,
+		Hashers:               1,
+		ProgressTickIntervalS: -1,
+		ModTimeFn: func(relPath string, info fs.FileInfo) time.Time {
+			return supplied
+		},
+	}
+
+	fchan, err := Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := make(fakeCurrentFiler)
+	for f := range fchan {
+		if f.ModifiedS != supplied.Unix() || f.ModifiedNs != int32(supplied.Nanosecond()) {
+			t.Errorf("%s has modification time %d.%09d, expected the supplied one", f.Name, f.ModifiedS, f.ModifiedNs)
+		}
+		current[f.Name] = f
+	}
+	if len(current) != 2 {
+		t.Fatalf("expected two items, got %d", len(current))
+	}
+
+	// The supplied time is what the current file is compared to, so the
+	// file is unchanged, regardless of its time on disk.
+	cfg.CurrentFiler = current
+	fchan, err = Walk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f := range fchan {
+		t.Errorf("unexpected change %v", f)
 	}
 }